@@ -24,6 +24,10 @@ import (
 	"github.com/gin-gonic/gin"
 	"reflect"
 	"strings"
+	"system-conf/common"
+	"system-conf/common/cron"
+	"system-conf/common/es"
+	"system-conf/common/profile"
 )
 
 func BindHandler(this any, funcPrefix string, parent gin.IRouter) {
@@ -39,12 +43,22 @@ func BindHandler(this any, funcPrefix string, parent gin.IRouter) {
 }
 
 type Controller struct {
-	Parent gin.IRouter
+	Parent   gin.IRouter
+	ExecConf *ExecConf
+	Jobs     *cron.Scheduler
+	Serial   *common.SerialManager
+	// Events carries the service's event streams, one topic each
+	Events *es.EventSourceBroker
+	// Profiles polls serial devices described by profile files
+	Profiles *profile.Runner
+
+	watchingSerial bool
 }
 
 func NewController(parent gin.IRouter) *Controller {
 	ctx := &Controller{
 		Parent: parent,
+		Events: es.GetOrCreate(SystemEventsId),
 	}
 
 	return ctx
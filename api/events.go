@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"system-conf/common/es"
+)
+
+// SystemEventsId is the id of the broker behind Controller.Events.
+const SystemEventsId = "system"
+
+// EventBrokerDetail is a broker with its connected clients.
+type EventBrokerDetail struct {
+	*es.BrokerInfo
+	ClientList []*es.ClientInfo `json:"clientList"`
+}
+
+// EventLogs is a page of a broker's log; Next is the offset of the
+// following page.
+type EventLogs struct {
+	Lines []*es.LogLine `json:"lines"`
+	Next  uint64        `json:"next"`
+}
+
+// AutoBindEvents binds the event source broker endpoints under /events.
+func (m *Controller) AutoBindEvents() {
+	BindHandler(m, "BindEventsHandle", m.Parent.Group("/events"))
+}
+
+func eventBroker(c *gin.Context, resp *Response) *es.EventSourceBroker {
+	broker := es.Get(c.Param("id"))
+	if broker == nil {
+		resp.SetMessage("事件源不存在:%s", c.Param("id")).Abort(c, http.StatusNotFound)
+	}
+	return broker
+}
+
+// BindEventsHandleList godoc
+// @Summary 事件源列表
+// @Description 列出活动的事件源及其客户端数、待发送消息数和日志大小
+// @Tags 事件
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response{data=[]es.BrokerInfo}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /events [get]
+func (m *Controller) BindEventsHandleList(parent gin.IRouter) {
+	parent.GET("", func(c *gin.Context) {
+		list := es.List()
+		NewRestResponse().SetData(list).SetTotal(len(list)).OK(c)
+	})
+}
+
+// BindEventsHandleSchemas godoc
+// @Summary 事件负载模式
+// @Description 列出已注册的事件类型及其负载模式(envelope的type/schema字段)
+// @Tags 事件
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response{data=[]es.Schema}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /events/schemas [get]
+func (m *Controller) BindEventsHandleSchemas(parent gin.IRouter) {
+	parent.GET("/schemas", func(c *gin.Context) {
+		list := es.Schemas()
+		NewRestResponse().SetData(list).SetTotal(len(list)).OK(c)
+	})
+}
+
+// BindEventsHandleGet godoc
+// @Summary 事件源详情
+// @Description 获取事件源信息及已连接客户端(过滤条件、排队数、丢弃数)
+// @Tags 事件
+// @Security Bearer
+// @Produce  json
+// @Param id path string true "事件源ID" default(system)
+// @Success 200 {object} Response{data=EventBrokerDetail}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /events/{id} [get]
+func (m *Controller) BindEventsHandleGet(parent gin.IRouter) {
+	parent.GET("/:id", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if broker := eventBroker(c, resp); broker != nil {
+			resp.SetData(&EventBrokerDetail{BrokerInfo: broker.Info(), ClientList: broker.Clients()}).OK(c)
+		}
+	})
+}
+
+// BindEventsHandleClose godoc
+// @Summary 关闭事件源
+// @Description 关闭事件源并断开其所有客户端
+// @Tags 事件
+// @Security Bearer
+// @Produce  json
+// @Param id path string true "事件源ID"
+// @Success 200 {object} Response  '{"code":200,"msg":"OK"}'
+// @Router /events/{id} [delete]
+func (m *Controller) BindEventsHandleClose(parent gin.IRouter) {
+	parent.DELETE("/:id", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if c.Param("id") == SystemEventsId {
+			resp.SetMessage("系统事件源不能关闭").Abort(c, http.StatusForbidden)
+			return
+		}
+		if !es.Close(c.Param("id")) {
+			resp.SetMessage("事件源不存在:%s", c.Param("id")).Abort(c, http.StatusNotFound)
+			return
+		}
+		resp.OK(c)
+	})
+}
+
+// BindEventsHandleStream godoc
+// @Summary 订阅事件源
+// @Description 以EventSource订阅事件源，可按topic/src过滤，支持Last-Event-ID续传
+// @Tags 事件
+// @Security Bearer
+// @Produce  text/event-stream
+// @Param id path string true "事件源ID" default(system)
+// @Param topic query string false "主题,可用通配符,逗号分隔"
+// @Param src query string false "来源,可用通配符,逗号分隔"
+// @Param format query string false "raw/json/base64/envelope/msgpack/cbor" default(raw)
+// @Param compress query string false "envelope负载压缩:gzip/deflate"
+// @Param compressMin query int false "压缩的最小负载字节数" default(1024)
+// @Param overflow query string false "drop-oldest/drop-newest/disconnect"
+// @Success 200 {string} string
+// @Router /events/{id}/stream [get]
+func (m *Controller) BindEventsHandleStream(parent gin.IRouter) {
+	parent.GET("/:id/stream", func(c *gin.Context) {
+		if broker := eventBroker(c, NewRestResponse()); broker != nil {
+			broker.ServeGin(c)
+		}
+	})
+}
+
+// BindEventsHandleWs godoc
+// @Summary 订阅事件源(WebSocket)
+// @Description 以WebSocket订阅事件源，参数同EventSource订阅；客户端发送的消息以来源ws发布到inputTopic主题
+// @Tags 事件
+// @Security Bearer
+// @Param id path string true "事件源ID" default(system)
+// @Param topic query string false "主题,可用通配符,逗号分隔"
+// @Param src query string false "来源,可用通配符,逗号分隔"
+// @Param format query string false "raw/json/base64/envelope/msgpack/cbor" default(raw)
+// @Param compress query string false "envelope负载压缩:gzip/deflate"
+// @Param compressMin query int false "压缩的最小负载字节数" default(1024)
+// @Param inputTopic query string false "客户端消息发布的主题,默认为空主题"
+// @Success 101 {string} string
+// @Router /events/{id}/ws [get]
+func (m *Controller) BindEventsHandleWs(parent gin.IRouter) {
+	parent.GET("/:id/ws", func(c *gin.Context) {
+		if broker := eventBroker(c, NewRestResponse()); broker != nil {
+			broker.ServeWebSocket(c, broker.Topic(c.Query("inputTopic")).Writer("ws"))
+		}
+	})
+}
+
+// BindEventsHandleLogs godoc
+// @Summary 事件源日志
+// @Description 按行号分页查询事件源输入的日志(回车刷新的进度行只保留最后内容)；不带offset时返回最后tail行
+// @Tags 事件
+// @Security Bearer
+// @Produce  json
+// @Param id path string true "事件源ID"
+// @Param offset query int false "起始行号"
+// @Param limit query int false "最多返回行数" default(500)
+// @Param tail query int false "不带offset时返回的最后行数" default(100)
+// @Param src query string false "只返回指定来源,如stdout/stderr"
+// @Success 200 {object} Response{data=EventLogs}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /events/{id}/logs [get]
+func (m *Controller) BindEventsHandleLogs(parent gin.IRouter) {
+	parent.GET("/:id/logs", func(c *gin.Context) {
+		resp := NewRestResponse()
+		broker := eventBroker(c, resp)
+		if broker == nil {
+			return
+		}
+		logs := &EventLogs{}
+		if v, ok := c.GetQuery("offset"); ok {
+			offset, e := strconv.ParseUint(v, 10, 64)
+			if e != nil {
+				resp.SetMessage("参数错误:%v", e).Abort(c, http.StatusBadRequest)
+				return
+			}
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "500"))
+			logs.Lines, logs.Next = broker.Logs.Query(offset, limit, c.Query("src"))
+		} else {
+			tail, _ := strconv.Atoi(c.DefaultQuery("tail", "100"))
+			for _, line := range broker.Logs.Tail(tail) {
+				if src := c.Query("src"); src == "" || line.Src == src {
+					logs.Lines = append(logs.Lines, line)
+				}
+				logs.Next = line.Offset + 1
+			}
+		}
+		if logs.Lines == nil {
+			logs.Lines = []*es.LogLine{}
+		}
+		resp.SetData(logs).OK(c)
+	})
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/es"
+	"system-conf/common/log"
+	"text/template"
+	"time"
+)
+
+//go:embed exec.json
+var defaultExecConf []byte
+
+const (
+	defaultExecTimeout   = 10
+	defaultExecMaxOutput = 64 * 1024
+)
+
+// ExecCommandConf is one entry of the command allow-list. Args may reference
+// request params with text/template syntax, e.g. "{{.host}}"; every param
+// must be declared in Params with a regexp its value has to match in full.
+type ExecCommandConf struct {
+	Name      string            `json:"name"`
+	Desc      string            `json:"desc,omitempty"`
+	Path      string            `json:"path"`
+	Args      []string          `json:"args,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Defaults  map[string]string `json:"defaults,omitempty"`
+	Timeout   int               `json:"timeout,omitempty" example:"10"`
+	MaxOutput int               `json:"maxOutput,omitempty" example:"65536"`
+	// Charset of the command output: UTF-8, GB18030, GBK, Big5 or auto
+	Charset string `json:"charset,omitempty" example:"auto"`
+
+	patterns map[string]*regexp.Regexp
+	args     []*template.Template
+}
+
+type ExecConf struct {
+	Commands []*ExecCommandConf `json:"commands"`
+
+	byName map[string]*ExecCommandConf
+}
+
+func ParseExecConf(buf []byte) (conf *ExecConf, err error) {
+	conf = &ExecConf{}
+	if err = json.Unmarshal(buf, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse exec conf:%v", err)
+	}
+	conf.byName = make(map[string]*ExecCommandConf)
+	for _, cmd := range conf.Commands {
+		if cmd.Name == "" || cmd.Path == "" {
+			return nil, fmt.Errorf("exec command must have name and path")
+		}
+		if _, ok := conf.byName[cmd.Name]; ok {
+			return nil, fmt.Errorf("duplicated exec command:%s", cmd.Name)
+		}
+		cmd.patterns = make(map[string]*regexp.Regexp)
+		for k, v := range cmd.Params {
+			if cmd.patterns[k], err = regexp.Compile("^(?:" + v + ")$"); err != nil {
+				return nil, fmt.Errorf("bad pattern of %s.%s:%v", cmd.Name, k, err)
+			}
+		}
+		for i, a := range cmd.Args {
+			var tpl *template.Template
+			if tpl, err = template.New(fmt.Sprintf("%s.%d", cmd.Name, i)).Option("missingkey=error").Parse(a); err != nil {
+				return nil, fmt.Errorf("bad arg template of %s:%v", cmd.Name, err)
+			}
+			cmd.args = append(cmd.args, tpl)
+		}
+		conf.byName[cmd.Name] = cmd
+	}
+	return
+}
+
+// LoadExecConf reads the command allow-list from path, falling back to the
+// embedded default list when path is empty or does not exist.
+func LoadExecConf(path string) (*ExecConf, error) {
+	buf := defaultExecConf
+	if path != "" && common.Exists(path) {
+		var err error
+		if buf, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		log.Printf("exec conf loaded from %s", path)
+	}
+	return ParseExecConf(buf)
+}
+
+func (m *ExecConf) Get(name string) *ExecCommandConf {
+	if m == nil {
+		return nil
+	}
+	return m.byName[name]
+}
+
+// Render validates params against the declared patterns and expands the
+// argument templates. Each template expands to exactly one argument.
+func (m *ExecCommandConf) Render(params map[string]string) (args []string, err error) {
+	values := make(map[string]string)
+	for k, v := range m.Defaults {
+		values[k] = v
+	}
+	for k, v := range params {
+		p, ok := m.patterns[k]
+		if !ok {
+			return nil, fmt.Errorf("param %s is not allowed", k)
+		}
+		if !p.MatchString(v) {
+			return nil, fmt.Errorf("param %s has an invalid value", k)
+		}
+		values[k] = v
+	}
+	for _, tpl := range m.args {
+		sb := &strings.Builder{}
+		if err = tpl.Execute(sb, values); err != nil {
+			return nil, fmt.Errorf("failed to render args:%v", err)
+		}
+		args = append(args, sb.String())
+	}
+	return
+}
+
+type ExecRequest struct {
+	Name      string            `json:"name" example:"ping"`
+	Params    map[string]string `json:"params,omitempty"`
+	Timeout   int               `json:"timeout,omitempty" example:"10"`
+	MaxOutput int               `json:"maxOutput,omitempty" example:"65536"`
+}
+
+type ExecResult struct {
+	Name      string   `json:"name"`
+	Path      string   `json:"path"`
+	Args      []string `json:"args"`
+	ExitCode  int      `json:"exitCode"`
+	Signal    string   `json:"signal,omitempty"`
+	Duration  int64    `json:"duration" example:"12"`
+	Stdout    string   `json:"stdout"`
+	Stderr    string   `json:"stderr"`
+	Truncated bool     `json:"truncated,omitempty"`
+	TimedOut  bool     `json:"timedOut,omitempty"`
+	ErrMsg    string   `json:"errMsg,omitempty"`
+}
+
+// execJob is a prepared, validated invocation of an allow-listed command.
+type execJob struct {
+	*ExecCommandConf
+	args      []string
+	timeout   time.Duration
+	maxOutput int
+}
+
+func (m *ExecConf) prepare(req *ExecRequest) (job *execJob, err error) {
+	cmd := m.Get(req.Name)
+	if cmd == nil {
+		return nil, fmt.Errorf("command %s is not allowed", req.Name)
+	}
+	job = &execJob{ExecCommandConf: cmd}
+	if job.args, err = cmd.Render(req.Params); err != nil {
+		return nil, err
+	}
+	limit := cmd.Timeout
+	if limit <= 0 {
+		limit = defaultExecTimeout
+	}
+	if req.Timeout > 0 && req.Timeout < limit {
+		limit = req.Timeout
+	}
+	job.timeout = time.Duration(limit) * time.Second
+	job.maxOutput = cmd.MaxOutput
+	if job.maxOutput <= 0 {
+		job.maxOutput = defaultExecMaxOutput
+	}
+	if req.MaxOutput > 0 && req.MaxOutput < job.maxOutput {
+		job.maxOutput = req.MaxOutput
+	}
+	return
+}
+
+// run executes the job and hands every output line to cb. It returns once
+// the process has exited, the timeout elapsed or cx was cancelled.
+func (job *execJob) run(cx context.Context, cb common.ProcessOutputCB) (result *ExecResult, err error) {
+	result = &ExecResult{Name: job.Name, Path: job.Path, Args: job.args}
+	ex := common.NewExec("", job.Path)
+	ex.Args = job.args
+	ex.SetCallback(cb)
+	ex.SetCharset(common.ParseCharset(job.Charset))
+	tc, cancel := context.WithTimeout(cx, job.timeout)
+	defer cancel()
+	tm := time.Now()
+	if err = ex.Start(tc); err != nil {
+		return
+	}
+	if e := ex.Wait(); e != nil {
+		result.ErrMsg = e.Error()
+	}
+	result.Duration = time.Since(tm).Milliseconds()
+	status := ex.ExitStatus()
+	result.ExitCode, result.Signal = status.Code, status.Signal
+	result.TimedOut = errors.Is(tc.Err(), context.DeadlineExceeded)
+	return
+}
+
+// limitedBuffer keeps at most max bytes and remembers whether it dropped any.
+type limitedBuffer struct {
+	sb        strings.Builder
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) WriteString(s string) {
+	if left := b.max - b.sb.Len(); left < len(s) {
+		b.truncated = true
+		if left <= 0 {
+			return
+		}
+		s = s[:left]
+	}
+	b.sb.WriteString(s)
+}
+
+// BindSystemHandleListExec godoc
+// @Summary 可执行诊断命令列表
+// @Description 可执行诊断命令列表
+// @Tags 系统
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/exec [get]
+func (m *Controller) BindSystemHandleListExec(parent gin.IRouter) {
+	parent.GET("/exec", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if m.ExecConf == nil {
+			resp.SetData([]any{}).OK(c)
+			return
+		}
+		resp.SetData(m.ExecConf.Commands).OK(c)
+	})
+}
+
+// BindSystemHandleExec godoc
+// @Summary 执行诊断命令
+// @Description 执行白名单中的诊断命令，返回退出码、耗时及标准输出/错误
+// @Tags 系统
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param req body ExecRequest true "命令"
+// @Success 200 {object} Response{data=ExecResult}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/exec [post]
+func (m *Controller) BindSystemHandleExec(parent gin.IRouter) {
+	parent.POST("/exec", func(c *gin.Context) {
+		resp := NewRestResponse()
+		req := &ExecRequest{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		job, err := m.ExecConf.prepare(req)
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		var mu sync.Mutex
+		stdout := &limitedBuffer{max: job.maxOutput}
+		stderr := &limitedBuffer{max: job.maxOutput}
+		result, err := job.run(c.Request.Context(), func(isErr bool, line string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if isErr {
+				stderr.WriteString(line)
+			} else {
+				stdout.WriteString(line)
+			}
+		})
+		if err != nil {
+			resp.SetMessage("执行失败:%v", err).Abort(c, http.StatusInternalServerError)
+			return
+		}
+		result.Stdout, result.Stderr = stdout.sb.String(), stderr.sb.String()
+		result.Truncated = stdout.truncated || stderr.truncated
+		resp.SetData(result).OK(c)
+	})
+}
+
+// parseExecQuery builds an ExecRequest from query args; every key other than
+// the reserved ones is treated as a template param.
+func parseExecQuery(c *gin.Context) *ExecRequest {
+	req := &ExecRequest{Name: c.Query("name"), Params: make(map[string]string)}
+	if v := common.ParseIntFromQuery(c, "timeout"); v != nil {
+		req.Timeout = *v
+	}
+	if v := common.ParseIntFromQuery(c, "maxOutput"); v != nil {
+		req.MaxOutput = *v
+	}
+	for k, v := range c.Request.URL.Query() {
+		switch k {
+		case "name", "timeout", "maxOutput", "raw", "format", "token":
+		default:
+			if len(v) > 0 {
+				req.Params[k] = v[0]
+			}
+		}
+	}
+	return req
+}
+
+// BindSystemHandleExecStream godoc
+// @Summary 执行诊断命令(SSE)
+// @Description 以 event-stream 方式实时输出诊断命令的标准输出/错误，最后一条消息(src=result)为执行结果。GET 时命令参数通过 query 传入
+// @Tags 系统
+// @Security Bearer
+// @Accept  json
+// @Produce  text/event-stream
+// @Param name query string false "命令名" default(ping)
+// @Param format query string false "raw/json/base64" default(raw)
+// @Param req body ExecRequest false "命令"
+// @Success 200 {string} string "event stream"
+// @Router /system/exec.stream [post]
+func (m *Controller) BindSystemHandleExecStream(parent gin.IRouter) {
+	parent.Match([]string{http.MethodGet, http.MethodPost}, "/exec.stream", func(c *gin.Context) {
+		resp := NewRestResponse()
+		req := &ExecRequest{}
+		if c.Request.Method == http.MethodGet {
+			req = parseExecQuery(c)
+		} else if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		job, err := m.ExecConf.prepare(req)
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		flusher, ok := c.Writer.(http.Flusher)
+		if !ok {
+			resp.SetMessage("Streaming unsupported!").Abort(c, http.StatusInternalServerError)
+			return
+		}
+		raw := false
+		if v := common.ParseIntFromQuery(c, "raw"); v != nil && *v > 0 {
+			raw = true
+		}
+		format := c.DefaultQuery("format", "raw")
+		c.Writer.Header().Set("Content-Type", "text/event-stream;charset=UTF-8")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Status(http.StatusOK)
+
+		id := fmt.Sprintf("exec.%s", job.Name)
+		msgs := make(chan es.IEventSourceMessage, 64)
+		var result *ExecResult
+		go func() {
+			defer close(msgs)
+			var mu sync.Mutex
+			sent := 0
+			truncated := false
+			result, err = job.run(c.Request.Context(), func(isErr bool, line string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if sent >= job.maxOutput {
+					truncated = true
+					return
+				}
+				sent += len(line)
+				src := "stdout"
+				if isErr {
+					src = "stderr"
+				}
+				msgs <- &es.MessageStrBody{Id: id, Src: src, Data: line}
+			})
+			if result != nil {
+				result.Truncated = truncated
+			}
+		}()
+		for msg := range msgs {
+			es.WriteEsData(c.Writer, raw, format, msg)
+			flusher.Flush()
+		}
+		final := es.EventSourceResult{}
+		if err != nil {
+			final.Code, final.Message = http.StatusInternalServerError, fmt.Sprintf("执行失败:%v", err)
+		} else {
+			final.Message = "ok"
+			final.Cost = time.Duration(result.Duration) * time.Millisecond
+		}
+		es.WriteEsData(c.Writer, raw, "json", &es.MessageBody{Id: id, Src: "result", Data: result, EventSourceResult: &final})
+		flusher.Flush()
+	})
+}
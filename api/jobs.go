@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"system-conf/common/cron"
+	"time"
+)
+
+// JobRequest defines a scheduled job. Exactly one of Exec (a command from
+// the exec allow-list) or Action (a built-in action) must be set.
+type JobRequest struct {
+	Name    string            `json:"name" example:"disk cleanup"`
+	Spec    string            `json:"spec" example:"0 3 * * *"`
+	Enabled bool              `json:"enabled" example:"true"`
+	Exec    *ExecRequest      `json:"exec,omitempty"`
+	Action  string            `json:"action,omitempty" example:"disk.cleanup"`
+	Params  map[string]string `json:"params,omitempty"`
+	Timeout int               `json:"timeout,omitempty" example:"600"`
+}
+
+func (m *Controller) buildJob(req *JobRequest) (job *cron.Job, err error) {
+	job = &cron.Job{
+		Name:    req.Name,
+		Spec:    req.Spec,
+		Enabled: req.Enabled,
+		Action:  req.Action,
+		Params:  req.Params,
+		Timeout: req.Timeout,
+	}
+	if req.Exec != nil {
+		if req.Action != "" {
+			return nil, errors.New("exec and action are exclusive")
+		}
+		var ej *execJob
+		if ej, err = m.ExecConf.prepare(req.Exec); err != nil {
+			return nil, err
+		}
+		job.Command, job.Args, job.Charset = ej.Path, ej.args, ej.Charset
+		job.Params = req.Exec.Params
+		// the allow-list limits still apply; a job may only tighten them
+		limit := int(ej.timeout / time.Second)
+		if req.Timeout > 0 && req.Timeout < limit {
+			limit = req.Timeout
+		}
+		job.Timeout, job.MaxOutput = limit, ej.maxOutput
+	}
+	return
+}
+
+func (m *Controller) jobsReady(c *gin.Context, resp *Response) bool {
+	if m.Jobs == nil {
+		resp.SetMessage("任务调度未启用").Abort(c, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func abortJobErr(c *gin.Context, resp *Response, err error) {
+	if errors.Is(err, cron.ErrJobNotFound) {
+		resp.SetMessage("任务不存在").Abort(c, http.StatusNotFound)
+	} else {
+		resp.SetMessage("任务操作失败:%v", err).Abort(c, http.StatusBadRequest)
+	}
+}
+
+// BindSystemHandleListJobs godoc
+// @Summary 定时任务列表
+// @Description 定时任务列表，包含上次/下次执行时间、退出码及输出尾部
+// @Tags 定时任务
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response{data=[]cron.Job}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/jobs [get]
+func (m *Controller) BindSystemHandleListJobs(parent gin.IRouter) {
+	parent.GET("/jobs", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.jobsReady(c, resp) {
+			return
+		}
+		jobs := m.Jobs.List()
+		resp.SetData(jobs).SetTotal(len(jobs)).OK(c)
+	})
+}
+
+// BindSystemHandleGetJob godoc
+// @Summary 获取定时任务
+// @Description 获取定时任务
+// @Tags 定时任务
+// @Security Bearer
+// @Produce  json
+// @Param id path string true "任务id"
+// @Success 200 {object} Response{data=cron.Job}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/jobs/{id} [get]
+func (m *Controller) BindSystemHandleGetJob(parent gin.IRouter) {
+	parent.GET("/jobs/:id", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.jobsReady(c, resp) {
+			return
+		}
+		if job, ok := m.Jobs.Get(c.Param("id")); ok {
+			resp.SetData(job).OK(c)
+		} else {
+			abortJobErr(c, resp, cron.ErrJobNotFound)
+		}
+	})
+}
+
+// BindSystemHandleCreateJob godoc
+// @Summary 新建定时任务
+// @Description 新建定时任务，spec 为5段 cron 表达式或 @daily/@every 1h 等；内置动作 disk.cleanup、file.snapshot、log.upload 的路径参数必须位于 -jobs.roots 配置的目录之下
+// @Tags 定时任务
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param job body JobRequest true "任务"
+// @Success 201 {object} Response  '{"code":0,"createdId":"","msg":""}'
+// @Router /system/jobs [post]
+func (m *Controller) BindSystemHandleCreateJob(parent gin.IRouter) {
+	parent.POST("/jobs", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.jobsReady(c, resp) {
+			return
+		}
+		req := &JobRequest{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		job, err := m.buildJob(req)
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		if id, e := m.Jobs.Add(job); e != nil {
+			abortJobErr(c, resp, e)
+		} else {
+			resp.Created(c, id)
+		}
+	})
+}
+
+// BindSystemHandleUpdateJob godoc
+// @Summary 修改定时任务
+// @Description 修改定时任务
+// @Tags 定时任务
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param id path string true "任务id"
+// @Param job body JobRequest true "任务"
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/jobs/{id} [put]
+func (m *Controller) BindSystemHandleUpdateJob(parent gin.IRouter) {
+	parent.PUT("/jobs/:id", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.jobsReady(c, resp) {
+			return
+		}
+		req := &JobRequest{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		job, err := m.buildJob(req)
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		if e := m.Jobs.Update(c.Param("id"), job); e != nil {
+			abortJobErr(c, resp, e)
+		} else {
+			resp.OK(c)
+		}
+	})
+}
+
+// BindSystemHandleDeleteJob godoc
+// @Summary 删除定时任务
+// @Description 删除定时任务
+// @Tags 定时任务
+// @Security Bearer
+// @Produce  json
+// @Param id path string true "任务id"
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/jobs/{id} [delete]
+func (m *Controller) BindSystemHandleDeleteJob(parent gin.IRouter) {
+	parent.DELETE("/jobs/:id", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.jobsReady(c, resp) {
+			return
+		}
+		if e := m.Jobs.Remove(c.Param("id")); e != nil {
+			abortJobErr(c, resp, e)
+		} else {
+			resp.OK(c)
+		}
+	})
+}
+
+// BindSystemHandleRunJob godoc
+// @Summary 立即执行定时任务
+// @Description 立即执行定时任务，不影响下次计划执行时间
+// @Tags 定时任务
+// @Security Bearer
+// @Produce  json
+// @Param id path string true "任务id"
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/jobs/{id}/run [post]
+func (m *Controller) BindSystemHandleRunJob(parent gin.IRouter) {
+	parent.POST("/jobs/:id/run", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.jobsReady(c, resp) {
+			return
+		}
+		if e := m.Jobs.RunNow(c.Param("id")); e != nil {
+			abortJobErr(c, resp, e)
+		} else {
+			resp.SetMessage("任务已启动").OK(c)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"system-conf/common/modbus"
+	"time"
+)
+
+type ModbusRequest struct {
+	Unit byte `json:"unit" example:"1"`
+	// readCoils/readDiscreteInputs/readHoldingRegisters/readInputRegisters/
+	// writeSingleCoil/writeSingleRegister/writeMultipleCoils/writeMultipleRegisters
+	Function string `json:"function" example:"readHoldingRegisters"`
+	Address  uint16 `json:"address" example:"0"`
+	Quantity uint16 `json:"quantity,omitempty" example:"10"`
+	// values to write; for coils any non-zero value means on
+	Values  []uint16 `json:"values,omitempty"`
+	Timeout int      `json:"timeout,omitempty" example:"1000"`
+	Retries *int     `json:"retries,omitempty" example:"2"`
+}
+
+type ModbusResult struct {
+	Function  string   `json:"function"`
+	Address   uint16   `json:"address"`
+	Registers []uint16 `json:"registers,omitempty"`
+	Bits      []bool   `json:"bits,omitempty"`
+	Duration  int64    `json:"duration"`
+}
+
+func doModbus(cx context.Context, master *modbus.RTUMaster, req *ModbusRequest) (result *ModbusResult, err error) {
+	result = &ModbusResult{Function: req.Function, Address: req.Address}
+	bits := func() []bool {
+		values := make([]bool, len(req.Values))
+		for i, v := range req.Values {
+			values[i] = v != 0
+		}
+		return values
+	}
+	single := func() (uint16, error) {
+		if len(req.Values) != 1 {
+			return 0, errors.New("exactly one value is required")
+		}
+		return req.Values[0], nil
+	}
+	switch req.Function {
+	case "readCoils":
+		result.Bits, err = master.ReadCoils(cx, req.Unit, req.Address, req.Quantity)
+	case "readDiscreteInputs":
+		result.Bits, err = master.ReadDiscreteInputs(cx, req.Unit, req.Address, req.Quantity)
+	case "readHoldingRegisters":
+		result.Registers, err = master.ReadHoldingRegisters(cx, req.Unit, req.Address, req.Quantity)
+	case "readInputRegisters":
+		result.Registers, err = master.ReadInputRegisters(cx, req.Unit, req.Address, req.Quantity)
+	case "writeSingleCoil":
+		var v uint16
+		if v, err = single(); err == nil {
+			err = master.WriteSingleCoil(cx, req.Unit, req.Address, v != 0)
+		}
+	case "writeSingleRegister":
+		var v uint16
+		if v, err = single(); err == nil {
+			err = master.WriteSingleRegister(cx, req.Unit, req.Address, v)
+		}
+	case "writeMultipleCoils":
+		err = master.WriteMultipleCoils(cx, req.Unit, req.Address, bits())
+	case "writeMultipleRegisters":
+		err = master.WriteMultipleRegisters(cx, req.Unit, req.Address, req.Values)
+	default:
+		err = errors.New("unknown function")
+	}
+	return
+}
+
+// BindSystemHandleModbus godoc
+// @Summary Modbus RTU 读写
+// @Description 作为主站通过串口读写 Modbus RTU 从站的线圈/寄存器，用于调试
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param req body ModbusRequest true "请求"
+// @Success 200 {object} Response{data=ModbusResult}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/modbus [post]
+func (m *Controller) BindSystemHandleModbus(parent gin.IRouter) {
+	parent.POST("/serial/:name/modbus", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		req := &ModbusRequest{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		ctx, err := m.Serial.Ctx(c.Param("name"))
+		if err != nil {
+			resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		master := modbus.GetRTUMaster(ctx)
+		cx := c.Request.Context()
+		if req.Retries != nil {
+			cx = modbus.WithRetries(cx, *req.Retries)
+		}
+		if req.Timeout > 0 {
+			var cancel context.CancelFunc
+			cx, cancel = context.WithTimeout(cx, time.Duration(req.Timeout)*time.Millisecond)
+			defer cancel()
+		}
+		tm := time.Now()
+		result, err := doModbus(cx, master, req)
+		if err != nil {
+			var ex *modbus.Exception
+			if errors.As(err, &ex) {
+				resp.SetMessage("%v", err).SetData(ex).Abort(c, http.StatusBadGateway)
+			} else if errors.Is(err, modbus.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				resp.SetMessage("%v", err).Abort(c, http.StatusGatewayTimeout)
+			} else {
+				resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+			}
+			return
+		}
+		result.Duration = time.Since(tm).Milliseconds()
+		resp.SetData(result).OK(c)
+	})
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"system-conf/common/modbus"
+)
+
+type ModbusSlaveRequest struct {
+	Unit     byte `json:"unit" example:"1"`
+	Coils    int  `json:"coils" example:"64"`
+	Discrete int  `json:"discrete" example:"64"`
+	Holding  int  `json:"holding" example:"128"`
+	Input    int  `json:"input" example:"128"`
+}
+
+type ModbusSlaveInfo struct {
+	Unit     byte              `json:"unit"`
+	Coils    int               `json:"coils"`
+	Discrete int               `json:"discrete"`
+	Holding  int               `json:"holding"`
+	Input    int               `json:"input"`
+	Stats    modbus.SlaveStats `json:"stats"`
+}
+
+type ModbusRegisterWrite struct {
+	Address uint16   `json:"address" example:"0"`
+	Values  []uint16 `json:"values"`
+}
+
+func newModbusSlaveInfo(s *modbus.RTUSlave) *ModbusSlaveInfo {
+	regs := s.Registers
+	return &ModbusSlaveInfo{
+		Unit:     s.UnitId,
+		Coils:    regs.Size(modbus.Coils),
+		Discrete: regs.Size(modbus.DiscreteInputs),
+		Holding:  regs.Size(modbus.HoldingRegisters),
+		Input:    regs.Size(modbus.InputRegisters),
+		Stats:    s.Stats(),
+	}
+}
+
+// modbusSlave looks up the slave running on the port named in the path.
+func (m *Controller) modbusSlave(c *gin.Context, resp *Response) *modbus.RTUSlave {
+	if !m.serialReady(c, resp) {
+		return nil
+	}
+	ctx, err := m.Serial.Ctx(c.Param("name"))
+	if err != nil {
+		resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+		return nil
+	}
+	slave := modbus.GetRTUSlave(ctx)
+	if slave == nil {
+		resp.SetMessage("串口未运行Modbus从站").Abort(c, http.StatusNotFound)
+	}
+	return slave
+}
+
+// BindSystemHandleStartModbusSlave godoc
+// @Summary 启动Modbus RTU从站
+// @Description 在串口上以指定站号运行Modbus RTU从站，寄存器表保存在内存中
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param req body ModbusSlaveRequest true "站号与各表大小"
+// @Success 200 {object} Response{data=ModbusSlaveInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/modbus.slave [post]
+func (m *Controller) BindSystemHandleStartModbusSlave(parent gin.IRouter) {
+	parent.POST("/serial/:name/modbus.slave", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		req := &ModbusSlaveRequest{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		ctx, err := m.Serial.Ctx(c.Param("name"))
+		if err != nil {
+			resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		regs := modbus.NewRegisterMap(req.Coils, req.Discrete, req.Holding, req.Input)
+		slave := modbus.NewRTUSlave(ctx, req.Unit, regs)
+		if e := slave.Start(); e != nil {
+			resp.SetMessage("启动从站失败:%v", e).Abort(c, http.StatusConflict)
+			return
+		}
+		resp.SetData(newModbusSlaveInfo(slave)).OK(c)
+	})
+}
+
+// BindSystemHandleGetModbusSlave godoc
+// @Summary Modbus RTU从站状态
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response{data=ModbusSlaveInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/modbus.slave [get]
+func (m *Controller) BindSystemHandleGetModbusSlave(parent gin.IRouter) {
+	parent.GET("/serial/:name/modbus.slave", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if slave := m.modbusSlave(c, resp); slave != nil {
+			resp.SetData(newModbusSlaveInfo(slave)).OK(c)
+		}
+	})
+}
+
+// BindSystemHandleStopModbusSlave godoc
+// @Summary 停止Modbus RTU从站
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name}/modbus.slave [delete]
+func (m *Controller) BindSystemHandleStopModbusSlave(parent gin.IRouter) {
+	parent.DELETE("/serial/:name/modbus.slave", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if slave := m.modbusSlave(c, resp); slave != nil {
+			slave.Stop()
+			resp.OK(c)
+		}
+	})
+}
+
+// BindSystemHandleReadModbusSlave godoc
+// @Summary 读取从站寄存器表
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param table path string true "coils/discrete/holding/input" default(holding)
+// @Param address query int false "起始地址" default(0)
+// @Param quantity query int false "数量" default(1)
+// @Success 200 {object} Response{data=[]uint16}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name}/modbus.slave/{table} [get]
+func (m *Controller) BindSystemHandleReadModbusSlave(parent gin.IRouter) {
+	parent.GET("/serial/:name/modbus.slave/:table", func(c *gin.Context) {
+		resp := NewRestResponse()
+		slave := m.modbusSlave(c, resp)
+		if slave == nil {
+			return
+		}
+		table, err := modbus.ParseTable(c.Param("table"))
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		addr, err1 := strconv.ParseUint(c.DefaultQuery("address", "0"), 10, 16)
+		qty, err2 := strconv.Atoi(c.DefaultQuery("quantity", "1"))
+		if err1 != nil || err2 != nil {
+			resp.SetMessage("参数错误:address/quantity").Abort(c, http.StatusBadRequest)
+			return
+		}
+		values, err := slave.Registers.Get(table, uint16(addr), qty)
+		if err != nil {
+			resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		resp.SetData(values).SetTotal(len(values)).OK(c)
+	})
+}
+
+// BindSystemHandleWriteModbusSlave godoc
+// @Summary 写入从站寄存器表
+// @Description 修改从站内存中的寄存器/线圈值，线圈非0即为1
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param table path string true "coils/discrete/holding/input" default(holding)
+// @Param req body ModbusRegisterWrite true "起始地址与值"
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name}/modbus.slave/{table} [put]
+func (m *Controller) BindSystemHandleWriteModbusSlave(parent gin.IRouter) {
+	parent.PUT("/serial/:name/modbus.slave/:table", func(c *gin.Context) {
+		resp := NewRestResponse()
+		slave := m.modbusSlave(c, resp)
+		if slave == nil {
+			return
+		}
+		table, err := modbus.ParseTable(c.Param("table"))
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		req := &ModbusRegisterWrite{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		if e := slave.Registers.Set(table, req.Address, req.Values...); e != nil {
+			resp.SetMessage("%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		resp.OK(c)
+	})
+}
@@ -0,0 +1,449 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"system-conf/common/log"
+	"system-conf/common/mqtt"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// DefaultRemotePrefix is the path the remote routes are relative to
+	DefaultRemotePrefix = "/api/system"
+	// DefaultRemoteTimeout bounds a remote request; streaming handlers
+	// such as the event sources end with it
+	DefaultRemoteTimeout = 30 * time.Second
+	// DefaultRemoteMaxBody caps the response published back
+	DefaultRemoteMaxBody = 1 << 20
+	// DefaultRemoteConcurrency is how many requests are served at once
+	DefaultRemoteConcurrency = 8
+	// DefaultRemoteAllow is the read-only routes served if Allow is not set
+	DefaultRemoteAllow = "GET ip,GET time,GET exec,GET jobs,GET jobs/*,GET serial,GET serial/*,GET serial.profiles,GET serial.profiles/*"
+)
+
+// RemoteRequest is the payload of a request on <root>/<sn>/req/<route>; an
+// empty payload is a GET. The MQTT 5 response topic property names where
+// the response goes and must lie under <root>/<sn>/res/, so a request
+// cannot make the device publish anywhere else on the broker; the
+// correlation data property is echoed on the response.
+type RemoteRequest struct {
+	Method string `json:"method,omitempty" example:"GET"`
+	// Query values are strings, numbers, booleans or lists of them
+	Query map[string]any      `json:"query,omitempty"`
+	Body  jsoniter.RawMessage `json:"body,omitempty" swaggertype:"object"`
+}
+
+// RemoteResponse is published to the response topic of a request, by
+// default <root>/<sn>/res/<route>. Response is what the handler wrote,
+// usually the Response JSON, or a string if it is not JSON.
+type RemoteResponse struct {
+	Route     string              `json:"route"`
+	Status    int                 `json:"status"`
+	Response  jsoniter.RawMessage `json:"response,omitempty" swaggertype:"object"`
+	Truncated bool                `json:"truncated,omitempty"`
+	Cost      time.Duration       `json:"cost" swaggertype:"integer"`
+}
+
+// MqttRemote serves the REST API over MQTT for devices that are only
+// reachable through the broker: a request published on
+// <Root>/<sn>/req/<route> is dispatched to Handler as <Prefix>/<route>,
+// so it runs the same gin handlers as over HTTP. It keeps its own MQTT 5
+// connection, as the session speaks MQTT 3.1.1 which has no response
+// topic or correlation data.
+type MqttRemote struct {
+	Options *mqtt.Options
+	Handler http.Handler
+	Root    string
+	Prefix  string
+	Qos     byte
+	Timeout time.Duration
+	MaxBody int
+	// Allow lists the routes served as "METHOD route", the route being a
+	// path.Match pattern relative to Prefix and the method * for any;
+	// nothing is served if it is empty.
+	Allow []string
+
+	mu     sync.Mutex
+	sem    chan struct{}
+	cm     *autopaho.ConnectionManager
+	cancel context.CancelFunc
+	// publish replaces the connection in tests
+	publish func(cx context.Context, p *paho.Publish) error
+}
+
+func NewMqttRemote(opt *mqtt.Options, handler http.Handler, root string) *MqttRemote {
+	return &MqttRemote{
+		Options: opt,
+		Handler: handler,
+		Root:    strings.TrimSuffix(root, "/"),
+		Prefix:  DefaultRemotePrefix,
+		Qos:     1,
+		Timeout: DefaultRemoteTimeout,
+		MaxBody: DefaultRemoteMaxBody,
+		Allow:   strings.Split(DefaultRemoteAllow, ","),
+		sem:     make(chan struct{}, DefaultRemoteConcurrency),
+	}
+}
+
+// TopicFor returns <Root>/<sn>/<kind>/<route>, kind being req or res; sn
+// is log.Sn.
+func (r *MqttRemote) TopicFor(kind, route string) string {
+	return strings.Join([]string{r.Root, log.Sn, kind, route}, "/")
+}
+
+// Start connects to the broker of Options and subscribes to the requests;
+// the connection is retried in the background.
+func (r *MqttRemote) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cm != nil {
+		return nil
+	}
+	opt := r.Options
+	if opt == nil || !opt.IsEnabled() {
+		return fmt.Errorf("invalid value of addr")
+	}
+	var servers []*url.URL
+	for _, addr := range strings.Split(opt.Addr, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		u, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid mqtt addr %s: %v", addr, err)
+		}
+		servers = append(servers, u)
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("addr list is empty")
+	}
+	cid := opt.ClientId
+	if cid == "" {
+		cid = mqtt.SnClientId()
+	}
+	retry := opt.RetryInterval
+	if retry <= 0 {
+		retry = mqtt.DefaultConnectRetryInterval
+	}
+	filter := r.TopicFor("req", "#")
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    servers,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectRetryDelay:             retry,
+		ConnectTimeout:                opt.Timeout,
+		ConnectUsername:               opt.Un,
+		ConnectPassword:               []byte(opt.Pw),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			cx, cancel := context.WithTimeout(context.Background(), retry)
+			defer cancel()
+			if _, err := cm.Subscribe(cx, &paho.Subscribe{
+				Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: r.Qos}},
+			}); err != nil {
+				log.Warnf("mqtt remote: failed to subscribe %s: %v", filter, err)
+				return
+			}
+			log.Printf("serving %s over mqtt on %s", r.Prefix, filter)
+		},
+		OnConnectError: func(err error) {
+			log.Warnf("mqtt remote: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: cid + "-mgmt",
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					r.receive(pr.Packet)
+					return true, nil
+				},
+			},
+		},
+	}
+	cx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(cx, cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	r.cm, r.cancel = cm, cancel
+	return nil
+}
+
+// Stop waits until the requests in flight got their response or cx is
+// done, then disconnects.
+func (r *MqttRemote) Stop(cx context.Context) {
+	r.mu.Lock()
+	cm := r.cm
+	r.mu.Unlock()
+	if cm == nil {
+		return
+	}
+	_, _ = cm.Unsubscribe(cx, &paho.Unsubscribe{Topics: []string{r.TopicFor("req", "#")}})
+	// every slot taken means no request is in flight
+	held := 0
+	for held < cap(r.sem) && cx.Err() == nil {
+		select {
+		case r.sem <- struct{}{}:
+			held++
+		case <-cx.Done():
+		}
+	}
+	r.mu.Lock()
+	cancel := r.cancel
+	if r.cm == cm {
+		r.cm, r.cancel = nil, nil
+	} else {
+		// stopped meanwhile
+		cancel = nil
+	}
+	r.mu.Unlock()
+	if cancel != nil {
+		_ = cm.Disconnect(cx)
+		cancel()
+	}
+	for ; held > 0; held-- {
+		<-r.sem
+	}
+}
+
+// receive runs on the MQTT client's goroutine, which must not block.
+func (r *MqttRemote) receive(p *paho.Publish) {
+	route := strings.TrimPrefix(p.Topic, r.TopicFor("req", ""))
+	props := p.Properties
+	if props == nil {
+		props = &paho.PublishProperties{}
+	}
+	req := &RemoteRequest{}
+	var err error
+	if payload := bytes.TrimSpace(p.Payload); len(payload) > 0 {
+		err = json.Unmarshal(payload, req)
+	}
+	reply := r.TopicFor("res", route)
+	if props.ResponseTopic != "" {
+		if !r.validReplyTopic(props.ResponseTopic) {
+			r.reply(reply, props.CorrelationData, r.failure(route, http.StatusBadRequest, "响应主题必须位于%s之下", r.TopicFor("res", "")))
+			return
+		}
+		reply = props.ResponseTopic
+	}
+	if err != nil {
+		r.reply(reply, props.CorrelationData, r.failure(route, http.StatusBadRequest, "请求格式错误:%v", err))
+		return
+	}
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		r.reply(reply, props.CorrelationData, r.failure(route, http.StatusServiceUnavailable, "远程请求过多"))
+		return
+	}
+	go func() {
+		defer func() { <-r.sem }()
+		r.reply(reply, props.CorrelationData, r.Do(route, req))
+	}()
+}
+
+// validReplyTopic accepts a topic name, not a filter, below <Root>/<sn>/res/.
+func (r *MqttRemote) validReplyTopic(topic string) bool {
+	prefix := r.TopicFor("res", "")
+	return len(topic) > len(prefix) && strings.HasPrefix(topic, prefix) &&
+		!strings.ContainsAny(topic, "+#\x00")
+}
+
+func (r *MqttRemote) failure(route string, status int, msg string, args ...any) *RemoteResponse {
+	buf, _ := json.Marshal(NewRestResponse().SetCode(status).SetMessage(msg, args...))
+	return &RemoteResponse{Route: route, Status: status, Response: buf}
+}
+
+// reply publishes resp with the correlation data of the request.
+func (r *MqttRemote) reply(topic string, correlation []byte, resp *RemoteResponse) {
+	buf, _ := json.Marshal(resp)
+	cx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	err := r.send(cx, &paho.Publish{
+		Topic: topic,
+		QoS:   r.Qos,
+		Properties: &paho.PublishProperties{
+			CorrelationData: correlation,
+			ContentType:     "application/json",
+		},
+		Payload: buf,
+	})
+	if err != nil {
+		log.Warnf("mqtt remote: failed to reply on %s: %v", topic, err)
+	}
+}
+
+func (r *MqttRemote) send(cx context.Context, p *paho.Publish) error {
+	if r.publish != nil {
+		return r.publish(cx, p)
+	}
+	r.mu.Lock()
+	cm := r.cm
+	r.mu.Unlock()
+	if cm == nil {
+		return fmt.Errorf("mqtt remote is stopped")
+	}
+	_, err := cm.Publish(cx, p)
+	return err
+}
+
+// allowed reports whether Allow has an entry for method and route.
+func (r *MqttRemote) allowed(method, route string) bool {
+	for _, entry := range r.Allow {
+		m, pattern, ok := strings.Cut(strings.TrimSpace(entry), " ")
+		if !ok || (m != "*" && !strings.EqualFold(m, method)) {
+			continue
+		}
+		if ok, _ := path.Match(strings.TrimSpace(pattern), route); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Do runs req against Handler as <Prefix>/<route> if Allow lets it.
+func (r *MqttRemote) Do(route string, req *RemoteRequest) *RemoteResponse {
+	start := time.Now()
+	prefix := strings.TrimSuffix(r.Prefix, "/") + "/"
+	p := path.Join(r.Prefix, route)
+	if route == "" || !strings.HasPrefix(p+"/", prefix) {
+		return r.failure(route, http.StatusBadRequest, "参数错误:%s", route)
+	}
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !r.allowed(method, strings.TrimPrefix(p, prefix)) {
+		return r.failure(route, http.StatusForbidden, "该路由未开放远程访问:%s %s", method, route)
+	}
+	query := url.Values{}
+	for k, v := range req.Query {
+		if list, ok := v.([]any); ok {
+			for _, item := range list {
+				query.Add(k, fmt.Sprint(item))
+			}
+		} else {
+			query.Add(k, fmt.Sprint(v))
+		}
+	}
+	cx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	target := (&url.URL{Path: p, RawQuery: query.Encode()}).String()
+	hr, err := http.NewRequestWithContext(cx, method, target, bytes.NewReader(req.Body))
+	if err != nil {
+		return r.failure(route, http.StatusBadRequest, "请求格式错误:%v", err)
+	}
+	if len(req.Body) > 0 {
+		hr.Header.Set("Content-Type", "application/json")
+	}
+	// the client address of the request, e.g. in the event source client list
+	hr.RemoteAddr = "mqtt:0"
+	w := newRemoteWriter(cx, r.MaxBody)
+	r.Handler.ServeHTTP(w, hr)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	resp := &RemoteResponse{
+		Route:     route,
+		Status:    w.status,
+		Truncated: w.truncated,
+		Cost:      time.Since(start),
+	}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	if body := w.body.Bytes(); len(body) > 0 {
+		if json.Valid(body) {
+			resp.Response = append(jsoniter.RawMessage(nil), body...)
+		} else {
+			resp.Response, _ = json.Marshal(string(body))
+		}
+	}
+	return resp
+}
+
+// remoteWriter collects a response in memory. It flushes and notifies of
+// closing like a connection, so streaming handlers run until the request
+// times out.
+type remoteWriter struct {
+	mu        sync.Mutex
+	cx        context.Context
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func newRemoteWriter(cx context.Context, max int) *remoteWriter {
+	return &remoteWriter{cx: cx, header: make(http.Header), max: max}
+}
+
+func (w *remoteWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *remoteWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *remoteWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if n := w.max - w.body.Len(); len(data) > n {
+		w.truncated = true
+		if n > 0 {
+			w.body.Write(data[:n])
+		}
+		return len(data), nil
+	}
+	return w.body.Write(data)
+}
+
+func (w *remoteWriter) Flush() {}
+
+func (w *remoteWriter) CloseNotify() <-chan bool {
+	ch := make(chan bool, 1)
+	go func() {
+		<-w.cx.Done()
+		ch <- true
+	}()
+	return ch
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"system-conf/common/log"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRemote(t *testing.T) (*MqttRemote, chan *paho.Publish) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/api/system/time", func(c *gin.Context) {
+		c.JSON(http.StatusOK, NewRestResponse().SetData("now"))
+	})
+	engine.POST("/api/system/exec", func(c *gin.Context) {
+		c.JSON(http.StatusOK, NewRestResponse())
+	})
+	log.Sn = "sn1"
+	r := NewMqttRemote(nil, engine, "mgmt")
+	published := make(chan *paho.Publish, 4)
+	r.publish = func(cx context.Context, p *paho.Publish) error {
+		published <- p
+		return nil
+	}
+	return r, published
+}
+
+func awaitReply(t *testing.T, published chan *paho.Publish) (*paho.Publish, *RemoteResponse) {
+	select {
+	case p := <-published:
+		resp := &RemoteResponse{}
+		if err := json.Unmarshal(p.Payload, resp); err != nil {
+			t.Fatalf("bad reply %q: %v", p.Payload, err)
+		}
+		return p, resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+	return nil, nil
+}
+
+func TestMqttRemoteProperties(t *testing.T) {
+	r, published := newTestRemote(t)
+	r.receive(&paho.Publish{
+		Topic: "mgmt/sn1/req/time",
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   "mgmt/sn1/res/client1",
+			CorrelationData: []byte("c1"),
+		},
+	})
+	p, resp := awaitReply(t, published)
+	if p.Topic != "mgmt/sn1/res/client1" || string(p.Properties.CorrelationData) != "c1" {
+		t.Fatalf("reply on %s with correlation data %q", p.Topic, p.Properties.CorrelationData)
+	}
+	if p.Properties.ContentType != "application/json" || resp.Status != http.StatusOK || resp.Route != "time" {
+		t.Fatalf("unexpected reply %s %+v", p.Properties.ContentType, resp)
+	}
+
+	// without a response topic the reply goes to res/<route>
+	r.receive(&paho.Publish{Topic: "mgmt/sn1/req/time"})
+	if p, _ = awaitReply(t, published); p.Topic != "mgmt/sn1/res/time" || len(p.Properties.CorrelationData) > 0 {
+		t.Fatalf("reply on %s with correlation data %q", p.Topic, p.Properties.CorrelationData)
+	}
+}
+
+func TestMqttRemoteBadResponseTopic(t *testing.T) {
+	r, published := newTestRemote(t)
+	for _, topic := range []string{"other/topic", "mgmt/sn1/res/", "mgmt/sn1/res/#", "mgmt/sn2/res/x"} {
+		r.receive(&paho.Publish{
+			Topic: "mgmt/sn1/req/time",
+			Properties: &paho.PublishProperties{
+				ResponseTopic:   topic,
+				CorrelationData: []byte("c2"),
+			},
+		})
+		p, resp := awaitReply(t, published)
+		if p.Topic != "mgmt/sn1/res/time" || resp.Status != http.StatusBadRequest ||
+			string(p.Properties.CorrelationData) != "c2" {
+			t.Fatalf("%s: reply on %s %+v", topic, p.Topic, resp)
+		}
+	}
+}
+
+func TestMqttRemoteAllow(t *testing.T) {
+	r, _ := newTestRemote(t)
+	cases := []struct {
+		allow  []string
+		method string
+		route  string
+		status int
+	}{
+		{nil, "GET", "time", http.StatusForbidden},
+		{[]string{"GET time"}, "GET", "time", http.StatusOK},
+		{[]string{"GET time"}, "POST", "exec", http.StatusForbidden},
+		{[]string{"GET *"}, "post", "exec", http.StatusForbidden},
+		{[]string{"* exec"}, "post", "exec", http.StatusOK},
+		{[]string{"GET t*"}, "GET", "./x/../time", http.StatusOK},
+		{[]string{"GET serial/*"}, "GET", "serial/a/capture", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r.Allow = c.allow
+		resp := r.Do(c.route, &RemoteRequest{Method: c.method})
+		if resp.Status != c.status {
+			t.Errorf("%v %s %s: status %d, want %d", c.allow, c.method, c.route, resp.Status, c.status)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"system-conf/common"
+)
+
+func (m *Controller) serialReady(c *gin.Context, resp *Response) bool {
+	if m.Serial == nil {
+		resp.SetMessage("串口管理未启用").Abort(c, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// BindSystemHandleListSerial godoc
+// @Summary 串口列表
+// @Description 枚举系统串口(含USB VID/PID/序列号)及其配置
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response{data=[]common.SerialPortInfo}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial [get]
+func (m *Controller) BindSystemHandleListSerial(parent gin.IRouter) {
+	parent.GET("/serial", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		if ports, e := m.Serial.List(); e != nil {
+			resp.SetMessage("枚举串口失败:%v", e).Abort(c, http.StatusInternalServerError)
+		} else {
+			resp.SetData(ports).SetTotal(len(ports)).OK(c)
+		}
+	})
+}
+
+// BindSystemHandleGetSerial godoc
+// @Summary 获取串口
+// @Description 获取串口信息及配置
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response{data=common.SerialPortInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name} [get]
+func (m *Controller) BindSystemHandleGetSerial(parent gin.IRouter) {
+	parent.GET("/serial/:name", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		if info, e := m.Serial.Get(c.Param("name")); e != nil {
+			resp.SetMessage("%v", e).Abort(c, http.StatusNotFound)
+		} else {
+			if info.Conf == nil {
+				info.Conf = m.Serial.GetConf(info.Name)
+			}
+			resp.SetData(info).OK(c)
+		}
+	})
+}
+
+// BindSystemHandleSetSerial godoc
+// @Summary 修改串口配置
+// @Description 修改波特率、数据位、校验位(none/odd/even/mark/space)、停止位(1/1.5/2)，并保存到配置文件
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param conf body common.SerialPortConf true "配置"
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name} [put]
+func (m *Controller) BindSystemHandleSetSerial(parent gin.IRouter) {
+	parent.PUT("/serial/:name", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		// start from the current settings so partial bodies are accepted
+		conf := m.Serial.GetConf(c.Param("name"))
+		if e := c.ShouldBindJSON(conf); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		conf.Name = common.ResolvePortName(c.Param("name"))
+		if e := m.Serial.SetConf(conf); e != nil {
+			resp.SetMessage("修改串口配置失败:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		resp.SetData(conf).OK(c)
+	})
+}
+
+// BindSystemHandleEnableSerial godoc
+// @Summary 启用串口
+// @Description 启用串口
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name}/enable [post]
+func (m *Controller) BindSystemHandleEnableSerial(parent gin.IRouter) {
+	parent.POST("/serial/:name/enable", func(c *gin.Context) {
+		m.setSerialEnabled(c, true)
+	})
+}
+
+// BindSystemHandleDisableSerial godoc
+// @Summary 停用串口
+// @Description 停用串口，已打开的串口会被关闭
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name}/disable [post]
+func (m *Controller) BindSystemHandleDisableSerial(parent gin.IRouter) {
+	parent.POST("/serial/:name/disable", func(c *gin.Context) {
+		m.setSerialEnabled(c, false)
+	})
+}
+
+func (m *Controller) setSerialEnabled(c *gin.Context, enabled bool) {
+	resp := NewRestResponse()
+	if !m.serialReady(c, resp) {
+		return
+	}
+	if e := m.Serial.SetEnabled(c.Param("name"), enabled); e != nil {
+		resp.SetMessage("修改串口状态失败:%v", e).Abort(c, http.StatusBadRequest)
+		return
+	}
+	resp.OK(c)
+}
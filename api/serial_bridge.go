@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"system-conf/common"
+)
+
+// BindSystemHandleGetSerialBridge godoc
+// @Summary 串口TCP桥状态
+// @Description 获取串口TCP桥配置及已连接的客户端
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response{data=common.BridgeInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/bridge [get]
+func (m *Controller) BindSystemHandleGetSerialBridge(parent gin.IRouter) {
+	parent.GET("/serial/:name/bridge", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		if b := m.Serial.Bridge(c.Param("name")); b != nil {
+			resp.SetData(b.Info()).OK(c)
+			return
+		}
+		info := &common.BridgeInfo{Clients: []*common.BridgeClientInfo{}}
+		if conf := m.Serial.GetConf(c.Param("name")); conf.Bridge != nil {
+			info.SerialBridgeConf = *conf.Bridge
+		}
+		resp.SetData(info).OK(c)
+	})
+}
+
+// BindSystemHandleSetSerialBridge godoc
+// @Summary 配置串口TCP桥
+// @Description 将串口以TCP服务暴露(可选RFC 2217远程设置波特率)，第一个发送数据的客户端独占写入，所有客户端都能收到串口数据
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param conf body common.SerialBridgeConf true "配置"
+// @Success 200 {object} Response{data=common.BridgeInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/bridge [put]
+func (m *Controller) BindSystemHandleSetSerialBridge(parent gin.IRouter) {
+	parent.PUT("/serial/:name/bridge", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		bridge := &common.SerialBridgeConf{}
+		if e := c.ShouldBindJSON(bridge); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		conf := m.Serial.GetConf(c.Param("name"))
+		conf.Bridge = bridge
+		if e := m.Serial.SetConf(conf); e != nil {
+			resp.SetMessage("修改串口配置失败:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		b := m.Serial.Bridge(conf.Name)
+		if bridge.Enabled && conf.Enabled && b == nil {
+			resp.SetMessage("串口TCP桥启动失败,请检查日志").Abort(c, http.StatusConflict)
+			return
+		}
+		info := &common.BridgeInfo{SerialBridgeConf: *bridge, Clients: []*common.BridgeClientInfo{}}
+		if b != nil {
+			info = b.Info()
+		}
+		resp.SetData(info).OK(c)
+	})
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/es"
+)
+
+// serialMonitor streams a running capture to web clients.
+type serialMonitor struct {
+	capture *common.SerialCapture
+	broker  *es.EventSourceBroker
+	cancel  func()
+}
+
+var serialMonitors = sync.Map{}
+
+func newSerialMonitor(capture *common.SerialCapture) *serialMonitor {
+	mon := &serialMonitor{capture: capture, broker: es.NewEventStreamBroker()}
+	mon.cancel = capture.Subscribe(func(rec *common.CaptureRecord) {
+		// never block the port: drop records if the broker falls behind
+		select {
+		case mon.broker.Notifier <- &es.MessageBody{Id: mon.broker.Id, Src: rec.Dir(), Data: rec}:
+		default:
+		}
+	})
+	return mon
+}
+
+func (mon *serialMonitor) stop() {
+	mon.cancel()
+	mon.capture.Stop()
+	mon.broker.Close()
+}
+
+func (m *Controller) serialCapture(c *gin.Context, resp *Response) *serialMonitor {
+	if !m.serialReady(c, resp) {
+		return nil
+	}
+	ctx, err := m.Serial.Ctx(c.Param("name"))
+	if err != nil {
+		resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+		return nil
+	}
+	if v, ok := serialMonitors.Load(ctx); ok {
+		return v.(*serialMonitor)
+	}
+	resp.SetMessage("串口未在抓包").Abort(c, http.StatusNotFound)
+	return nil
+}
+
+// BindSystemHandleStartSerialCapture godoc
+// @Summary 开始串口抓包
+// @Description 记录串口收发数据(时间戳/方向)到内存环形缓冲区，可选写入hex或pcap文件
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param conf body common.SerialCaptureConf true "配置"
+// @Success 200 {object} Response{data=common.SerialCaptureInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/capture [post]
+func (m *Controller) BindSystemHandleStartSerialCapture(parent gin.IRouter) {
+	parent.POST("/serial/:name/capture", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		conf := &common.SerialCaptureConf{}
+		if e := c.ShouldBindJSON(conf); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		ctx, err := m.Serial.Ctx(c.Param("name"))
+		if err != nil {
+			resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		capture, err := common.StartSerialCapture(ctx, *conf)
+		if err != nil {
+			resp.SetMessage("开始抓包失败:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		serialMonitors.Store(ctx, newSerialMonitor(capture))
+		resp.SetData(capture.Info()).OK(c)
+	})
+}
+
+// BindSystemHandleStopSerialCapture godoc
+// @Summary 停止串口抓包
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {object} Response{data=common.SerialCaptureInfo}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/capture [delete]
+func (m *Controller) BindSystemHandleStopSerialCapture(parent gin.IRouter) {
+	parent.DELETE("/serial/:name/capture", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if mon := m.serialCapture(c, resp); mon != nil {
+			serialMonitors.CompareAndDelete(mon.capture.Serial, mon)
+			mon.stop()
+			resp.SetData(mon.capture.Info()).OK(c)
+		}
+	})
+}
+
+// BindSystemHandleGetSerialCapture godoc
+// @Summary 获取串口抓包记录
+// @Description 返回环形缓冲区中最近的收发记录
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param limit query int false "最多返回条数" default(100)
+// @Success 200 {object} Response{data=[]common.CaptureRecord}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial/{name}/capture [get]
+func (m *Controller) BindSystemHandleGetSerialCapture(parent gin.IRouter) {
+	parent.GET("/serial/:name/capture", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if mon := m.serialCapture(c, resp); mon != nil {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+			records := mon.capture.Records(limit)
+			resp.SetData(records).SetTotal(len(records)).OK(c)
+		}
+	})
+}
+
+// BindSystemHandleDownloadSerialCapture godoc
+// @Summary 下载串口抓包文件
+// @Tags 串口
+// @Security Bearer
+// @Produce  octet-stream
+// @Param name path string true "串口名" default(ttyS0)
+// @Success 200 {file} file
+// @Router /system/serial/{name}/capture.file [get]
+func (m *Controller) BindSystemHandleDownloadSerialCapture(parent gin.IRouter) {
+	parent.GET("/serial/:name/capture.file", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if mon := m.serialCapture(c, resp); mon != nil {
+			if mon.capture.Path() == "" {
+				resp.SetMessage("未配置抓包文件").Abort(c, http.StatusNotFound)
+				return
+			}
+			c.FileAttachment(mon.capture.Path(), mon.capture.Conf.File)
+		}
+	})
+}
+
+// BindSystemHandleSerialMonitor godoc
+// @Summary 串口监视
+// @Description 以EventSource实时推送串口收发数据，src为rx/tx，先推送缓冲区中最近的记录
+// @Tags 串口
+// @Security Bearer
+// @Produce  text/event-stream
+// @Param name path string true "串口名" default(ttyS0)
+// @Param format query string false "raw/json/base64" default(raw)
+// @Param history query int false "先推送的历史记录条数" default(100)
+// @Success 200 {string} string
+// @Router /system/serial/{name}/capture.stream [get]
+func (m *Controller) BindSystemHandleSerialMonitor(parent gin.IRouter) {
+	parent.GET("/serial/:name/capture.stream", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if mon := m.serialCapture(c, resp); mon != nil {
+			history, _ := strconv.Atoi(c.DefaultQuery("history", "100"))
+			var msgs []string
+			if history > 0 {
+				for _, rec := range mon.capture.Records(history) {
+					msgs = append(msgs, rec.String())
+				}
+			}
+			mon.broker.ServeGin(c, msgs...)
+		}
+	})
+}
+
+// BindSystemHandleSerialMonitorWs godoc
+// @Summary 串口监视(WebSocket)
+// @Description 以WebSocket实时推送串口收发数据(每条记录一个消息)，客户端发来的消息原样写入串口，供不支持EventSource的终端使用
+// @Tags 串口
+// @Security Bearer
+// @Param name path string true "串口名" default(ttyS0)
+// @Param format query string false "raw/json/base64" default(raw)
+// @Param history query int false "先推送的历史记录条数" default(100)
+// @Success 101 {string} string
+// @Router /system/serial/{name}/capture.ws [get]
+func (m *Controller) BindSystemHandleSerialMonitorWs(parent gin.IRouter) {
+	parent.GET("/serial/:name/capture.ws", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if mon := m.serialCapture(c, resp); mon != nil {
+			history, _ := strconv.Atoi(c.DefaultQuery("history", "100"))
+			var msgs []string
+			if history > 0 {
+				for _, rec := range mon.capture.Records(history) {
+					msgs = append(msgs, rec.String())
+				}
+			}
+			mon.broker.ServeWebSocket(c, mon.capture.Serial, msgs...)
+		}
+	})
+}
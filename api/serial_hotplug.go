@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"system-conf/common"
+	"system-conf/common/es"
+)
+
+// SerialHotplugTopic is the Events topic of serial connect/disconnect events.
+const SerialHotplugTopic = "serial.hotplug"
+
+func init() {
+	_ = es.RegisterSchema(&es.Schema{
+		Type:        SerialHotplugTopic,
+		Version:     1,
+		ContentType: es.ContentTypeJson,
+		Desc:        "a serial device was connected or disconnected, src is the type",
+		Definition: []byte(`{"type":"object","required":["type","time","port"],"properties":{` +
+			`"type":{"enum":["connect","disconnect"]},"time":{"type":"string","format":"date-time"},` +
+			`"port":{"type":"object","required":["name"],"properties":{"name":{"type":"string"},"vid":{"type":"string"},` +
+			`"pid":{"type":"string"},"serialNumber":{"type":"string"},"product":{"type":"string"},"byId":{"type":"string"}}},` +
+			`"conf":{"type":"string"}}}`),
+	})
+}
+
+// WatchSerial starts hotplug detection on the serial manager and publishes
+// its connect/disconnect events on Events.
+func (m *Controller) WatchSerial() {
+	if m.Serial == nil {
+		return
+	}
+	broker := m.Events
+	m.Serial.OnHotplug(func(ev *common.SerialHotplugEvent) {
+		select {
+		case broker.Notifier <- &es.MessageBody{Id: broker.Id, Topic: SerialHotplugTopic, Src: ev.Type, Data: ev}:
+		default:
+		}
+	})
+	m.Serial.StartHotplug()
+	m.watchingSerial = true
+}
+
+// BindSystemHandleSerialEvents godoc
+// @Summary 串口热插拔事件
+// @Description 以EventSource推送串口设备插入(connect)/拔出(disconnect)事件
+// @Tags 串口
+// @Security Bearer
+// @Produce  text/event-stream
+// @Param format query string false "raw/json/base64" default(raw)
+// @Param src query string false "只推送指定事件,connect/disconnect"
+// @Success 200 {string} string
+// @Router /system/serial.events [get]
+func (m *Controller) BindSystemHandleSerialEvents(parent gin.IRouter) {
+	parent.GET("/serial.events", func(c *gin.Context) {
+		if !m.watchingSerial {
+			NewRestResponse().SetMessage("串口热插拔检测未启用").Abort(c, http.StatusServiceUnavailable)
+			return
+		}
+		filter := &es.Filter{Topics: []string{SerialHotplugTopic}}
+		if f := es.ParseFilter(c); f != nil {
+			filter.Srcs = f.Srcs
+		}
+		m.Events.ServeFilter(c, filter)
+	})
+}
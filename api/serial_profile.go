@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func (m *Controller) profilesReady(c *gin.Context, resp *Response) bool {
+	if m.Profiles == nil {
+		resp.SetMessage("串口设备配置未启用").Abort(c, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// BindSystemHandleListSerialProfiles godoc
+// @Summary 串口设备配置列表
+// @Description 列出串口设备配置(轮询命令、解析规则、MQTT主题)及运行状态和最新读数
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response{data=[]profile.Info}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial.profiles [get]
+func (m *Controller) BindSystemHandleListSerialProfiles(parent gin.IRouter) {
+	parent.GET("/serial.profiles", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.profilesReady(c, resp) {
+			return
+		}
+		list := m.Profiles.List()
+		resp.SetData(list).SetTotal(len(list)).OK(c)
+	})
+}
+
+// BindSystemHandleGetSerialProfile godoc
+// @Summary 串口设备配置详情
+// @Description 获取单个串口设备配置及其运行状态和最新读数
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Param name path string true "配置名"
+// @Success 200 {object} Response{data=profile.Info}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial.profiles/{name} [get]
+func (m *Controller) BindSystemHandleGetSerialProfile(parent gin.IRouter) {
+	parent.GET("/serial.profiles/:name", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.profilesReady(c, resp) {
+			return
+		}
+		info := m.Profiles.Get(c.Param("name"))
+		if info == nil {
+			resp.SetMessage("设备配置不存在:%s", c.Param("name")).Abort(c, http.StatusNotFound)
+			return
+		}
+		resp.SetData(info).OK(c)
+	})
+}
+
+// BindSystemHandleReloadSerialProfiles godoc
+// @Summary 重新加载串口设备配置
+// @Description 重新读取配置目录下的YAML/JSON设备配置并重启轮询；配置有误时保持原有配置运行
+// @Tags 串口
+// @Security Bearer
+// @Produce  json
+// @Success 200 {object} Response{data=[]profile.Info}  '{"code":200,"data":[],"msg":"OK"}'
+// @Router /system/serial.profiles.reload [post]
+func (m *Controller) BindSystemHandleReloadSerialProfiles(parent gin.IRouter) {
+	parent.POST("/serial.profiles.reload", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.profilesReady(c, resp) {
+			return
+		}
+		if e := m.Profiles.Load(); e != nil {
+			resp.SetMessage("加载设备配置失败:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		list := m.Profiles.List()
+		resp.SetData(list).SetTotal(len(list)).OK(c)
+	})
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"system-conf/common"
+	"time"
+)
+
+type SerialTransactRequest struct {
+	// hex or text
+	Encoding string `json:"encoding" example:"hex"`
+	Payload  string `json:"payload" example:"01 03 00 00 00 01 84 0A"`
+	// the reply ends after this many bytes
+	Length int `json:"length,omitempty" example:"7"`
+	// the reply ends with the delimiter, in the same encoding as the payload
+	Delimiter string `json:"delimiter,omitempty"`
+	// without length or delimiter the reply ends after idle ms of silence
+	Idle    int `json:"idle,omitempty" example:"50"`
+	Timeout int `json:"timeout,omitempty" example:"1000"`
+	Retries int `json:"retries,omitempty" example:"0"`
+}
+
+type SerialTransactResult struct {
+	Hex      string `json:"hex"`
+	Text     string `json:"text"`
+	Length   int    `json:"length"`
+	Duration int64  `json:"duration"`
+}
+
+func decodePayload(encoding, payload string) ([]byte, error) {
+	switch encoding {
+	case "", "hex":
+		return hex.DecodeString(strings.NewReplacer(" ", "", ":", "", "-", "").Replace(payload))
+	case "text":
+		return []byte(payload), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %s", encoding)
+}
+
+// BindSystemHandleSerialTransact godoc
+// @Summary 串口请求/应答
+// @Description 向串口发送一条命令并等待设备应答，应答按长度、结束符或静默时间判断结束，多个请求排队执行
+// @Tags 串口
+// @Security Bearer
+// @Accept  json
+// @Produce  json
+// @Param name path string true "串口名" default(ttyS0)
+// @Param req body SerialTransactRequest true "请求"
+// @Success 200 {object} Response{data=SerialTransactResult}  '{"code":200,"data":{},"msg":"OK"}'
+// @Router /system/serial/{name}/transact [post]
+func (m *Controller) BindSystemHandleSerialTransact(parent gin.IRouter) {
+	parent.POST("/serial/:name/transact", func(c *gin.Context) {
+		resp := NewRestResponse()
+		if !m.serialReady(c, resp) {
+			return
+		}
+		req := &SerialTransactRequest{}
+		if e := c.ShouldBindJSON(req); e != nil {
+			resp.SetMessage("请求格式错误:%v", e).Abort(c, http.StatusBadRequest)
+			return
+		}
+		payload, err := decodePayload(req.Encoding, req.Payload)
+		if err == nil && len(payload) == 0 {
+			err = errors.New("payload is empty")
+		}
+		if err != nil {
+			resp.SetMessage("参数错误:%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		var match common.ReplyMatcher
+		if req.Delimiter != "" {
+			delim, e := decodePayload(req.Encoding, req.Delimiter)
+			if e != nil {
+				resp.SetMessage("参数错误:%v", e).Abort(c, http.StatusBadRequest)
+				return
+			}
+			match = common.MatchDelimiter(delim)
+		} else if req.Length > 0 {
+			match = common.MatchLength(req.Length)
+		}
+		ctx, err := m.Serial.Ctx(c.Param("name"))
+		if err != nil {
+			resp.SetMessage("%v", err).Abort(c, http.StatusBadRequest)
+			return
+		}
+		cx := common.WithTransactRetries(c.Request.Context(), req.Retries)
+		if req.Timeout > 0 {
+			cx = common.WithTransactTimeout(cx, time.Duration(req.Timeout)*time.Millisecond)
+			// bound the time spent queued behind other requests as well
+			var cancel context.CancelFunc
+			cx, cancel = context.WithTimeout(cx, time.Duration(req.Timeout*(req.Retries+1))*time.Millisecond+common.DefaultTransactTimeout)
+			defer cancel()
+		}
+		if req.Idle > 0 {
+			cx = common.WithTransactIdle(cx, time.Duration(req.Idle)*time.Millisecond)
+		}
+		tm := time.Now()
+		reply, err := ctx.Transact(cx, payload, match)
+		if err != nil {
+			if errors.Is(err, common.ErrTransactTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				resp.SetMessage("%v", err).Abort(c, http.StatusGatewayTimeout)
+			} else if errors.Is(err, common.ErrSerialBusy) {
+				resp.SetMessage("%v", err).Abort(c, http.StatusConflict)
+			} else {
+				resp.SetMessage("%v", err).Abort(c, http.StatusBadGateway)
+			}
+			return
+		}
+		resp.SetData(&SerialTransactResult{
+			Hex:      hex.EncodeToString(reply),
+			Text:     string(reply),
+			Length:   len(reply),
+			Duration: time.Since(tm).Milliseconds(),
+		}).OK(c)
+	})
+}
@@ -20,17 +20,23 @@
 
 package common
 
-import "strconv"
+import "system-conf/common/codec"
 
+// ParseBCD returns the digits of a big endian BCD number. Nibbles above 9
+// are rendered as '?'; use codec.Decode to get an error instead.
 func ParseBCD(bcd []byte) string {
-	result := ""
-
+	if digits, err := codec.Decode(bcd); err == nil {
+		return digits
+	}
+	result := make([]byte, 0, len(bcd)*2)
 	for _, b := range bcd {
-		high := b >> 4
-		low := b & 0x0F
-
-		result += strconv.Itoa(int(high)) + strconv.Itoa(int(low))
+		for _, n := range []byte{b >> 4, b & 0x0F} {
+			if n > 9 {
+				result = append(result, '?')
+			} else {
+				result = append(result, '0'+n)
+			}
+		}
 	}
-
-	return result
+	return string(result)
 }
@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package codec encodes and decodes the numeric formats found in serial and
+// CAN device frames: packed BCD in its signed, fixed-point and little endian
+// variants, and whole frames declared as structs with `bin` field tags.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	ErrInvalidDigit = errors.New("bcd: invalid digit")
+	ErrOverflow     = errors.New("bcd: value does not fit")
+	ErrSign         = errors.New("bcd: invalid sign")
+	ErrPrecision    = errors.New("bcd: too many decimal places")
+)
+
+// DigitError reports a nibble above 9 where a digit was expected.
+type DigitError struct {
+	Offset int
+	Nibble byte
+}
+
+func (e *DigitError) Error() string {
+	return fmt.Sprintf("bcd: invalid digit 0x%X at byte %d", e.Nibble, e.Offset)
+}
+
+func (e *DigitError) Unwrap() error {
+	return ErrInvalidDigit
+}
+
+// SignMode is how a signed BCD number carries its sign.
+type SignMode int
+
+const (
+	Unsigned SignMode = iota
+	// SignNibble is packed decimal: the last nibble is 0xC (or 0xA, 0xE,
+	// 0xF) for positive and 0xD (or 0xB) for negative numbers.
+	SignNibble
+	// SignBit uses the top bit of the most significant byte.
+	SignBit
+)
+
+// BCD is a packed BCD format. The zero value is unsigned, big endian (most
+// significant digits first) and has no decimal places.
+type BCD struct {
+	LittleEndian bool
+	Sign         SignMode
+	// Scale is the number of implied decimal places.
+	Scale int
+}
+
+var (
+	BigEndian    = BCD{}
+	LittleEndian = BCD{LittleEndian: true}
+)
+
+// Valid reports whether b holds only the digits 0-9.
+func Valid(b []byte) bool {
+	_, _, err := BigEndian.digits(b)
+	return err == nil
+}
+
+// Decode returns the digits of an unsigned big endian BCD number, keeping
+// leading zeros.
+func Decode(b []byte) (string, error) {
+	_, digits, err := BigEndian.digits(b)
+	return digits, err
+}
+
+// Encode packs a string of digits, left padded with zeros to size bytes; a
+// size <= 0 uses as few bytes as possible.
+func Encode(digits string, size int) ([]byte, error) {
+	return BigEndian.encode(false, digits, size)
+}
+
+func DecodeUint(b []byte) (uint64, error) {
+	return BigEndian.DecodeUint(b)
+}
+
+func EncodeUint(v uint64, size int) ([]byte, error) {
+	return BigEndian.EncodeUint(v, size)
+}
+
+// digits returns the sign and the digits of b, most significant first.
+func (c BCD) digits(b []byte) (neg bool, digits string, err error) {
+	n := len(b)
+	at := func(i int) byte {
+		if c.LittleEndian {
+			return b[n-1-i]
+		}
+		return b[i]
+	}
+	offset := func(i int) int {
+		if c.LittleEndian {
+			return n - 1 - i
+		}
+		return i
+	}
+	buf := make([]byte, 0, n*2)
+	for i := 0; i < n; i++ {
+		v := at(i)
+		if i == 0 && c.Sign == SignBit {
+			neg = v&0x80 != 0
+			v &= 0x7F
+		}
+		hi, lo := v>>4, v&0x0F
+		if hi > 9 {
+			return false, "", &DigitError{Offset: offset(i), Nibble: hi}
+		}
+		buf = append(buf, '0'+hi)
+		if i == n-1 && c.Sign == SignNibble {
+			switch lo {
+			case 0xA, 0xC, 0xE, 0xF:
+			case 0xB, 0xD:
+				neg = true
+			default:
+				return false, "", ErrSign
+			}
+			continue
+		}
+		if lo > 9 {
+			return false, "", &DigitError{Offset: offset(i), Nibble: lo}
+		}
+		buf = append(buf, '0'+lo)
+	}
+	return neg, string(buf), nil
+}
+
+// encode packs digits (0-9 only) into size bytes.
+func (c BCD) encode(neg bool, digits string, size int) ([]byte, error) {
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return nil, ErrInvalidDigit
+		}
+	}
+	if neg && c.Sign == Unsigned {
+		return nil, ErrSign
+	}
+	digits = strings.TrimLeft(digits, "0")
+	nibbles := len(digits)
+	if c.Sign == SignNibble {
+		nibbles++
+	}
+	if size <= 0 {
+		size = (nibbles + 1) / 2
+		if size == 0 {
+			size = 1
+		}
+		if c.Sign == SignBit && nibbles == size*2 && digits[0] > '7' {
+			size++
+		}
+	}
+	capacity := size * 2
+	if c.Sign == SignNibble {
+		capacity--
+	}
+	if len(digits) > capacity {
+		return nil, ErrOverflow
+	}
+	digits = strings.Repeat("0", capacity-len(digits)) + digits
+	if c.Sign == SignNibble {
+		sign := byte(0xC)
+		if neg {
+			sign = 0xD
+		}
+		digits += string('0' + sign)
+	}
+	out := make([]byte, size)
+	for i := range out {
+		out[i] = (digits[2*i]-'0')<<4 | (digits[2*i+1] - '0')
+	}
+	if c.Sign == SignBit {
+		if out[0]&0x80 != 0 {
+			return nil, ErrOverflow
+		}
+		if neg {
+			out[0] |= 0x80
+		}
+	}
+	if c.LittleEndian {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	return out, nil
+}
+
+// Decode returns the number as a decimal string such as "-12.34".
+func (c BCD) Decode(b []byte) (string, error) {
+	neg, digits, err := c.digits(b)
+	if err != nil {
+		return "", err
+	}
+	if c.Scale > 0 {
+		if len(digits) <= c.Scale {
+			digits = strings.Repeat("0", c.Scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-c.Scale] + "." + digits[len(digits)-c.Scale:]
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" || digits[0] == '.' {
+		digits = "0" + digits
+	}
+	if neg && strings.Trim(digits, "0.") != "" {
+		digits = "-" + digits
+	}
+	return digits, nil
+}
+
+// Encode packs a decimal string such as "-12.34" into size bytes; it may
+// have at most Scale decimal places.
+func (c BCD) Encode(s string, size int) ([]byte, error) {
+	neg := false
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		neg, s = s[0] == '-', s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) > c.Scale {
+		return nil, ErrPrecision
+	}
+	if whole == "" && frac == "" {
+		return nil, ErrInvalidDigit
+	}
+	return c.encode(neg, whole+frac+strings.Repeat("0", c.Scale-len(frac)), size)
+}
+
+// DecodeInt returns the raw integer, i.e. the value times 10^Scale.
+func (c BCD) DecodeInt(b []byte) (int64, error) {
+	neg, digits, err := c.digits(b)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := 0; i < len(digits); i++ {
+		if v > (math.MaxInt64-9)/10 {
+			return 0, ErrOverflow
+		}
+		v = v*10 + uint64(digits[i]-'0')
+	}
+	if neg {
+		return -int64(v), nil
+	}
+	return int64(v), nil
+}
+
+func (c BCD) EncodeInt(v int64, size int) ([]byte, error) {
+	if v < 0 {
+		return c.encode(true, fmt.Sprint(uint64(-(v+1))+1), size)
+	}
+	return c.encode(false, fmt.Sprint(v), size)
+}
+
+func (c BCD) DecodeUint(b []byte) (uint64, error) {
+	neg, digits, err := c.digits(b)
+	if err != nil {
+		return 0, err
+	}
+	if neg {
+		return 0, ErrSign
+	}
+	var v uint64
+	for i := 0; i < len(digits); i++ {
+		if v > (math.MaxUint64-9)/10 {
+			return 0, ErrOverflow
+		}
+		v = v*10 + uint64(digits[i]-'0')
+	}
+	return v, nil
+}
+
+func (c BCD) EncodeUint(v uint64, size int) ([]byte, error) {
+	return c.encode(false, fmt.Sprint(v), size)
+}
+
+// DecodeFloat returns the value with Scale applied.
+func (c BCD) DecodeFloat(b []byte) (float64, error) {
+	v, err := c.DecodeInt(b)
+	return float64(v) / math.Pow10(c.Scale), err
+}
+
+// EncodeFloat rounds f to Scale decimal places.
+func (c BCD) EncodeFloat(f float64, size int) ([]byte, error) {
+	v := math.Round(f * math.Pow10(c.Scale))
+	if math.IsNaN(v) || math.Abs(v) >= math.MaxInt64 {
+		return nil, ErrOverflow
+	}
+	return c.EncodeInt(int64(v), size)
+}
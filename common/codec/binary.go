@@ -0,0 +1,676 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Marshal encodes a struct into a frame laid out by the `bin` tags of its
+// exported fields, in declaration order. A tag is a kind followed by
+// options:
+//
+//	u8 u16 u32 u64 i8 i16 i32 i64  integers; for float fields the raw
+//	                               value is the field times 10^scale
+//	f32 f64                        IEEE 754
+//	bcd                            packed BCD of size bytes
+//	ascii                          text of size bytes, padded on encode
+//	                               and trimmed on decode
+//	bytes                          raw bytes
+//
+//	le, be        byte order, big endian by default
+//	size=N|Field  size in bytes, or the name of an earlier integer field
+//	              holding it; "rest" takes the remaining bytes on decode
+//	scale=N       implied decimal places (integers and bcd)
+//	sign=nibble|bit  signed bcd, see SignMode
+//	pad=space|zero   ascii padding, zero by default
+//
+// An empty kind is derived from the field type: sized integers, floats,
+// bool (u8), string (ascii), []byte and [N]byte (bytes) and nested structs.
+// Arrays of any supported type repeat the element encoding. Fields tagged
+// "-" and fields without a derivable kind are skipped.
+func Marshal(v any) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.New("codec: Marshal needs a struct")
+	}
+	buf := &bytes.Buffer{}
+	err := marshalStruct(buf, rv)
+	return buf.Bytes(), err
+}
+
+// Unmarshal decodes a frame into the struct pointed to by v, see Marshal.
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("codec: Unmarshal needs a pointer to a struct")
+	}
+	rd := bytes.NewReader(data)
+	return unmarshalStruct(rd, rv.Elem())
+}
+
+// Size returns the encoded size of a struct type without size=Field or
+// rest fields.
+func Size(v any) (int, error) {
+	t := reflect.Indirect(reflect.ValueOf(v)).Type()
+	specs, err := structSpecs(t)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, s := range specs {
+		n, err := s.fixedSize(t.Field(s.index).Type)
+		if err != nil {
+			return 0, &FieldError{Field: s.name, Err: err}
+		}
+		total += n
+	}
+	return total, nil
+}
+
+var ErrRange = errors.New("codec: value out of range")
+
+// FieldError reports the struct field a Marshal or Unmarshal error is in.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("codec: field %s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type fieldSpec struct {
+	index     int
+	name      string
+	kind      string
+	le        bool
+	size      int
+	sizeField int // index of the field holding the size, or -1
+	rest      bool
+	scale     int
+	sign      SignMode
+	pad       byte
+}
+
+var specCache = sync.Map{}
+
+func structSpecs(t reflect.Type) ([]*fieldSpec, error) {
+	if v, ok := specCache.Load(t); ok {
+		return v.([]*fieldSpec), nil
+	}
+	var specs []*fieldSpec
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("bin")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		s := &fieldSpec{index: i, name: f.Name, sizeField: -1}
+		opts := strings.Split(tag, ",")
+		s.kind = opts[0]
+		for _, opt := range opts[1:] {
+			key, val, _ := strings.Cut(opt, "=")
+			var err error
+			switch key {
+			case "le":
+				s.le = true
+			case "be":
+				s.le = false
+			case "size":
+				if val == "rest" {
+					s.rest = true
+				} else if s.size, err = strconv.Atoi(val); err != nil {
+					err = nil
+					sf, ok := t.FieldByName(val)
+					if !ok || sf.Index[0] >= i || !isInteger(sf.Type.Kind()) {
+						err = fmt.Errorf("size field %s must be an earlier integer field", val)
+					} else {
+						s.sizeField = sf.Index[0]
+					}
+				}
+			case "scale":
+				s.scale, err = strconv.Atoi(val)
+			case "sign":
+				switch val {
+				case "nibble":
+					s.sign = SignNibble
+				case "bit":
+					s.sign = SignBit
+				default:
+					err = fmt.Errorf("bad sign %s", val)
+				}
+			case "pad":
+				switch val {
+				case "space":
+					s.pad = ' '
+				case "zero":
+					s.pad = 0
+				default:
+					err = fmt.Errorf("bad pad %s", val)
+				}
+			default:
+				err = fmt.Errorf("unknown option %s", opt)
+			}
+			if err != nil {
+				return nil, &FieldError{Field: f.Name, Err: err}
+			}
+		}
+		if s.kind == "" {
+			s.kind = kindOf(f.Type)
+			if s.kind == "" {
+				if tagged {
+					return nil, &FieldError{Field: f.Name, Err: fmt.Errorf("unsupported type %s", f.Type)}
+				}
+				continue
+			}
+		}
+		if f.Type.Kind() == reflect.Array && s.kind == "bytes" && s.size == 0 && s.sizeField < 0 {
+			s.size = f.Type.Len()
+		}
+		specs = append(specs, s)
+	}
+	specCache.Store(t, specs)
+	return specs, nil
+}
+
+func isInteger(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Uintptr
+}
+
+func kindOf(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Uint8:
+		return "u8"
+	case reflect.Int8:
+		return "i8"
+	case reflect.Uint16:
+		return "u16"
+	case reflect.Int16:
+		return "i16"
+	case reflect.Uint32:
+		return "u32"
+	case reflect.Int32:
+		return "i32"
+	case reflect.Uint64:
+		return "u64"
+	case reflect.Int64:
+		return "i64"
+	case reflect.Float32:
+		return "f32"
+	case reflect.Float64:
+		return "f64"
+	case reflect.String:
+		return "ascii"
+	case reflect.Struct:
+		return "struct"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		if t.Kind() == reflect.Array && kindOf(t.Elem()) != "" {
+			return "array"
+		}
+	}
+	return ""
+}
+
+func intWidth(kind string) (width int, signed bool, ok bool) {
+	switch kind {
+	case "u8", "u16", "u32", "u64":
+		w, _ := strconv.Atoi(kind[1:])
+		return w / 8, false, true
+	case "i8", "i16", "i32", "i64":
+		w, _ := strconv.Atoi(kind[1:])
+		return w / 8, true, true
+	}
+	return 0, false, false
+}
+
+func (s *fieldSpec) fixedSize(t reflect.Type) (int, error) {
+	if w, _, ok := intWidth(s.kind); ok {
+		return w, nil
+	}
+	switch s.kind {
+	case "f32":
+		return 4, nil
+	case "f64":
+		return 8, nil
+	case "struct":
+		total := 0
+		specs, err := structSpecs(t)
+		if err != nil {
+			return 0, err
+		}
+		for _, fs := range specs {
+			n, err := fs.fixedSize(t.Field(fs.index).Type)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+		return total, nil
+	case "array":
+		elem := *s
+		elem.kind = kindOf(t.Elem())
+		n, err := elem.fixedSize(t.Elem())
+		return n * t.Len(), err
+	}
+	if s.rest || s.sizeField >= 0 || s.size <= 0 {
+		return 0, errors.New("size is not fixed")
+	}
+	return s.size, nil
+}
+
+func (s *fieldSpec) order() binary.ByteOrder {
+	if s.le {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func (s *fieldSpec) bcd() BCD {
+	return BCD{LittleEndian: s.le, Sign: s.sign, Scale: s.scale}
+}
+
+// sizeOf returns the size of a variable length field, or -1 for rest. A
+// size field holding a negative or oversized value is an error, not rest.
+func (s *fieldSpec) sizeOf(parent reflect.Value) (int, error) {
+	if s.sizeField >= 0 {
+		f := parent.Field(s.sizeField)
+		if f.CanInt() {
+			if v := f.Int(); v >= 0 && v <= math.MaxInt {
+				return int(v), nil
+			}
+		} else if v := f.Uint(); v <= math.MaxInt {
+			return int(v), nil
+		}
+		return 0, fmt.Errorf("size field %s: %w", parent.Type().Field(s.sizeField).Name, ErrRange)
+	}
+	if s.rest {
+		return -1, nil
+	}
+	return s.size, nil
+}
+
+func marshalStruct(w *bytes.Buffer, rv reflect.Value) error {
+	specs, err := structSpecs(rv.Type())
+	if err != nil {
+		return err
+	}
+	for _, s := range specs {
+		if err = s.marshal(w, rv.Field(s.index), rv); err != nil {
+			var fe *FieldError
+			if errors.As(err, &fe) {
+				fe.Field = s.name + "." + fe.Field
+				return fe
+			}
+			return &FieldError{Field: s.name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (s *fieldSpec) marshal(w *bytes.Buffer, f reflect.Value, parent reflect.Value) error {
+	if width, signed, ok := intWidth(s.kind); ok {
+		bits := uint(width * 8)
+		var u uint64
+		if f.CanUint() && s.scale == 0 {
+			u = f.Uint()
+			if signed && u >= 1<<(bits-1) || !signed && bits < 64 && u >= 1<<bits {
+				return ErrRange
+			}
+		} else {
+			raw, err := s.rawInt(f)
+			if err != nil {
+				return err
+			}
+			if signed && bits < 64 && (raw < -(1<<(bits-1)) || raw >= 1<<(bits-1)) ||
+				!signed && (raw < 0 || bits < 64 && raw >= 1<<bits) {
+				return ErrRange
+			}
+			u = uint64(raw)
+		}
+		for i := 0; i < width; i++ {
+			shift := uint(i * 8)
+			if !s.le {
+				shift = uint((width - 1 - i) * 8)
+			}
+			w.WriteByte(byte(u >> shift))
+		}
+		return nil
+	}
+	switch s.kind {
+	case "f32", "f64":
+		var v float64
+		switch {
+		case f.CanFloat():
+			v = f.Float()
+		case f.CanInt():
+			v = float64(f.Int())
+		case f.CanUint():
+			v = float64(f.Uint())
+		default:
+			return fmt.Errorf("cannot encode %s as %s", f.Type(), s.kind)
+		}
+		if s.kind == "f32" {
+			return binary.Write(w, s.order(), math.Float32bits(float32(v)))
+		}
+		return binary.Write(w, s.order(), math.Float64bits(v))
+	case "bcd":
+		size, err := s.sizeOf(parent)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			size = 0
+		}
+		var buf []byte
+		c := s.bcd()
+		switch {
+		case f.Kind() == reflect.String:
+			buf, err = c.Encode(f.String(), size)
+		case f.CanFloat():
+			buf, err = c.EncodeFloat(f.Float(), size)
+		case f.CanInt():
+			buf, err = c.EncodeInt(f.Int()*int64(math.Pow10(s.scale)), size)
+		case f.CanUint():
+			buf, err = c.EncodeUint(f.Uint()*uint64(math.Pow10(s.scale)), size)
+		default:
+			err = fmt.Errorf("cannot encode %s as bcd", f.Type())
+		}
+		if err == nil {
+			w.Write(buf)
+		}
+		return err
+	case "ascii", "bytes":
+		var buf []byte
+		switch {
+		case f.Kind() == reflect.String:
+			buf = []byte(f.String())
+		case f.Kind() == reflect.Slice:
+			buf = f.Bytes()
+		case f.Kind() == reflect.Array:
+			buf = make([]byte, f.Len())
+			reflect.Copy(reflect.ValueOf(buf), f)
+		default:
+			return fmt.Errorf("cannot encode %s as %s", f.Type(), s.kind)
+		}
+		size, err := s.sizeOf(parent)
+		if err != nil {
+			return err
+		}
+		if size >= 0 && s.sizeField < 0 && size > 0 {
+			if len(buf) > size {
+				return ErrRange
+			}
+			pad := s.pad
+			if s.kind == "bytes" {
+				pad = 0
+			}
+			w.Write(buf)
+			w.Write(bytes.Repeat([]byte{pad}, size-len(buf)))
+			return nil
+		}
+		if s.sizeField >= 0 && len(buf) != size {
+			return fmt.Errorf("length %d does not match size field %d", len(buf), size)
+		}
+		w.Write(buf)
+		return nil
+	case "struct":
+		return marshalStruct(w, f)
+	case "array":
+		elem := *s
+		elem.kind = kindOf(f.Type().Elem())
+		for i := 0; i < f.Len(); i++ {
+			if err := elem.marshal(w, f.Index(i), parent); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown kind %s", s.kind)
+}
+
+// rawInt returns the integer to put on the wire for an integer kind.
+func (s *fieldSpec) rawInt(f reflect.Value) (int64, error) {
+	switch {
+	case f.Kind() == reflect.Bool:
+		if f.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case f.CanInt():
+		return f.Int() * int64(math.Pow10(s.scale)), nil
+	case f.CanUint():
+		return int64(f.Uint() * uint64(math.Pow10(s.scale))), nil
+	case f.CanFloat():
+		v := math.Round(f.Float() * math.Pow10(s.scale))
+		if math.IsNaN(v) || math.Abs(v) >= math.MaxInt64 {
+			return 0, ErrRange
+		}
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("cannot encode %s as integer", f.Type())
+}
+
+func unmarshalStruct(r *bytes.Reader, rv reflect.Value) error {
+	specs, err := structSpecs(rv.Type())
+	if err != nil {
+		return err
+	}
+	for _, s := range specs {
+		if err = s.unmarshal(r, rv.Field(s.index), rv); err != nil {
+			var fe *FieldError
+			if errors.As(err, &fe) {
+				fe.Field = s.name + "." + fe.Field
+				return fe
+			}
+			return &FieldError{Field: s.name, Err: err}
+		}
+	}
+	return nil
+}
+
+func readN(r *bytes.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		n = r.Len()
+	}
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+func (s *fieldSpec) unmarshal(r *bytes.Reader, f reflect.Value, parent reflect.Value) error {
+	if width, signed, ok := intWidth(s.kind); ok {
+		buf, err := readN(r, width)
+		if err != nil {
+			return err
+		}
+		var u uint64
+		for i := 0; i < width; i++ {
+			b := buf[i]
+			if s.le {
+				b = buf[width-1-i]
+			}
+			u = u<<8 | uint64(b)
+		}
+		raw := int64(u)
+		if signed && width < 8 {
+			shift := uint(64 - width*8)
+			raw = raw << shift >> shift
+		}
+		return s.setInt(f, raw, u, signed)
+	}
+	switch s.kind {
+	case "f32", "f64":
+		var v float64
+		if s.kind == "f32" {
+			var bits uint32
+			if err := binary.Read(r, s.order(), &bits); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			v = float64(math.Float32frombits(bits))
+		} else {
+			var bits uint64
+			if err := binary.Read(r, s.order(), &bits); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			v = math.Float64frombits(bits)
+		}
+		switch {
+		case f.CanFloat():
+			f.SetFloat(v)
+		case f.CanInt():
+			f.SetInt(int64(v))
+		case f.CanUint():
+			f.SetUint(uint64(v))
+		default:
+			return fmt.Errorf("cannot decode %s into %s", s.kind, f.Type())
+		}
+		return nil
+	case "bcd":
+		size, err := s.sizeOf(parent)
+		if err != nil {
+			return err
+		}
+		buf, err := readN(r, size)
+		if err != nil {
+			return err
+		}
+		c := s.bcd()
+		switch {
+		case f.Kind() == reflect.String:
+			var v string
+			if v, err = c.Decode(buf); err == nil {
+				f.SetString(v)
+			}
+		case f.CanFloat():
+			var v float64
+			if v, err = c.DecodeFloat(buf); err == nil {
+				f.SetFloat(v)
+			}
+		case f.CanInt():
+			var v int64
+			if v, err = c.DecodeInt(buf); err == nil {
+				f.SetInt(v / int64(math.Pow10(s.scale)))
+			}
+		case f.CanUint():
+			var v uint64
+			if v, err = c.DecodeUint(buf); err == nil {
+				f.SetUint(v / uint64(math.Pow10(s.scale)))
+			}
+		default:
+			err = fmt.Errorf("cannot decode bcd into %s", f.Type())
+		}
+		return err
+	case "ascii", "bytes":
+		size, err := s.sizeOf(parent)
+		if err != nil {
+			return err
+		}
+		if size == 0 && f.Kind() == reflect.Array {
+			size = f.Len()
+		}
+		buf, err := readN(r, size)
+		if err != nil {
+			return err
+		}
+		switch f.Kind() {
+		case reflect.String:
+			if s.kind == "ascii" && s.sizeField < 0 && !s.rest {
+				buf = bytes.TrimRight(buf, string([]byte{s.pad}))
+			}
+			f.SetString(string(buf))
+		case reflect.Slice:
+			f.SetBytes(buf)
+		case reflect.Array:
+			reflect.Copy(f, reflect.ValueOf(buf))
+		default:
+			return fmt.Errorf("cannot decode %s into %s", s.kind, f.Type())
+		}
+		return nil
+	case "struct":
+		return unmarshalStruct(r, f)
+	case "array":
+		elem := *s
+		elem.kind = kindOf(f.Type().Elem())
+		for i := 0; i < f.Len(); i++ {
+			if err := elem.unmarshal(r, f.Index(i), parent); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown kind %s", s.kind)
+}
+
+func (s *fieldSpec) setInt(f reflect.Value, raw int64, u uint64, signed bool) error {
+	scale := math.Pow10(s.scale)
+	switch {
+	case f.Kind() == reflect.Bool:
+		f.SetBool(u != 0)
+	case f.CanFloat():
+		if signed {
+			f.SetFloat(float64(raw) / scale)
+		} else {
+			f.SetFloat(float64(u) / scale)
+		}
+	case f.CanInt():
+		v := raw
+		if !signed {
+			v = int64(u)
+		}
+		v /= int64(scale)
+		if f.OverflowInt(v) {
+			return ErrRange
+		}
+		f.SetInt(v)
+	case f.CanUint():
+		if signed && raw < 0 {
+			return ErrRange
+		}
+		v := u / uint64(scale)
+		if f.OverflowUint(v) {
+			return ErrRange
+		}
+		f.SetUint(v)
+	default:
+		return fmt.Errorf("cannot decode %s into %s", s.kind, f.Type())
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"system-conf/common/log"
+	"time"
+)
+
+// ActionFunc is a built-in job. Anything written to out ends up in the
+// output tail of the job status.
+type ActionFunc func(cx context.Context, params map[string]string, out io.Writer) error
+
+type action struct {
+	fn    ActionFunc
+	paths []string
+}
+
+var actions = sync.Map{}
+
+// RegisterAction adds a built-in action; pathParams name the params that
+// hold file system paths, which must lie below one of the action roots.
+func RegisterAction(name string, fn ActionFunc, pathParams ...string) {
+	actions.Store(name, &action{fn: fn, paths: pathParams})
+}
+
+func GetAction(name string) ActionFunc {
+	if v, ok := actions.Load(name); ok {
+		return v.(*action).fn
+	}
+	return nil
+}
+
+// checkActionParams verifies the path params of an action job.
+func checkActionParams(name string, params map[string]string) error {
+	v, ok := actions.Load(name)
+	if !ok {
+		return fmt.Errorf("unknown action:%s", name)
+	}
+	for _, key := range v.(*action).paths {
+		if params[key] == "" {
+			continue
+		}
+		if _, err := actionPath(params[key]); err != nil {
+			return fmt.Errorf("param %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+var (
+	rootsMu     sync.RWMutex
+	actionRoots []string
+)
+
+// SetActionRoots sets the directories the built-in actions may read and
+// write below. Without roots every path is refused, so jobs created over
+// the API cannot touch arbitrary files.
+func SetActionRoots(roots ...string) {
+	list := make([]string, 0, len(roots))
+	for _, root := range roots {
+		if root = strings.TrimSpace(root); root == "" {
+			continue
+		}
+		if abs, err := resolvePath(root); err == nil {
+			list = append(list, abs)
+		} else {
+			log.Warnf("ignore action root %s: %v", root, err)
+		}
+	}
+	rootsMu.Lock()
+	actionRoots = list
+	rootsMu.Unlock()
+}
+
+func ActionRoots() []string {
+	rootsMu.RLock()
+	defer rootsMu.RUnlock()
+	return append([]string(nil), actionRoots...)
+}
+
+// resolvePath makes p absolute and follows the symlinks of its longest
+// existing prefix, so a link cannot lead out of a root.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if real, e := filepath.EvalSymlinks(dir); e == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if filepath.Dir(dir) == dir {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// actionPath resolves p and checks that it lies below an action root.
+func actionPath(p string) (string, error) {
+	real, err := resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range ActionRoots() {
+		if rel, e := filepath.Rel(root, real); e == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the action roots", p)
+}
+
+// Uploader stores the file at path under key for the log.upload action.
+type Uploader func(cx context.Context, key, path string) error
+
+var uploader atomic.Value
+
+func SetUploader(fn Uploader) {
+	uploader.Store(fn)
+}
+
+func ListActions() (names []string) {
+	actions.Range(func(key, value any) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	return
+}
+
+func init() {
+	RegisterAction("disk.cleanup", actionDiskCleanup, "dir")
+	RegisterAction("file.snapshot", actionFileSnapshot, "src", "dir")
+	RegisterAction("log.upload", actionLogUpload, "dir")
+}
+
+// actionDiskCleanup removes files under params["dir"] matching
+// params["pattern"] (default "*") that are older than params["days"].
+func actionDiskCleanup(cx context.Context, params map[string]string, out io.Writer) error {
+	if params["dir"] == "" {
+		return fmt.Errorf("param dir is required")
+	}
+	dir, err := actionPath(params["dir"])
+	if err != nil {
+		return err
+	}
+	pattern := params["pattern"]
+	if pattern == "" {
+		pattern = "*"
+	}
+	days, err := strconv.Atoi(params["days"])
+	if err != nil || days <= 0 {
+		return fmt.Errorf("param days must be a positive integer")
+	}
+	before := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	removed := 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if e := cx.Err(); e != nil {
+			return e
+		}
+		if info.IsDir() || info.ModTime().After(before) {
+			return nil
+		}
+		if ok, _ := filepath.Match(pattern, info.Name()); !ok {
+			return nil
+		}
+		if e := os.Remove(path); e != nil {
+			fmt.Fprintf(out, "failed to remove %s: %v\n", path, e)
+		} else {
+			removed++
+			fmt.Fprintf(out, "removed %s\n", path)
+		}
+		return nil
+	})
+	fmt.Fprintf(out, "%d files removed\n", removed)
+	return err
+}
+
+// actionFileSnapshot copies params["src"] into params["dir"] with a
+// timestamp suffix and keeps at most params["keep"] snapshots.
+func actionFileSnapshot(cx context.Context, params map[string]string, out io.Writer) error {
+	if params["src"] == "" || params["dir"] == "" {
+		return fmt.Errorf("params src and dir are required")
+	}
+	src, err := actionPath(params["src"])
+	if err != nil {
+		return err
+	}
+	dir, err := actionPath(params["dir"])
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	base := filepath.Base(src)
+	dst := filepath.Join(dir, fmt.Sprintf("%s.%s", base, time.Now().In(log.BJ).Format("2006-01-02-15-04-05")))
+	if err = os.WriteFile(dst, buf, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "snapshot written to %s\n", dst)
+	if keep, e := strconv.Atoi(params["keep"]); e == nil && keep > 0 {
+		// timestamp suffixes sort chronologically
+		olds, _ := filepath.Glob(filepath.Join(dir, base+".*"))
+		for i := 0; i < len(olds)-keep; i++ {
+			if e := os.Remove(olds[i]); e == nil {
+				fmt.Fprintf(out, "removed %s\n", olds[i])
+			}
+		}
+	}
+	return nil
+}
+
+// actionLogUpload uploads the files under params["dir"] matching
+// params["pattern"] (default "*.log") through the configured Uploader.
+// Keys are params["prefix"] (default "<sn>/") followed by the path below
+// dir; with params["remove"] true uploaded files are deleted.
+func actionLogUpload(cx context.Context, params map[string]string, out io.Writer) error {
+	upload, _ := uploader.Load().(Uploader)
+	if upload == nil {
+		return fmt.Errorf("no log uploader is configured")
+	}
+	if params["dir"] == "" {
+		return fmt.Errorf("param dir is required")
+	}
+	dir, err := actionPath(params["dir"])
+	if err != nil {
+		return err
+	}
+	pattern := params["pattern"]
+	if pattern == "" {
+		pattern = "*.log"
+	}
+	prefix, ok := params["prefix"]
+	if !ok {
+		prefix = log.Sn + "/"
+	}
+	remove, _ := strconv.ParseBool(params["remove"])
+	uploaded, failed := 0, 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if e := cx.Err(); e != nil {
+			return e
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if ok, _ := filepath.Match(pattern, info.Name()); !ok {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		key := prefix + filepath.ToSlash(rel)
+		if e := upload(cx, key, path); e != nil {
+			failed++
+			fmt.Fprintf(out, "failed to upload %s: %v\n", path, e)
+			return nil
+		}
+		uploaded++
+		fmt.Fprintf(out, "uploaded %s as %s\n", path, key)
+		if remove {
+			if e := os.Remove(path); e != nil {
+				fmt.Fprintf(out, "failed to remove %s: %v\n", path, e)
+			}
+		}
+		return nil
+	})
+	fmt.Fprintf(out, "%d files uploaded, %d failed\n", uploaded, failed)
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d uploads failed", failed)
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cron
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestActionPathStaysBelowRoots(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	SetActionRoots(root)
+	defer SetActionRoots()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip(err)
+	}
+	for _, p := range []string{root, filepath.Join(root, "a", "b"), filepath.Join(root, "missing", "..", "x")} {
+		if _, err := actionPath(p); err != nil {
+			t.Errorf("%s refused: %v", p, err)
+		}
+	}
+	for _, p := range []string{"/", outside, root + "-other", filepath.Join(root, ".."),
+		filepath.Join(root, "link"), filepath.Join(root, "link", "new", "dir")} {
+		if _, err := actionPath(p); err == nil {
+			t.Errorf("%s accepted", p)
+		}
+	}
+
+	SetActionRoots()
+	if _, err := actionPath(root); err == nil {
+		t.Error("a path was accepted without roots")
+	}
+}
+
+func TestActionJobsRejectPathsOutsideRoots(t *testing.T) {
+	root := t.TempDir()
+	SetActionRoots(root)
+	defer SetActionRoots()
+	for _, job := range []*Job{
+		{Name: "clean", Spec: "@daily", Action: "disk.cleanup", Params: map[string]string{"dir": "/", "days": "1"}},
+		{Name: "snap", Spec: "@daily", Action: "file.snapshot", Params: map[string]string{"src": "/etc/passwd", "dir": root}},
+		{Name: "upload", Spec: "@daily", Action: "log.upload", Params: map[string]string{"dir": "/var/log"}},
+	} {
+		if err := job.Validate(time.Local); err == nil {
+			t.Errorf("job %s was accepted", job.Name)
+		}
+		if err := GetAction(job.Action)(context.Background(), job.Params, io.Discard); err == nil {
+			t.Errorf("action %s ran", job.Action)
+		}
+	}
+	ok := &Job{Name: "clean", Spec: "@daily", Action: "disk.cleanup", Params: map[string]string{"dir": root, "days": "1"}}
+	if err := ok.Validate(time.Local); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogUpload(t *testing.T) {
+	root := t.TempDir()
+	SetActionRoots(root)
+	defer SetActionRoots()
+	for _, name := range []string{"a.log", "sub/b.log", "c.txt"} {
+		p := filepath.Join(root, name)
+		_ = os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	SetUploader(func(cx context.Context, key, path string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	defer SetUploader(nil)
+
+	params := map[string]string{"dir": root, "prefix": "dev1/", "remove": "true"}
+	if err := actionLogUpload(context.Background(), params, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "dev1/a.log" || keys[1] != "dev1/sub/b.log" {
+		t.Fatalf("uploaded %v", keys)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.log")); !os.IsNotExist(err) {
+		t.Fatal("uploaded file was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "c.txt")); err != nil {
+		t.Fatal("file not matching the pattern was removed")
+	}
+
+	SetUploader(nil)
+	if err := actionLogUpload(context.Background(), params, io.Discard); err == nil {
+		t.Fatal("upload without an uploader succeeded")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"system-conf/common"
+	"time"
+)
+
+const (
+	JobKindCommand = "command"
+	JobKindAction  = "action"
+
+	defaultJobTimeout = 10 * time.Minute
+	outputTailSize    = 4096
+)
+
+// Job is a persisted job definition together with its last run status.
+// A job either runs Command/Args through common.Exec or a registered Action.
+type Job struct {
+	Id        string            `json:"id"`
+	Name      string            `json:"name"`
+	Spec      string            `json:"spec" example:"0 3 * * *"`
+	Enabled   bool              `json:"enabled"`
+	Command   string            `json:"command,omitempty"`
+	Args      []string          `json:"args,omitempty"`
+	WorkDir   string            `json:"workDir,omitempty"`
+	Charset   string            `json:"charset,omitempty"`
+	Action    string            `json:"action,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Timeout   int               `json:"timeout,omitempty" example:"600"`
+	MaxOutput int               `json:"maxOutput,omitempty" example:"4096"`
+	Status    JobStatus         `json:"status"`
+
+	schedule Schedule
+}
+
+type JobStatus struct {
+	Running  bool       `json:"running"`
+	LastRun  *time.Time `json:"lastRun,omitempty"`
+	NextRun  *time.Time `json:"nextRun,omitempty"`
+	Duration int64      `json:"duration,omitempty"`
+	ExitCode int        `json:"exitCode"`
+	ErrMsg   string     `json:"errMsg,omitempty"`
+	Output   string     `json:"output,omitempty"`
+	RunCount int64      `json:"runCount"`
+}
+
+func (j *Job) Kind() string {
+	if j.Action != "" {
+		return JobKindAction
+	}
+	return JobKindCommand
+}
+
+// Validate checks the definition and compiles its schedule.
+func (j *Job) Validate(loc *time.Location) (err error) {
+	if j.Name == "" {
+		return fmt.Errorf("job name is empty")
+	}
+	if (j.Command == "") == (j.Action == "") {
+		return fmt.Errorf("job must have either a command or an action")
+	}
+	if j.Action != "" {
+		if err = checkActionParams(j.Action, j.Params); err != nil {
+			return
+		}
+	}
+	j.schedule, err = Parse(j.Spec, loc)
+	return
+}
+
+func (j *Job) timeout() time.Duration {
+	if j.Timeout > 0 {
+		return time.Duration(j.Timeout) * time.Second
+	}
+	return defaultJobTimeout
+}
+
+// run executes the job once and returns the exit code and output tail.
+func (j *Job) run(cx context.Context) (exitCode int, output string, err error) {
+	cx, cancel := context.WithTimeout(cx, j.timeout())
+	defer cancel()
+	tail := &tailBuffer{max: outputTailSize}
+	if j.MaxOutput > 0 {
+		tail.max = j.MaxOutput
+	}
+	if j.Action != "" {
+		action := GetAction(j.Action)
+		if action == nil {
+			return -1, "", fmt.Errorf("unknown action:%s", j.Action)
+		}
+		if err = action(cx, j.Params, tail); err != nil {
+			exitCode = 1
+		}
+		return exitCode, tail.String(), err
+	}
+	ex := common.NewExec(j.WorkDir, j.Command)
+	ex.Args = j.Args
+	ex.SetCharset(common.ParseCharset(j.Charset))
+	ex.SetCallback(func(isErr bool, line string) {
+		tail.WriteString(line)
+	})
+	if err = ex.Start(cx); err != nil {
+		return -1, "", err
+	}
+	err = ex.Wait()
+	return ex.GetExitCode(), tail.String(), err
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return len(p), nil
+}
+func (b *tailBuffer) WriteString(s string) {
+	_, _ = b.Write([]byte(s))
+}
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.ToValidUTF8(string(b.buf), "")
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cron
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule yields the next activation time strictly after t.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowBounds = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+const starBit = 1 << 63
+
+// SpecSchedule is a standard 5-field cron expression
+// (minute hour day-of-month month day-of-week) stored as bit sets.
+type SpecSchedule struct {
+	Minute, Hour, Dom, Month, Dow uint64
+	Location                      *time.Location
+}
+
+// EverySchedule fires at a fixed interval, e.g. "@every 90s".
+type EverySchedule struct {
+	Interval time.Duration
+}
+
+func (s EverySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.Interval - time.Duration(t.Nanosecond())).Truncate(time.Second)
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a 5-field cron spec, a descriptor such as "@daily" or
+// "@every <duration>". Times are evaluated in loc (UTC if nil).
+func Parse(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if loc == nil {
+		loc = time.UTC
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("bad interval of %q:%v", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("interval of %q is shorter than 1s", spec)
+		}
+		return EverySchedule{Interval: d}, nil
+	}
+	if v, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = v
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q must have 5 fields", spec)
+	}
+	s := &SpecSchedule{Location: loc}
+	var err error
+	if s.Minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, err
+	}
+	if s.Hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, err
+	}
+	if s.Dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, err
+	}
+	if s.Month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, err
+	}
+	if s.Dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, err
+	}
+	// 7 is an alias of sunday
+	if s.Dow&(1<<7) != 0 {
+		s.Dow = s.Dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func parseField(field string, b bounds) (bitSet uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		var v uint64
+		if v, err = parseRange(part, b); err != nil {
+			return
+		}
+		bitSet |= v
+	}
+	return
+}
+
+func parseRange(expr string, b bounds) (uint64, error) {
+	rangeAndStep := strings.SplitN(expr, "/", 2)
+	lowAndHigh := strings.SplitN(rangeAndStep[0], "-", 2)
+	var start, end, step uint = 0, 0, 1
+	var extra uint64
+	var err error
+	if lowAndHigh[0] == "*" || lowAndHigh[0] == "?" {
+		start, end = b.min, b.max
+		extra = starBit
+	} else {
+		if start, err = parseValue(lowAndHigh[0], b); err != nil {
+			return 0, err
+		}
+		end = start
+		if len(lowAndHigh) == 2 {
+			if end, err = parseValue(lowAndHigh[1], b); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(rangeAndStep) == 2 {
+		v, e := strconv.ParseUint(rangeAndStep[1], 10, 8)
+		if e != nil || v == 0 {
+			return 0, fmt.Errorf("bad step in %q", expr)
+		}
+		step = uint(v)
+		extra = 0
+		// "5/10" means 5-max/10
+		if len(lowAndHigh) == 1 && lowAndHigh[0] != "*" && lowAndHigh[0] != "?" {
+			end = b.max
+		}
+	}
+	if start < b.min || end > b.max || start > end {
+		return 0, fmt.Errorf("value out of range (%d-%d) in %q", b.min, b.max, expr)
+	}
+	var bitSet uint64
+	for i := start; i <= end; i += step {
+		bitSet |= 1 << i
+	}
+	return bitSet | extra, nil
+}
+
+func parseValue(s string, b bounds) (uint, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return uint(v), nil
+}
+
+func has(bitSet uint64, v int) bool {
+	return bitSet&(1<<uint(v)) != 0
+}
+
+func (s *SpecSchedule) dayMatches(t time.Time) bool {
+	dom := has(s.Dom, t.Day())
+	dow := has(s.Dow, int(t.Weekday()))
+	// as in vixie cron: when both fields are restricted either one may match
+	if s.Dom&starBit != 0 || s.Dow&starBit != 0 {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *SpecSchedule) Next(t time.Time) time.Time {
+	origLoc := t.Location()
+	t = t.In(s.Location).Truncate(time.Minute).Add(time.Minute)
+	// no valid spec needs more than a few years to find a match
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		if !has(s.Month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if !has(s.Hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.Location)
+			continue
+		}
+		if !has(s.Minute, t.Minute()) {
+			// jump straight to the next allowed minute of this hour if any
+			rest := s.Minute &^ starBit >> uint(t.Minute())
+			if rest == 0 {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.Location)
+			} else {
+				t = t.Add(time.Duration(bits.TrailingZeros64(rest)) * time.Minute)
+			}
+			continue
+		}
+		return t.In(origLoc)
+	}
+	return time.Time{}
+}
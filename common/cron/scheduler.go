@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrJobNotFound = fmt.Errorf("job not found")
+
+// Scheduler runs jobs on their cron schedule and persists the definitions
+// and last run status to a JSON file.
+type Scheduler struct {
+	Path     string
+	Location *time.Location
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	wake chan struct{}
+	cx   context.Context
+	cl   context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+func NewScheduler(path string) *Scheduler {
+	return &Scheduler{
+		Path:     path,
+		Location: log.BJ,
+		jobs:     make(map[string]*Job),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Load reads the job file. A missing file is not an error.
+func (s *Scheduler) Load() error {
+	if s.Path == "" || !common.Exists(s.Path) {
+		return nil
+	}
+	buf, err := os.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	var jobs []*Job
+	if err = json.Unmarshal(buf, &jobs); err != nil {
+		return fmt.Errorf("failed to parse %s:%v", s.Path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range jobs {
+		if e := j.Validate(s.Location); e != nil {
+			log.Warnf("job %s(%s) is disabled: %v", j.Name, j.Id, e)
+			j.Enabled = false
+		}
+		j.Status.Running = false
+		s.jobs[j.Id] = j
+		s.reschedule(j, time.Now())
+	}
+	log.Printf("%d jobs loaded from %s", len(jobs), s.Path)
+	return nil
+}
+
+// save must be called with s.mu held.
+func (s *Scheduler) save() {
+	if s.Path == "" {
+		return
+	}
+	buf, err := json.MarshalIndent(s.list(), "", "  ")
+	if err == nil {
+		if dir := filepath.Dir(s.Path); !common.Exists(dir) {
+			_ = os.MkdirAll(dir, os.ModePerm)
+		}
+		tmp := s.Path + ".tmp"
+		if err = os.WriteFile(tmp, buf, 0644); err == nil {
+			err = os.Rename(tmp, s.Path)
+		}
+	}
+	if err != nil {
+		log.Warnf("failed to save jobs to %s: %v", s.Path, err)
+	}
+}
+
+func (s *Scheduler) list() []*Job {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].Name < jobs[b].Name || jobs[a].Name == jobs[b].Name && jobs[a].Id < jobs[b].Id
+	})
+	return jobs
+}
+
+// List returns copies of all jobs ordered by name.
+func (s *Scheduler) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Job, 0, len(s.jobs))
+	for _, j := range s.list() {
+		result = append(result, *j)
+	}
+	return result
+}
+
+func (s *Scheduler) Get(id string) (job Job, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, found := s.jobs[id]; found {
+		return *j, true
+	}
+	return
+}
+
+func (s *Scheduler) Add(job *Job) (id string, err error) {
+	if err = job.Validate(s.Location); err != nil {
+		return
+	}
+	job.Id = uuid.New().String()
+	job.Status = JobStatus{}
+	s.mu.Lock()
+	s.jobs[job.Id] = job
+	s.reschedule(job, time.Now())
+	s.save()
+	s.mu.Unlock()
+	s.notify()
+	return job.Id, nil
+}
+
+// Update replaces the definition of a job and keeps its run status.
+func (s *Scheduler) Update(id string, job *Job) (err error) {
+	if err = job.Validate(s.Location); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.notify()
+	defer s.mu.Unlock()
+	old, ok := s.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	job.Id = id
+	job.Status = old.Status
+	s.jobs[id] = job
+	s.reschedule(job, time.Now())
+	s.save()
+	return nil
+}
+
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	defer s.notify()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	delete(s.jobs, id)
+	s.save()
+	return nil
+}
+
+// RunNow starts a job immediately regardless of its schedule.
+func (s *Scheduler) RunNow(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if j.Status.Running {
+		return fmt.Errorf("job %s is running", j.Name)
+	}
+	s.launch(j)
+	return nil
+}
+
+// reschedule must be called with s.mu held.
+func (s *Scheduler) reschedule(j *Job, now time.Time) {
+	j.Status.NextRun = nil
+	if j.Enabled && j.schedule != nil {
+		if next := j.schedule.Next(now); !next.IsZero() {
+			j.Status.NextRun = &next
+		}
+	}
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cx != nil {
+		return
+	}
+	s.cx, s.cl = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.loop(s.cx)
+}
+
+// Stop halts scheduling, cancels running jobs and waits for them to exit.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	cl := s.cl
+	s.mu.Unlock()
+	if cl != nil {
+		cl()
+		s.wg.Wait()
+	}
+}
+
+func (s *Scheduler) loop(cx context.Context) {
+	defer s.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		wait := time.Hour
+		now := time.Now()
+		for _, j := range s.jobs {
+			if j.Enabled && j.Status.NextRun != nil {
+				if d := j.Status.NextRun.Sub(now); d < wait {
+					wait = d
+				}
+			}
+		}
+		s.mu.Unlock()
+		if wait < 0 {
+			wait = 0
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-cx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+			s.runDue(time.Now())
+		}
+	}
+}
+
+func (s *Scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if !j.Enabled || j.Status.NextRun == nil || j.Status.NextRun.After(now) {
+			continue
+		}
+		if j.Status.Running {
+			log.Warnf("job %s is still running; skip this round", j.Name)
+		} else {
+			s.launch(j)
+		}
+		s.reschedule(j, now)
+	}
+}
+
+// launch must be called with s.mu held.
+func (s *Scheduler) launch(j *Job) {
+	cx := s.cx
+	if cx == nil {
+		cx = context.Background()
+	}
+	tm := time.Now()
+	j.Status.Running = true
+	j.Status.LastRun = &tm
+	j.Status.RunCount++
+	job := *j
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		log.Printf("job %s started", job.Name)
+		code, output, err := job.run(cx)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if cur, ok := s.jobs[job.Id]; ok {
+			cur.Status.Running = false
+			cur.Status.Duration = time.Since(tm).Milliseconds()
+			cur.Status.ExitCode = code
+			cur.Status.Output = output
+			cur.Status.ErrMsg = ""
+			if err != nil {
+				cur.Status.ErrMsg = err.Error()
+			}
+			s.save()
+		}
+		log.Printf("job %s finished: code=%d err=%v", job.Name, code, err)
+	}()
+}
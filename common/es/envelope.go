@@ -0,0 +1,502 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package es
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// EnvelopeVersion is the version of the Envelope layout, sent as v.
+const EnvelopeVersion = 1
+
+// Formats a client can receive messages in. raw, json and base64 are the
+// message's own renderings; envelope, msgpack and cbor wrap it in an
+// Envelope.
+const (
+	FormatRaw      = "raw"
+	FormatJson     = "json"
+	FormatBase64   = "base64"
+	FormatEnvelope = "envelope"
+	FormatMsgpack  = "msgpack"
+	FormatCbor     = "cbor"
+)
+
+const (
+	ContentTypeJson   = "application/json"
+	ContentTypeText   = "text/plain; charset=utf-8"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Payload compressions of an Envelope.
+const (
+	CompressGzip    = "gzip"
+	CompressDeflate = "deflate"
+)
+
+// DefaultCompressMin is the payload size from which envelopes are compressed.
+const DefaultCompressMin = 1024
+
+// Envelope is the self-describing form of a broker message. Type is the
+// message's event, else its topic, else "message"; Schema names the
+// registered schema of that type. Payload holds ContentType data,
+// compressed when Encoding is set.
+//
+// In JSON the payload is embedded as is for uncompressed JSON, as a string
+// for uncompressed text and base64 encoded otherwise. msgpack and CBOR
+// encode the same fields as a map, with the payload as binary.
+type Envelope struct {
+	V           int    `json:"v"`
+	Type        string `json:"type"`
+	Time        int64  `json:"ts"` // unix milliseconds
+	Broker      string `json:"broker,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Src         string `json:"src,omitempty"`
+	Seq         uint64 `json:"seq,omitempty"`
+	Schema      string `json:"schema,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Payload     []byte `json:"-"`
+}
+
+// envelopeMessage is implemented by messages that fill in their broker,
+// content type and payload themselves.
+type envelopeMessage interface {
+	envelope(env *Envelope)
+}
+
+// NewEnvelope wraps msg. Messages of other types than MessageBody and
+// MessageStrBody carry their raw rendering as binary.
+func NewEnvelope(msg IEventSourceMessage) *Envelope {
+	env := &Envelope{V: EnvelopeVersion, Type: "message"}
+	at := time.Now()
+	if s, ok := msg.(*sequenced); ok {
+		env.Seq, at, msg = s.seq, s.at, s.IEventSourceMessage
+	}
+	env.Time = at.UnixMilli()
+	if m, ok := msg.(ITopicMessage); ok {
+		env.Topic, env.Src = m.GetTopic(), m.GetSrc()
+		if env.Topic != "" {
+			env.Type = env.Topic
+		}
+	}
+	if m, ok := msg.(IEventMessage); ok && m.GetEvent() != "" {
+		env.Type = m.GetEvent()
+	}
+	if m, ok := msg.(envelopeMessage); ok {
+		m.envelope(env)
+	} else {
+		env.ContentType, env.Payload = ContentTypeBinary, msg.ToRaw()
+	}
+	if s := LookupSchema(env.Type); s != nil {
+		env.Schema = s.Id()
+		// bytes pushed without a content type are what the schema says
+		if env.ContentType == ContentTypeBinary && s.ContentType != "" {
+			env.ContentType = s.ContentType
+		}
+	}
+	return env
+}
+
+func (m *MessageBody) envelope(env *Envelope) {
+	env.Broker = m.Id
+	if m.EventSourceResult != nil {
+		env.ContentType = ContentTypeJson
+		env.Payload, _ = json.Marshal(m.EventSourceResult)
+		return
+	}
+	switch data := m.Data.(type) {
+	case nil:
+	case []byte:
+		env.ContentType, env.Payload = ContentTypeBinary, data
+	case string:
+		env.ContentType, env.Payload = ContentTypeText, []byte(data)
+	default:
+		env.ContentType = ContentTypeJson
+		env.Payload, _ = json.Marshal(data)
+	}
+	if m.ContentType != "" {
+		env.ContentType = m.ContentType
+	}
+}
+
+func (m *MessageStrBody) envelope(env *Envelope) {
+	env.Broker = m.Id
+	env.ContentType, env.Payload = ContentTypeText, []byte(m.Data)
+}
+
+// Compress compresses the payload with method when it is at least min
+// bytes and gets smaller; an empty method leaves it alone.
+func (env *Envelope) Compress(method string, min int) error {
+	if method == "" || env.Encoding != "" || len(env.Payload) < min {
+		return nil
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch method {
+	case CompressGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressDeflate:
+		w = zlib.NewWriter(&buf)
+	default:
+		return fmt.Errorf("unknown compression %q", method)
+	}
+	if _, err := w.Write(env.Payload); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if buf.Len() < len(env.Payload) {
+		env.Payload, env.Encoding = buf.Bytes(), method
+	}
+	return nil
+}
+
+// Decompress undoes Compress.
+func (env *Envelope) Decompress() error {
+	var r io.ReadCloser
+	var err error
+	switch env.Encoding {
+	case "":
+		return nil
+	case CompressGzip:
+		r, err = gzip.NewReader(bytes.NewReader(env.Payload))
+	case CompressDeflate:
+		r, err = zlib.NewReader(bytes.NewReader(env.Payload))
+	default:
+		return fmt.Errorf("unknown compression %q", env.Encoding)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if env.Payload, err = io.ReadAll(r); err != nil {
+		return err
+	}
+	env.Encoding = ""
+	return nil
+}
+
+func (env *Envelope) MarshalJSON() ([]byte, error) {
+	type plain Envelope
+	var payload any
+	switch {
+	case env.Payload == nil:
+	case env.Encoding == "" && env.ContentType == ContentTypeJson && json.Valid(env.Payload):
+		payload = json.RawMessage(env.Payload)
+	case env.Encoding == "" && env.ContentType == ContentTypeText && utf8.Valid(env.Payload):
+		payload = string(env.Payload)
+	default:
+		payload = env.Payload
+	}
+	return json.Marshal(&struct {
+		*plain
+		Payload any `json:"payload,omitempty"`
+	}{(*plain)(env), payload})
+}
+
+type envelopeField struct {
+	key string
+	val any // string, uint64 or []byte
+}
+
+// fields lists what is encoded, in order and without the empty ones.
+func (env *Envelope) fields() []envelopeField {
+	fields := []envelopeField{{"v", uint64(env.V)}, {"type", env.Type}, {"ts", uint64(env.Time)}}
+	add := func(key, val string) {
+		if val != "" {
+			fields = append(fields, envelopeField{key, val})
+		}
+	}
+	add("broker", env.Broker)
+	add("topic", env.Topic)
+	add("src", env.Src)
+	if env.Seq > 0 {
+		fields = append(fields, envelopeField{"seq", env.Seq})
+	}
+	add("schema", env.Schema)
+	add("contentType", env.ContentType)
+	add("encoding", env.Encoding)
+	if env.Payload != nil {
+		fields = append(fields, envelopeField{"payload", env.Payload})
+	}
+	return fields
+}
+
+// MarshalMsgpack encodes the envelope as a MessagePack map.
+func (env *Envelope) MarshalMsgpack() []byte {
+	fields := env.fields()
+	buf := msgpackHead(nil, 0x80, 16, 0xde, len(fields))
+	for _, f := range fields {
+		buf = msgpackAppend(buf, f.key)
+		buf = msgpackAppend(buf, f.val)
+	}
+	return buf
+}
+
+// msgpackHead appends a map or str header: the fix form below fix, else
+// the 16 or 32 bit form starting at code.
+func msgpackHead(buf []byte, fixCode byte, fix int, code byte, n int) []byte {
+	switch {
+	case n < fix:
+		return append(buf, fixCode|byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, code), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, code+1), uint32(n))
+	}
+}
+
+func msgpackAppend(buf []byte, val any) []byte {
+	switch v := val.(type) {
+	case string:
+		if n := len(v); n >= 32 && n <= 0xff {
+			buf = append(buf, 0xd9, byte(n))
+		} else {
+			buf = msgpackHead(buf, 0xa0, 32, 0xda, n)
+		}
+		return append(buf, v...)
+	case uint64:
+		switch {
+		case v < 0x80:
+			return append(buf, byte(v))
+		case v <= 0xff:
+			return append(buf, 0xcc, byte(v))
+		case v <= 0xffff:
+			return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(v))
+		case v <= 0xffffffff:
+			return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(v))
+		default:
+			return binary.BigEndian.AppendUint64(append(buf, 0xcf), v)
+		}
+	case []byte:
+		switch n := len(v); {
+		case n <= 0xff:
+			buf = append(buf, 0xc4, byte(n))
+		case n <= 0xffff:
+			buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+		default:
+			buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+		}
+		return append(buf, v...)
+	}
+	return append(buf, 0xc0)
+}
+
+// MarshalCbor encodes the envelope as a CBOR (RFC 8949) map.
+func (env *Envelope) MarshalCbor() []byte {
+	fields := env.fields()
+	buf := cborHead(nil, 5, uint64(len(fields)))
+	for _, f := range fields {
+		buf = cborAppend(buf, f.key)
+		buf = cborAppend(buf, f.val)
+	}
+	return buf
+}
+
+// cborHead appends the initial byte of major type major with argument n.
+func cborHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= 0xff:
+		return append(buf, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major|27), n)
+	}
+}
+
+func cborAppend(buf []byte, val any) []byte {
+	switch v := val.(type) {
+	case string:
+		return append(cborHead(buf, 3, uint64(len(v))), v...)
+	case uint64:
+		return cborHead(buf, 0, v)
+	case []byte:
+		return append(cborHead(buf, 2, uint64(len(v))), v...)
+	}
+	// null
+	return append(buf, 0xf6)
+}
+
+// Encoding is how a client receives messages: the format and, for the
+// envelope formats, the compression of payloads of CompressMin bytes or more.
+type Encoding struct {
+	Format      string `json:"format"`
+	Compress    string `json:"compress,omitempty"`
+	CompressMin int    `json:"compressMin,omitempty"`
+}
+
+// ParseEncoding checks format and compress; an empty format is raw and a
+// non-positive min is DefaultCompressMin.
+func ParseEncoding(format, compress string, min int) (Encoding, error) {
+	enc := Encoding{Format: format, Compress: compress, CompressMin: min}
+	switch format {
+	case "":
+		enc.Format = FormatRaw
+	case FormatRaw, FormatJson, FormatBase64, FormatEnvelope, FormatMsgpack, FormatCbor:
+	default:
+		return enc, fmt.Errorf("unknown format %q", format)
+	}
+	switch compress {
+	case "":
+		enc.CompressMin = 0
+		return enc, nil
+	case CompressGzip, CompressDeflate:
+	default:
+		return enc, fmt.Errorf("unknown compression %q", compress)
+	}
+	if !enc.IsEnvelope() {
+		return enc, errors.New("compression needs the envelope, msgpack or cbor format")
+	}
+	if enc.CompressMin <= 0 {
+		enc.CompressMin = DefaultCompressMin
+	}
+	return enc, nil
+}
+
+// IsEnvelope reports whether messages are wrapped in an Envelope.
+func (enc Encoding) IsEnvelope() bool {
+	switch enc.Format {
+	case FormatEnvelope, FormatMsgpack, FormatCbor:
+		return true
+	}
+	return false
+}
+
+// IsBinary reports whether the payloads are binary rather than text.
+func (enc Encoding) IsBinary() bool {
+	return enc.Format == FormatMsgpack || enc.Format == FormatCbor
+}
+
+// Payload renders msg; see the Format constants.
+func (enc Encoding) Payload(msg IEventSourceMessage) []byte {
+	if enc.IsEnvelope() {
+		env := NewEnvelope(msg)
+		// the methods were checked by ParseEncoding
+		_ = env.Compress(enc.Compress, enc.CompressMin)
+		switch enc.Format {
+		case FormatMsgpack:
+			return env.MarshalMsgpack()
+		case FormatCbor:
+			return env.MarshalCbor()
+		}
+		buf, _ := env.MarshalJSON()
+		return buf
+	}
+	if s, ok := msg.(*sequenced); ok {
+		msg = s.IEventSourceMessage
+	}
+	switch enc.Format {
+	case FormatBase64:
+		return msg.ToBase64()
+	case FormatJson:
+		return msg.ToJson()
+	default:
+		return msg.ToRaw()
+	}
+}
+
+// Text is Payload for text-only transports such as SSE: the binary
+// formats are base64 encoded.
+func (enc Encoding) Text(msg IEventSourceMessage) []byte {
+	data := enc.Payload(msg)
+	if enc.IsBinary() {
+		return []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	return data
+}
+
+// Schema describes the payload of an envelope type. Definition is
+// typically a JSON Schema.
+type Schema struct {
+	Type        string          `json:"type"`
+	Version     int             `json:"version"`
+	ContentType string          `json:"contentType"`
+	Desc        string          `json:"desc,omitempty"`
+	Definition  json.RawMessage `json:"definition,omitempty" swaggertype:"object"`
+}
+
+// Id is the schema of an envelope, type/v<version>.
+func (s *Schema) Id() string {
+	return s.Type + "/v" + strconv.Itoa(s.Version)
+}
+
+var schemas = struct {
+	sync.RWMutex
+	types map[string]*Schema
+}{types: map[string]*Schema{
+	MqttTopic: {
+		Type: MqttTopic, Version: 1, ContentType: ContentTypeBinary,
+		Desc: "a message received from MQTT, src is its MQTT topic; text payloads are sent as text",
+	},
+}}
+
+// RegisterSchema registers or replaces the schema of s.Type.
+func RegisterSchema(s *Schema) error {
+	if s.Type == "" {
+		return errors.New("schema without type")
+	}
+	if s.Version <= 0 {
+		s.Version = 1
+	}
+	schemas.Lock()
+	schemas.types[s.Type] = s
+	schemas.Unlock()
+	return nil
+}
+
+// LookupSchema returns the schema of an envelope type, or nil.
+func LookupSchema(typ string) *Schema {
+	schemas.RLock()
+	defer schemas.RUnlock()
+	return schemas.types[typ]
+}
+
+// Schemas lists the registered schemas by type.
+func Schemas() []*Schema {
+	schemas.RLock()
+	list := make([]*Schema, 0, len(schemas.types))
+	for _, s := range schemas.types {
+		list = append(list, s)
+	}
+	schemas.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Type < list[j].Type })
+	return list
+}
@@ -22,6 +22,7 @@ package es
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -29,11 +30,16 @@ import (
 	"github.com/google/uuid"
 	"io"
 	"net/http"
+	"path"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"system-conf/common"
 	"system-conf/common/log"
 	"time"
+	"unicode/utf8"
 )
 
 type IEventSourceMessage interface {
@@ -48,13 +54,41 @@ type EventSourceResult struct {
 	Err     error         `json:"err,omitempty"`
 	Data    any           `json:"data,omitempty"`
 }
+
+// ITopicMessage is implemented by messages that can be filtered by topic
+// and source; other messages only reach clients without a filter.
+type ITopicMessage interface {
+	GetTopic() string
+	GetSrc() string
+}
+
+// IEventMessage is implemented by messages that name their SSE event.
+// Browsers only deliver named events to listeners added for that name, so
+// messages without one go out as plain "message" events.
+type IEventMessage interface {
+	GetEvent() string
+}
+
 type MessageBody struct {
 	Id                 string `json:"id"`
+	Topic              string `json:"topic,omitempty"`
+	Event              string `json:"event,omitempty"`
 	Src                string `json:"src"`
 	Data               any    `json:"data,omitempty"`
 	*EventSourceResult `json:",inline"`
+	// ContentType of Data in an Envelope, derived from its type if empty
+	ContentType string `json:"-"`
 }
 
+func (m *MessageBody) GetTopic() string {
+	return m.Topic
+}
+func (m *MessageBody) GetSrc() string {
+	return m.Src
+}
+func (m *MessageBody) GetEvent() string {
+	return m.Event
+}
 func (m *MessageBody) ToJson() []byte {
 	buf, _ := json.Marshal(m)
 	return buf
@@ -80,9 +114,17 @@ func (m *MessageBody) ToBase64() []byte {
 }
 
 type MessageStrBody struct {
-	Id   string `json:"id"`
-	Src  string `json:"src"`
-	Data string `json:"data"`
+	Id    string `json:"id"`
+	Topic string `json:"topic,omitempty"`
+	Src   string `json:"src"`
+	Data  string `json:"data"`
+}
+
+func (m *MessageStrBody) GetTopic() string {
+	return m.Topic
+}
+func (m *MessageStrBody) GetSrc() string {
+	return m.Src
 }
 
 func (m *MessageStrBody) ToJson() []byte {
@@ -107,6 +149,119 @@ func (m *MessageBody) ToRawJson() []byte {
 
 type MessageChan chan IEventSourceMessage
 
+// Filter selects the messages a client receives. Topics and Srcs hold
+// exact names or path.Match patterns such as "serial/*"; an empty list
+// matches everything.
+type Filter struct {
+	Topics []string `json:"topics,omitempty"`
+	Srcs   []string `json:"srcs,omitempty"`
+}
+
+// ParseFilter reads the topic and src query parameters, each repeatable or
+// comma separated.
+func ParseFilter(c *gin.Context) *Filter {
+	split := func(values []string) (list []string) {
+		for _, v := range values {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+		}
+		return
+	}
+	f := &Filter{Topics: split(c.QueryArray("topic")), Srcs: split(c.QueryArray("src"))}
+	if len(f.Topics) == 0 && len(f.Srcs) == 0 {
+		return nil
+	}
+	return f
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok || p == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether a message is delivered to a client with filter f;
+// a nil filter matches every message.
+func (f *Filter) Match(msg IEventSourceMessage) bool {
+	if f == nil {
+		return true
+	}
+	m, ok := msg.(ITopicMessage)
+	if !ok {
+		return false
+	}
+	return matchAny(f.Topics, m.GetTopic()) && matchAny(f.Srcs, m.GetSrc())
+}
+
+// sequenced is a message numbered by the broker; the number is sent as
+// the SSE id so reconnecting clients can resume after it. at is when the
+// broker received it.
+type sequenced struct {
+	IEventSourceMessage
+	seq uint64
+	at  time.Time
+}
+
+// OverflowPolicy decides what happens when a client's buffer is full.
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest discards the message that does not fit
+	DropNewest OverflowPolicy = "drop-newest"
+	// Disconnect closes the stream; an EventSource client reconnects and
+	// resumes from its Last-Event-ID
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case DropOldest, DropNewest, Disconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	Remote  string         `json:"remote,omitempty"`
+	Filter  *Filter        `json:"filter,omitempty"`
+	Policy  OverflowPolicy `json:"policy"`
+	Format  string         `json:"format,omitempty"`
+	Since   time.Time      `json:"since"`
+	Queued  int            `json:"queued"`
+	Dropped uint64         `json:"dropped"`
+}
+
+type esClient struct {
+	ch     MessageChan
+	filter *Filter
+	policy OverflowPolicy
+	enc    Encoding
+	remote string
+	since  time.Time
+	// gone is closed when the broker disconnects a slow client, closed is
+	// the close signal of the broker it registered with
+	gone    chan struct{}
+	closed  <-chan struct{}
+	dropped atomic.Uint64
+	// lastId is the Last-Event-ID of a reconnecting client; the history
+	// after it is handed over in backlog before ready is closed
+	lastId  uint64
+	backlog []IEventSourceMessage
+	ready   chan struct{}
+}
+
 type EventSourceBroker struct {
 	Id string
 	// Events are pushed to this channel by the main events-gathering routine
@@ -114,90 +269,378 @@ type EventSourceBroker struct {
 
 	dumpMap map[string]bool
 
-	Logs []string
+	// Charset of the bound inputs; empty means GB18030 on windows, UTF-8 elsewhere
+	Charset common.Charset
+
+	// Logs keeps the recent output of the bound inputs as lines
+	Logs *LogBuffer
+
+	// Retry is the reconnection delay sent to clients, Heartbeat the
+	// interval of the comments that keep idle streams open through proxies
+	// and HistorySize how many events are kept for Last-Event-ID replay
+	Retry       time.Duration
+	Heartbeat   time.Duration
+	HistorySize int
+
+	// ClientBuffer is the number of messages queued per client and
+	// Overflow what happens when a client falls that far behind, so a
+	// stalled client never holds up the others or the Notifier
+	ClientBuffer int
+	Overflow     OverflowPolicy
+
+	seq     uint64
+	history []*sequenced
 
 	// New client connections
-	newClients chan MessageChan
+	newClients chan *esClient
 
 	// Closed client connections
 	closingClients chan MessageChan
 
 	// Client connections registry
-	clients map[MessageChan]bool
+	clients   map[MessageChan]*esClient
+	clientsMu sync.Mutex
 
+	// IdleTimeout closes the broker once it has had no clients and no
+	// events for that long; zero keeps it until Close
+	IdleTimeout time.Duration
+
+	created time.Time
+	active  atomic.Int64
+
+	// mu guards closeSig and closed
+	mu       sync.Mutex
+	closed   bool
 	closeSig chan struct{}
 }
 
+// Close disconnects every client, stops the broker and its log file and
+// removes it from the registry. Pushing to a closed broker fails with
+// ErrBrokerClosed.
 func (broker *EventSourceBroker) Close() {
-	defer func() {
-		if e := recover(); e != nil {
-			log.Printf("close sig chan failed:%v", e)
+	broker.mu.Lock()
+	if broker.closed {
+		broker.mu.Unlock()
+		return
+	}
+	broker.closed = true
+	close(broker.closeSig)
+	broker.mu.Unlock()
+	unregisterBroker(broker)
+	_ = broker.Logs.Close()
+}
+
+// IsClosed reports whether Close has been called.
+func (broker *EventSourceBroker) IsClosed() bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.closed
+}
+
+// done returns the close signal of the broker's current run.
+func (broker *EventSourceBroker) done() <-chan struct{} {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.closeSig
+}
+
+func (broker *EventSourceBroker) touch() {
+	broker.active.Store(time.Now().UnixNano())
+}
+
+// notify queues msg for the listen loop unless the broker is closed.
+func (broker *EventSourceBroker) notify(msg IEventSourceMessage) error {
+	done := broker.done()
+	select {
+	case <-done:
+		return ErrBrokerClosed
+	default:
+	}
+	select {
+	case broker.Notifier <- msg:
+		return nil
+	case <-done:
+		return ErrBrokerClosed
+	}
+}
+
+// clientFor creates the client of a request, taking the overflow policy,
+// the format, compress and compressMin encoding and Last-Event-ID from it.
+func (broker *EventSourceBroker) clientFor(c *gin.Context, filter *Filter) (*esClient, error) {
+	var policy OverflowPolicy
+	if v := c.Query("overflow"); v != "" {
+		var err error
+		if policy, err = ParseOverflowPolicy(v); err != nil {
+			return nil, err
 		}
+	}
+	min, _ := strconv.Atoi(c.Query("compressMin"))
+	enc, err := ParseEncoding(c.Query("format"), c.Query("compress"), min)
+	if err != nil {
+		return nil, err
+	}
+	client := broker.newClient(filter, policy)
+	client.enc = enc
+	client.remote = c.Request.RemoteAddr
+	client.lastId = lastEventId(c)
+	client.ready = make(chan struct{})
+	return client, nil
+}
 
-	}()
-	close(broker.closeSig)
+// register adds client to the broker and waits for its replay backlog; it
+// fails once the broker is closed.
+func (broker *EventSourceBroker) register(client *esClient) bool {
+	client.closed = broker.done()
+	select {
+	case broker.newClients <- client:
+	case <-client.closed:
+		return false
+	}
+	if client.ready != nil {
+		<-client.ready
+	}
+	return true
+}
+
+// unregister removes client; after a Close there is nothing to remove.
+func (broker *EventSourceBroker) unregister(client *esClient) {
+	select {
+	case broker.closingClients <- client.ch:
+	case <-client.closed:
+	}
+}
+
+// newClient creates a client with its own bounded queue.
+func (broker *EventSourceBroker) newClient(filter *Filter, policy OverflowPolicy) *esClient {
+	size := broker.ClientBuffer
+	if size <= 0 {
+		size = DefaultClientBuffer
+	}
+	if policy == "" {
+		policy = broker.Overflow
+	}
+	if policy == "" {
+		policy = DropOldest
+	}
+	return &esClient{
+		ch:     make(MessageChan, size),
+		filter: filter,
+		policy: policy,
+		since:  time.Now(),
+		gone:   make(chan struct{}),
+	}
+}
+
+// Clients lists the connected clients with their queue length and the
+// number of messages dropped for them.
+func (broker *EventSourceBroker) Clients() []*ClientInfo {
+	broker.clientsMu.Lock()
+	defer broker.clientsMu.Unlock()
+	list := make([]*ClientInfo, 0, len(broker.clients))
+	for _, c := range broker.clients {
+		list = append(list, &ClientInfo{
+			Remote:  c.remote,
+			Filter:  c.filter,
+			Policy:  c.policy,
+			Format:  c.enc.Format,
+			Since:   c.since,
+			Queued:  len(c.ch),
+			Dropped: c.dropped.Load(),
+		})
+	}
+	return list
+}
+
+// deliver queues msg for c without ever blocking the broker.
+func (broker *EventSourceBroker) deliver(c *esClient, msg IEventSourceMessage) {
+	select {
+	case c.ch <- msg:
+		return
+	default:
+	}
+	if c.dropped.Add(1) == 1 {
+		log.Warnf("event source client %s is too slow, policy %s", c.remote, c.policy)
+	}
+	switch c.policy {
+	case DropNewest:
+	case Disconnect:
+		delete(broker.clients, c.ch)
+		close(c.gone)
+	default:
+		// the broker is the only sender, so once one message is taken out
+		// there is room for this one
+		select {
+		case <-c.ch:
+		default:
+		}
+		select {
+		case c.ch <- msg:
+		default:
+		}
+	}
 }
 
 func (broker *EventSourceBroker) SetDumpPile(name string, val bool) {
 	broker.dumpMap[name] = val
 }
+func (broker *EventSourceBroker) SetCharset(cs common.Charset) *EventSourceBroker {
+	broker.Charset = cs
+	return broker
+}
+
+// ResetCloseSig reopens a closed broker under its old id; it does nothing
+// while the broker is open or when another broker has taken the id.
 func (broker *EventSourceBroker) ResetCloseSig() {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if !broker.closed || !registerBroker(broker) {
+		return
+	}
+	broker.closed = false
 	broker.closeSig = make(chan struct{})
+	broker.touch()
+	go broker.listen(broker.closeSig)
 }
 
 // Listen on different channels and act accordingly
-func (broker *EventSourceBroker) listen() {
+func (broker *EventSourceBroker) listen(closeSig <-chan struct{}) {
 	for {
 		select {
+		case <-closeSig:
+			// the clients see closeSig too and stop on their own
+			broker.clientsMu.Lock()
+			broker.clients = make(map[MessageChan]*esClient)
+			broker.clientsMu.Unlock()
+			return
 		case s := <-broker.newClients:
+			broker.touch()
 
 			// A new client has connected.
 			// Register their message channel
-			broker.clients[s] = true
+			broker.clientsMu.Lock()
+			broker.clients[s.ch] = s
+			broker.clientsMu.Unlock()
+			if s.lastId > 0 {
+				for _, h := range broker.history {
+					if h.seq > s.lastId && s.filter.Match(h.IEventSourceMessage) {
+						s.backlog = append(s.backlog, h)
+					}
+				}
+			}
+			if s.ready != nil {
+				close(s.ready)
+			}
 			log.Printf("Client added. %d registered clients", len(broker.clients))
 		case s := <-broker.closingClients:
 			// A client has dettached and we want to
 			// stop sending them messages.
+			broker.touch()
+			broker.clientsMu.Lock()
 			delete(broker.clients, s)
+			broker.clientsMu.Unlock()
 			log.Printf("Removed client. %d registered clients", len(broker.clients))
 		case event := <-broker.Notifier:
 			// We got a new event from the outside!
-			// Send event to all connected clients
-			for clientMessageChan, _ := range broker.clients {
-				clientMessageChan <- event
+			broker.touch()
+			broker.seq++
+			numbered := &sequenced{IEventSourceMessage: event, seq: broker.seq, at: time.Now()}
+			// the done notices of departing clients are not worth replaying
+			if m, ok := event.(ITopicMessage); broker.HistorySize > 0 && !(ok && m.GetSrc() == esDoneSrc) {
+				if len(broker.history) >= broker.HistorySize {
+					copy(broker.history, broker.history[1:])
+					broker.history = broker.history[:len(broker.history)-1]
+				}
+				broker.history = append(broker.history, numbered)
 			}
+			// Send event to all connected clients subscribed to it
+			broker.clientsMu.Lock()
+			for _, client := range broker.clients {
+				if client.filter.Match(event) {
+					broker.deliver(client, numbered)
+				}
+			}
+			broker.clientsMu.Unlock()
 		}
 	}
 
 }
-func (broker *EventSourceBroker) PushJson(src string, data interface{}) (err error) {
+
+// Topic is a named channel of a broker. Clients subscribe to it with the
+// topic query parameter of ServeGin, so one broker can carry several
+// unrelated streams.
+type Topic struct {
+	broker *EventSourceBroker
+	Name   string
+}
+
+// Topic returns a handle publishing to the named topic; the broker's own
+// Push methods publish to the default topic "".
+func (broker *EventSourceBroker) Topic(name string) *Topic {
+	return &Topic{broker: broker, Name: name}
+}
+
+func (t *Topic) PushJson(src string, data interface{}) (err error) {
 	if buf, e := json.Marshal(data); e != nil {
 		err = fmt.Errorf("failed to marshal json:%v", e)
 		return
 	} else {
-		broker.Notifier <- &MessageBody{
-			Id:   broker.Id,
-			Src:  src,
-			Data: buf,
-		}
+		err = t.broker.notify(&MessageBody{
+			Id:          t.broker.Id,
+			Topic:       t.Name,
+			Src:         src,
+			Data:        buf,
+			ContentType: ContentTypeJson,
+		})
 	}
 	return
 }
-func (broker *EventSourceBroker) PushData(src string, data interface{}) (err error) {
-	broker.Notifier <- &MessageBody{
-		Id:   broker.Id,
-		Src:  src,
-		Data: data,
-	}
-	return
+func (t *Topic) PushData(src string, data interface{}) (err error) {
+	return t.broker.notify(&MessageBody{
+		Id:    t.broker.Id,
+		Topic: t.Name,
+		Src:   src,
+		Data:  data,
+	})
 }
-func (broker *EventSourceBroker) PushResult(result EventSourceResult) (err error) {
-	broker.Notifier <- &MessageBody{
-		Id:                broker.Id,
+func (t *Topic) PushResult(result EventSourceResult) (err error) {
+	return t.broker.notify(&MessageBody{
+		Id:                t.broker.Id,
+		Topic:             t.Name,
 		Src:               "result",
 		EventSourceResult: &result,
+	})
+}
+
+// Writer returns an io.Writer pushing each write to the topic as data of
+// src, a string if it is UTF-8 and bytes otherwise.
+func (t *Topic) Writer(src string) io.Writer {
+	return &topicWriter{topic: t, src: src}
+}
+
+type topicWriter struct {
+	topic *Topic
+	src   string
+}
+
+func (w *topicWriter) Write(p []byte) (int, error) {
+	var data any = append([]byte(nil), p...)
+	if utf8.Valid(p) {
+		data = string(p)
 	}
-	return
+	if err := w.topic.PushData(w.src, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (broker *EventSourceBroker) PushJson(src string, data interface{}) (err error) {
+	return broker.Topic("").PushJson(src, data)
+}
+func (broker *EventSourceBroker) PushData(src string, data interface{}) (err error) {
+	return broker.Topic("").PushData(src, data)
+}
+func (broker *EventSourceBroker) PushResult(result EventSourceResult) (err error) {
+	return broker.Topic("").PushResult(result)
 }
 
 type EsBase64 struct {
@@ -223,34 +666,91 @@ func (m *EsJson) Marshal() []byte {
 
 var esPrefix = []byte("data: ")
 var esSuffix = []byte("\n\n")
+var esHeartbeat = []byte(": heartbeat\n\n")
+
+const (
+	DefaultRetry       = 3 * time.Second
+	DefaultHeartbeat   = 15 * time.Second
+	DefaultHistorySize = 256
+	// DefaultClientBuffer is the per-client queue length
+	DefaultClientBuffer = 256
+)
 
 const esDone = "------------ HTTP EVENT SOURCE DONE ------------"
+const esDoneSrc = "EventSourceBroker"
 
 func WriteEsData(rw http.ResponseWriter, raw bool, format string, msg IEventSourceMessage) {
+	writeEsEvent(rw, raw, Encoding{Format: format}, "", msg)
+}
+
+// writeEsEvent writes msg as one SSE frame: the event name (event, or the
+// message's own), the broker's sequence id and the payload split into one
+// data field per line, CR LF and lone CR ending lines as in the spec.
+func writeEsEvent(rw http.ResponseWriter, raw bool, enc Encoding, event string, msg IEventSourceMessage) {
+	var seq uint64
+	if s, ok := msg.(*sequenced); ok {
+		seq, msg = s.seq, s.IEventSourceMessage
+	}
 	// Make sure that the writer supports flushing.
 	if raw {
 		// Raw JSON events, one per line
 		rw.Write(msg.ToRaw())
-	} else {
+		return
+	}
+	if m, ok := msg.(IEventMessage); ok && m.GetEvent() != "" {
+		event = m.GetEvent()
+	}
+	if event != "" {
+		rw.Write([]byte("event: " + strings.NewReplacer("\r", "", "\n", "").Replace(event) + "\n"))
+	}
+	if seq > 0 {
+		rw.Write([]byte("id: " + strconv.FormatUint(seq, 10) + "\n"))
+	}
+	data := enc.Text(msg)
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for {
 		rw.Write(esPrefix)
-		switch format {
-		case "base64":
-			rw.Write(msg.ToBase64())
-		case "json":
-			rw.Write(msg.ToJson())
-		default:
-			rw.Write(msg.ToRaw())
-			//rw.Write([]byte(" \b"))
-			//fmt.Printf("msg:%s", msg)
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			rw.Write(data)
+			break
 		}
-		rw.Write(esSuffix)
+		rw.Write(data[:i+1])
+		data = data[i+1:]
 	}
+	rw.Write(esSuffix)
+}
+
+// lastEventId reads the Last-Event-ID header, or the lastEventId query
+// parameter for clients that cannot set headers.
+func lastEventId(c *gin.Context) uint64 {
+	v := c.GetHeader("Last-Event-ID")
+	if v == "" {
+		v = c.Query("lastEventId")
+	}
+	id, _ := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	return id
 }
 
 // Implement the http.Handler interface.
 // This allows us to wrap HTTP handlers (see auth_handler.go)
 // http://golang.org/pkg/net/http/#Handler
+//
+// The topic and src query parameters restrict the stream, see ParseFilter.
+// With event=src every message is sent as an SSE event named after its
+// source. A client reconnecting with Last-Event-ID gets the events it
+// missed from the broker's history instead of msgs. overflow overrides
+// the broker's OverflowPolicy for this client. format is one of the Format
+// constants, the binary msgpack and cbor ones base64 encoded; compress and
+// compressMin compress the envelope payloads, see ParseEncoding.
 func (broker *EventSourceBroker) ServeGin(c *gin.Context, msgs ...string) {
+	broker.ServeFilter(c, ParseFilter(c), msgs...)
+}
+
+// ServeFilter streams the messages matching filter to c after the prefill
+// msgs; a nil filter receives everything.
+func (broker *EventSourceBroker) ServeFilter(c *gin.Context, filter *Filter, msgs ...string) {
 
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
@@ -265,63 +765,91 @@ func (broker *EventSourceBroker) ServeGin(c *gin.Context, msgs ...string) {
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 
 	// Each connection registers its own message channel with the EventSourceBroker's connections registry
-	messageChan := make(MessageChan)
+	client, err := broker.clientFor(c, filter)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messageChan := client.ch
 
 	// Signal the broker that we have a new connection
-	broker.newClients <- messageChan
+	if !broker.register(client) {
+		http.Error(c.Writer, ErrBrokerClosed.Error(), http.StatusGone)
+		return
+	}
 
-	// Remove this client from the map of connected clients
-	// when this handler exits.
+	// Remove this client from the map of connected clients when this
+	// handler exits. messageChan stays open: listen may still be sending
+	// on it until the broker has dropped the client.
 	defer func() {
-		broker.closingClients <- messageChan
+		broker.unregister(client)
+		broker.PushData(esDoneSrc, esDone)
 	}()
 
 	// "raw" query string option
 	// If provided, send raw JSON lines instead of SSE-compliant strings.
 	c.DefaultQuery("raw", "0")
-	c.DefaultQuery("format", "raw")
 	raw := false
 	if v := common.ParseIntFromQuery(c, "raw"); v != nil && *v > 0 {
 		raw = true
 	}
-	format := c.Query("format")
-
-	// Listen to connection close and un-register messageChan
+	format := client.enc
+	eventName := func(msg IEventSourceMessage) string {
+		if c.Query("event") != "src" {
+			return ""
+		}
+		if s, ok := msg.(*sequenced); ok {
+			msg = s.IEventSourceMessage
+		}
+		if m, ok := msg.(ITopicMessage); ok {
+			return m.GetSrc()
+		}
+		return ""
+	}
 
+	// Listen to connection close
 	notify := c.Writer.(http.CloseNotifier).CloseNotify()
-	go func() {
-	DONE:
-		for {
-			select {
-			case <-c.Request.Context().Done():
-				break DONE
-			case <-notify:
-				break DONE
-			case <-broker.closeSig:
-				break DONE
+	if !raw && broker.Retry > 0 {
+		c.Writer.WriteString("retry: " + strconv.FormatInt(broker.Retry.Milliseconds(), 10) + "\n\n")
+	}
+	if client.lastId == 0 {
+		for _, msg := range msgs {
+			prefill := &MessageStrBody{
+				Id:   broker.Id,
+				Src:  "prefill",
+				Data: msg,
 			}
+			writeEsEvent(c.Writer, raw, format, eventName(prefill), prefill)
 		}
-		broker.closingClients <- messageChan
-		broker.PushData("EventSourceBroker", esDone)
-		close(messageChan)
-
-	}()
-	for _, msg := range msgs {
-		WriteEsData(c.Writer, raw, format, &MessageStrBody{
-			Id:   broker.Id,
-			Src:  "prefill",
-			Data: msg,
-		})
-		flusher.Flush()
+	}
+	for _, msg := range client.backlog {
+		writeEsEvent(c.Writer, raw, format, eventName(msg), msg)
+	}
+	flusher.Flush()
+	var heartbeat <-chan time.Time
+	if !raw && broker.Heartbeat > 0 {
+		t := time.NewTicker(broker.Heartbeat)
+		defer t.Stop()
+		heartbeat = t.C
 	}
 	defer c.Status(http.StatusOK)
 	// block waiting or messages broadcast on this connection's messageChan
 	for {
-		if msg, ok1 := <-messageChan; ok1 {
-			WriteEsData(c.Writer, raw, format, msg)
+		select {
+		case msg := <-messageChan:
+			writeEsEvent(c.Writer, raw, format, eventName(msg), msg)
+			flusher.Flush()
+		case <-client.gone:
+			return
+		case <-client.closed:
+			return
+		case <-c.Request.Context().Done():
+			return
+		case <-notify:
+			return
+		case <-heartbeat:
+			c.Writer.Write(esHeartbeat)
 			flusher.Flush()
-		} else {
-			break
 		}
 	}
 
@@ -329,58 +857,76 @@ func (broker *EventSourceBroker) ServeGin(c *gin.Context, msgs ...string) {
 func (broker *EventSourceBroker) DumpOutput(cx context.Context) {
 
 	// Each connection registers its own message channel with the EventSourceBroker's connections registry
-	messageChan := make(MessageChan)
+	client := broker.newClient(nil, "")
+	messageChan := client.ch
 
 	// Signal the broker that we have a new connection
-	broker.newClients <- messageChan
+	if !broker.register(client) {
+		return
+	}
 
-	// Remove this client from the map of connected clients
-	// when this handler exits.
+	// Remove this client from the map of connected clients when this
+	// returns; messageChan stays open, as for ServeFilter.
 	defer func() {
-		broker.closingClients <- messageChan
-	}()
-
-	// "raw" query string option
-	// If provided, send raw JSON lines instead of SSE-compliant strings.
-
-	// Listen to connection close and un-register messageChan
-
-	go func() {
-	DONE:
-		for {
-			select {
-			case <-cx.Done():
-				break DONE
-			case <-broker.closeSig:
-				break DONE
-			}
-		}
-		broker.closingClients <- messageChan
-		broker.PushData("EventSourceBroker", esDone)
-		close(messageChan)
-
+		broker.unregister(client)
+		broker.PushData(esDoneSrc, esDone)
 	}()
 
 	// block waiting or messages broadcast on this connection's messageChan
 	for {
-		if msg, ok1 := <-messageChan; ok1 {
+		select {
+		case msg := <-messageChan:
+			if s, ok := msg.(*sequenced); ok {
+				msg = s.IEventSourceMessage
+			}
 			log.Println(msg)
-		} else {
-			break
+		case <-client.gone:
+			return
+		case <-client.closed:
+			return
+		case <-cx.Done():
+			return
 		}
 	}
 }
 func (broker *EventSourceBroker) BindInput(name string, reader io.Reader) {
+	broker.BindTopicInput("", name, reader)
+}
+
+// BindTopicInput is BindInput publishing to topic, so the output of several
+// processes can share one broker.
+func (broker *EventSourceBroker) BindTopicInput(topic, name string, reader io.Reader) {
 	buf := make([]byte, 4096)
 	rd := bufio.NewReader(reader)
-	for {
-		var charSet common.Charset
+	charSet := broker.Charset
+	if charSet == "" {
 		switch runtime.GOOS {
 		case "windows":
 			charSet = common.GB18030
 		default:
 			charSet = common.UTF8
 		}
+	}
+	decoder := common.NewCharsetDecoder(charSet)
+	publish := func(msg string) {
+		if len(msg) == 0 {
+			return
+		}
+		broker.Logs.Write(name, msg)
+		if v, ok := broker.dumpMap[name]; ok && v {
+			log.Warnf("data from %s: %s", name, msg)
+		}
+		// a closed broker drops it; reading goes on so the writer never blocks
+		_ = broker.notify(&MessageBody{
+			Id:    broker.Id,
+			Topic: topic,
+			Src:   name,
+			Data:  msg,
+		})
+	}
+	// a sequence cut short by EOF or a read error is still published
+	defer func() { publish(decoder.Flush()) }()
+	for {
 
 		//if line, e := rd.ReadString('\n'); e != nil {
 		//	if e == io.EOF {
@@ -401,38 +947,7 @@ func (broker *EventSourceBroker) BindInput(name string, reader io.Reader) {
 		//}
 		if n, e := rd.Read(buf); e == nil {
 			if n > 0 {
-				msg := common.ConvertByte2String(buf[:n], charSet)
-				logSz := len(broker.Logs)
-				if msg == "\r" {
-					if logSz > 0 {
-						broker.Logs[logSz-1] += "\r"
-					}
-				} else {
-					if logSz > 0 && strings.HasSuffix(broker.Logs[logSz-1], "\r") {
-						broker.Logs[logSz-1] = msg
-					} else {
-						broker.Logs = append(broker.Logs, msg)
-					}
-				}
-				//log.Printf("got log(%d):%s \n", len(msg), msg)
-				//if strings.HasPrefix(msg, "frame=") && len(broker.Logs) > 0 {
-				//	// 如果消息以 "frame=" 开头且 broker.Logs 不为空，替换最后一个元素
-				//	broker.Logs[len(broker.Logs)-1] = msg
-				//} else {
-				//	// 否则，直接追加消息
-				//	broker.Logs = append(broker.Logs, msg)
-				//}
-				if v, ok := broker.dumpMap[name]; ok && v {
-					log.Warnf("data from %s: %s", name, msg)
-				}
-				//if name != "stdout" {
-				//	log.Warnf("data from %s: %s", name, msg)
-				//}
-				broker.Notifier <- &MessageBody{
-					Id:   broker.Id,
-					Src:  name,
-					Data: msg,
-				}
+				publish(decoder.Decode(buf[:n]))
 			}
 		} else {
 			if e == io.EOF {
@@ -443,20 +958,36 @@ func (broker *EventSourceBroker) BindInput(name string, reader io.Reader) {
 		}
 	}
 }
+
+// NewEventStreamBroker creates and registers a broker with a random id.
 func NewEventStreamBroker() (broker *EventSourceBroker) {
+	broker, _ = Create("")
+	return
+}
+
+func newBroker(id string) (broker *EventSourceBroker) {
+	if id == "" {
+		id = uuid.New().String()
+	}
 	// Instantiate a broker
 	broker = &EventSourceBroker{
-		Id:             uuid.New().String(),
+		Id:             id,
+		created:        time.Now(),
 		Notifier:       make(chan IEventSourceMessage, 1024),
+		Retry:          DefaultRetry,
+		Heartbeat:      DefaultHeartbeat,
+		HistorySize:    DefaultHistorySize,
 		dumpMap:        make(map[string]bool),
-		newClients:     make(chan MessageChan),
+		Logs:           NewLogBuffer(DefaultLogLines, DefaultLogBytes),
+		newClients:     make(chan *esClient),
 		closingClients: make(chan MessageChan),
-		clients:        make(map[MessageChan]bool),
+		clients:        make(map[MessageChan]*esClient),
 		closeSig:       make(chan struct{}),
 	}
 
+	broker.touch()
 	// Set it running - listening and broadcasting events
-	go broker.listen()
+	go broker.listen(broker.closeSig)
 
 	return
 }
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package es
+
+import (
+	"bufio"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"system-conf/common"
+	"testing"
+	"time"
+)
+
+// seqOf returns the broker sequence number of a queued message.
+func seqOf(t *testing.T, msg IEventSourceMessage) uint64 {
+	t.Helper()
+	s, ok := msg.(*sequenced)
+	if !ok {
+		t.Fatalf("queued message %T is not sequenced", msg)
+	}
+	return s.seq
+}
+
+// One subscriber that never reads must not hold up another: the fast one
+// gets every event while the slow one is trimmed, or dropped, as its
+// policy says.
+func TestSlowClientDoesNotStallOthers(t *testing.T) {
+	const buffer, events = 4, 50
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Disconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			broker := newBroker("")
+			defer broker.Close()
+			broker.ClientBuffer = buffer
+
+			slow := broker.newClient(nil, policy)
+			fast := broker.newClient(nil, DropNewest)
+			if !broker.register(slow) || !broker.register(fast) {
+				t.Fatal("broker closed")
+			}
+			// lockstep: each event must reach the fast client before the
+			// next is pushed, whatever the slow one does
+			for i := 1; i <= events; i++ {
+				if err := broker.PushData("test", i); err != nil {
+					t.Fatalf("push %d: %v", i, err)
+				}
+				select {
+				case msg := <-fast.ch:
+					if seq := seqOf(t, msg); seq != uint64(i) {
+						t.Fatalf("fast client got event %d, want %d", seq, i)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("fast client stalled at event %d", i)
+				}
+			}
+			if n := fast.dropped.Load(); n != 0 {
+				t.Fatalf("fast client dropped %d events", n)
+			}
+
+			switch policy {
+			case Disconnect:
+				select {
+				case <-slow.gone:
+				default:
+					t.Fatal("slow client was not disconnected")
+				}
+				for _, c := range broker.Clients() {
+					if c.Policy == Disconnect {
+						t.Fatal("disconnected client is still registered")
+					}
+				}
+			default:
+				if len(slow.ch) != buffer {
+					t.Fatalf("slow client has %d queued, want %d", len(slow.ch), buffer)
+				}
+				if n := slow.dropped.Load(); n != events-buffer {
+					t.Fatalf("slow client dropped %d, want %d", n, events-buffer)
+				}
+				// drop-oldest keeps the latest events, drop-newest the first
+				first := uint64(1)
+				if policy == DropOldest {
+					first = events - buffer + 1
+				}
+				for i := uint64(0); i < buffer; i++ {
+					if seq := seqOf(t, <-slow.ch); seq != first+i {
+						t.Fatalf("slow client kept event %d, want %d", seq, first+i)
+					}
+				}
+			}
+		})
+	}
+}
+
+// A multi-byte character cut short by EOF is still published when the
+// input ends.
+func TestBindTopicInputFlushesAtEOF(t *testing.T) {
+	broker := newBroker("")
+	defer broker.Close()
+	broker.Charset = common.UTF8
+	client := broker.newClient(nil, DropNewest)
+	if !broker.register(client) {
+		t.Fatal("broker closed")
+	}
+	const input = "héllo\xe4\xb8"
+	broker.BindTopicInput("", "stdout", strings.NewReader(input))
+
+	var got strings.Builder
+	for got.Len() < len(input) {
+		select {
+		case msg := <-client.ch:
+			got.WriteString(msg.(*sequenced).IEventSourceMessage.(*MessageBody).Data.(string))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %q, want %q", got.String(), input)
+		}
+	}
+	if got.String() != input {
+		t.Fatalf("got %q, want %q", got.String(), input)
+	}
+}
+
+// Closing the broker while it delivers to a streaming client must end the
+// stream; the client queue is never closed under the broker.
+func TestServeFilterBrokerClose(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for i := 0; i < 20; i++ {
+		broker := newBroker("")
+		engine := gin.New()
+		engine.GET("/events", func(c *gin.Context) { broker.ServeGin(c) })
+		srv := httptest.NewServer(engine)
+
+		resp, err := http.Get(srv.URL + "/events?overflow=drop-newest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd := bufio.NewReader(resp.Body)
+		if _, err = rd.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = broker.PushData("test", "x")
+				}
+			}
+		}()
+		time.Sleep(5 * time.Millisecond)
+		broker.Close()
+		close(stop)
+
+		ended := make(chan struct{})
+		go func() {
+			defer close(ended)
+			for {
+				if _, err := rd.ReadString('\n'); err != nil {
+					return
+				}
+			}
+		}()
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream did not end after Close")
+		}
+		resp.Body.Close()
+		srv.Close()
+	}
+}
+
+// DumpOutput ends when the broker closes while events are pushed, and
+// when its context is done.
+func TestDumpOutputEnds(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		broker := newBroker("")
+		cx, cancel := context.WithCancel(context.Background())
+		ended := make(chan struct{})
+		go func() {
+			defer close(ended)
+			broker.DumpOutput(cx)
+		}()
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = broker.PushData("test", "x")
+				}
+			}
+		}()
+		time.Sleep(time.Millisecond)
+		if i%2 == 0 {
+			broker.Close()
+		} else {
+			cancel()
+		}
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("DumpOutput did not end")
+		}
+		close(stop)
+		cancel()
+		broker.Close()
+	}
+}
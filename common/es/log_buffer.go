@@ -0,0 +1,353 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package es
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLogLines = 5000
+	DefaultLogBytes = 4 << 20
+	// MaxLogLineBytes ends a line that never sees a newline, such as a
+	// process writing binary data
+	MaxLogLineBytes = 64 << 10
+	// DefaultLogFileBytes is the size at which a persisted log is rotated
+	// to <path>.1
+	DefaultLogFileBytes = 16 << 20
+)
+
+// LogLine is one line of output. Offsets count every line ever written
+// to the buffer, so they stay valid while old lines are evicted. Partial
+// is set on the last line of a source until its newline arrives.
+type LogLine struct {
+	Offset  uint64    `json:"offset"`
+	Time    time.Time `json:"time"`
+	Src     string    `json:"src"`
+	Text    string    `json:"text"`
+	Partial bool      `json:"partial,omitempty"`
+}
+
+// pending is the unfinished line of a source; cr is set when its last
+// chunk ended in a carriage return, so the next text overwrites it.
+type pending struct {
+	line *LogLine
+	cr   bool
+}
+
+// LogBuffer keeps the latest output of a broker's inputs as lines, capped
+// by MaxLines and MaxBytes. Chunks are assembled into lines per source and
+// a carriage return overwrites the current line the way a terminal does,
+// so progress bars take one line. Complete lines are appended to a JSON
+// lines file once Persist is called.
+type LogBuffer struct {
+	MaxLines     int
+	MaxBytes     int
+	MaxFileBytes int64
+
+	mu      sync.Mutex
+	lines   []*LogLine
+	bytes   int
+	next    uint64
+	pending map[string]*pending
+	file    *os.File
+	path    string
+	size    int64
+}
+
+func NewLogBuffer(maxLines, maxBytes int) *LogBuffer {
+	return &LogBuffer{
+		MaxLines:     maxLines,
+		MaxBytes:     maxBytes,
+		MaxFileBytes: DefaultLogFileBytes,
+		pending:      make(map[string]*pending),
+	}
+}
+
+// Write adds a chunk of output from src.
+func (b *LogBuffer) Write(src, chunk string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for len(chunk) > 0 {
+		i := strings.IndexAny(chunk, "\r\n")
+		text := chunk
+		if i >= 0 {
+			text = chunk[:i]
+		}
+		if text != "" {
+			p := b.current(src, now)
+			if p.cr {
+				b.bytes -= len(p.line.Text)
+				p.line.Text = ""
+				p.cr = false
+			}
+			if room := MaxLogLineBytes - len(p.line.Text); len(text) > room {
+				text = text[:room]
+				chunk = chunk[room:]
+				i = -2
+			}
+			p.line.Text += text
+			p.line.Time = now
+			b.bytes += len(text)
+			if i == -2 {
+				b.finish(src)
+				continue
+			}
+		}
+		if i < 0 {
+			break
+		}
+		switch {
+		case chunk[i] == '\n':
+			b.current(src, now)
+			b.finish(src)
+		case i+1 < len(chunk) && chunk[i+1] == '\n':
+			// CR LF ends the line like LF
+			b.current(src, now)
+			b.finish(src)
+			i++
+		default:
+			b.current(src, now).cr = true
+		}
+		chunk = chunk[i+1:]
+	}
+	b.evict()
+}
+
+// current returns the unfinished line of src, starting one if needed.
+func (b *LogBuffer) current(src string, now time.Time) *pending {
+	if p, ok := b.pending[src]; ok {
+		return p
+	}
+	line := &LogLine{Offset: b.next, Time: now, Src: src, Partial: true}
+	b.next++
+	b.lines = append(b.lines, line)
+	p := &pending{line: line}
+	b.pending[src] = p
+	return p
+}
+
+func (b *LogBuffer) finish(src string) {
+	p, ok := b.pending[src]
+	if !ok {
+		return
+	}
+	delete(b.pending, src)
+	p.line.Partial = false
+	b.persist(p.line)
+}
+
+func (b *LogBuffer) evict() {
+	n := 0
+	for n < len(b.lines) && ((b.MaxLines > 0 && len(b.lines)-n > b.MaxLines) || (b.MaxBytes > 0 && b.bytes > b.MaxBytes)) {
+		line := b.lines[n]
+		b.bytes -= len(line.Text)
+		if p, ok := b.pending[line.Src]; ok && p.line == line {
+			delete(b.pending, line.Src)
+		}
+		n++
+	}
+	if n > 0 {
+		b.lines = append(b.lines[:0], b.lines[n:]...)
+	}
+}
+
+// Query returns up to limit lines (all with limit <= 0) from offset on,
+// optionally only those of src, and the offset to continue from. Lines
+// evicted before offset are skipped, which the caller sees as a gap
+// between offset and the first line. next stops at the first partial line
+// so it is fetched again once complete; lines after it repeat as well.
+func (b *LogBuffer) Query(offset uint64, limit int, src string) (lines []*LogLine, next uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	next = offset
+	if len(b.lines) == 0 {
+		return
+	}
+	// offsets increase by one per line, restored logs may have gaps where
+	// partial lines were never persisted, so walk back from the guess
+	start := 0
+	if first := b.lines[0].Offset; offset > first {
+		start = int(offset - first)
+		if start > len(b.lines) {
+			start = len(b.lines)
+		}
+		for start > 0 && b.lines[start-1].Offset >= offset {
+			start--
+		}
+	}
+	partial := false
+	for _, line := range b.lines[start:] {
+		if line.Offset < offset {
+			continue
+		}
+		if limit > 0 && len(lines) >= limit {
+			break
+		}
+		if !partial {
+			next = line.Offset + 1
+		}
+		if src != "" && line.Src != src {
+			continue
+		}
+		if line.Partial && !partial {
+			// come back for the rest of the line
+			partial = true
+			next = line.Offset
+		}
+		l := *line
+		lines = append(lines, &l)
+	}
+	return
+}
+
+// Tail returns the last n lines.
+func (b *LogBuffer) Tail(n int) []*LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n <= 0 || n > len(b.lines) {
+		n = len(b.lines)
+	}
+	lines := make([]*LogLine, 0, n)
+	for _, line := range b.lines[len(b.lines)-n:] {
+		l := *line
+		lines = append(lines, &l)
+	}
+	return lines
+}
+
+// Len returns the number of buffered lines and their total size.
+func (b *LogBuffer) Len() (lines, bytes int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.lines), b.bytes
+}
+
+// Persist appends complete lines to path as JSON lines from now on. Lines
+// already in the file are loaded first, so offsets continue across
+// restarts.
+func (b *LogBuffer) Persist(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	restored, err := readLogFile(path, b.MaxLines)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.Close()
+	}
+	b.file, b.path, b.size = f, path, st.Size()
+	if len(restored) > 0 && len(b.lines) == 0 {
+		for _, line := range restored {
+			b.bytes += len(line.Text)
+		}
+		b.lines = restored
+		b.next = restored[len(restored)-1].Offset + 1
+		b.evict()
+	}
+	return nil
+}
+
+// Close stops persisting.
+func (b *LogBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+func (b *LogBuffer) persist(line *LogLine) {
+	if b.file == nil {
+		return
+	}
+	buf, _ := json.Marshal(line)
+	buf = append(buf, '\n')
+	if b.MaxFileBytes > 0 && b.size+int64(len(buf)) > b.MaxFileBytes {
+		b.file.Close()
+		_ = os.Rename(b.path, b.path+".1")
+		f, err := os.OpenFile(b.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			b.file = nil
+			return
+		}
+		b.file, b.size = f, 0
+	}
+	if n, err := b.file.Write(buf); err == nil {
+		b.size += int64(n)
+	}
+}
+
+// readLogFile returns the last max lines of a persisted log.
+func readLogFile(path string, max int) ([]*LogLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var lines []*LogLine
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 4096), 2*MaxLogLineBytes)
+	for sc.Scan() {
+		line := &LogLine{}
+		if json.Unmarshal(sc.Bytes(), line) != nil {
+			continue
+		}
+		lines = append(lines, line)
+		if max > 0 && len(lines) > 2*max {
+			lines = append(lines[:0], lines[len(lines)-max:]...)
+		}
+	}
+	// lines are written as they complete, not in offset order
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].Offset < lines[j].Offset
+	})
+	if max > 0 && len(lines) > max {
+		lines = lines[len(lines)-max:]
+	}
+	return lines, sc.Err()
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package es
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"system-conf/common/log"
+	"system-conf/common/mqtt"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// DefaultMqttPrefix is the topic root of republished broker messages;
+	// {sn} is replaced by the device serial number
+	DefaultMqttPrefix = "es/{sn}"
+	// MqttTopic is the broker topic of messages received from MQTT
+	MqttTopic = "mqtt"
+)
+
+// MqttBridge connects a broker with an MQTT session in both directions:
+// Start republishes the broker's messages to <Prefix>/<broker id>/[<topic>/]<src>,
+// and Subscribe feeds MQTT messages into the broker on the topic "mqtt",
+// with the MQTT topic as Src, so browsers can watch them. Messages that
+// came from MQTT are never published back.
+type MqttBridge struct {
+	Broker  *EventSourceBroker
+	Session *mqtt.Session
+	Prefix  string
+	Qos     int
+	// Encoding of the published payloads, json by default
+	Encoding Encoding
+	// Filter restricts what is republished, nil publishes everything
+	Filter *Filter
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	subs   []string
+}
+
+// mqttMessage marks a message received from MQTT.
+type mqttMessage struct {
+	*MessageBody
+}
+
+func NewMqttBridge(broker *EventSourceBroker, session *mqtt.Session) *MqttBridge {
+	return &MqttBridge{Broker: broker, Session: session, Prefix: DefaultMqttPrefix, Encoding: Encoding{Format: FormatJson}}
+}
+
+// TopicFor returns the MQTT topic a message is published on. The wildcard
+// characters + and # are not allowed in published topics and become _.
+func (b *MqttBridge) TopicFor(topic, src string) string {
+	parts := []string{strings.ReplaceAll(b.Prefix, "{sn}", log.Sn), b.Broker.Id}
+	if topic != "" {
+		parts = append(parts, topic)
+	}
+	if src != "" {
+		parts = append(parts, src)
+	}
+	return strings.NewReplacer("+", "_", "#", "_").Replace(strings.Join(parts, "/"))
+}
+
+// Start republishes the broker's messages until Stop or the broker closes.
+func (b *MqttBridge) Start() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		return nil
+	}
+	client := b.Broker.newClient(b.Filter, DropOldest)
+	client.remote = "mqtt:" + b.Prefix
+	if !b.Broker.register(client) {
+		return ErrBrokerClosed
+	}
+	cx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go func() {
+		defer b.Broker.unregister(client)
+		for {
+			select {
+			case <-cx.Done():
+				return
+			case <-client.closed:
+				return
+			case <-client.gone:
+				return
+			case msg := <-client.ch:
+				b.publish(msg)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *MqttBridge) publish(numbered IEventSourceMessage) {
+	msg := numbered
+	if s, ok := msg.(*sequenced); ok {
+		msg = s.IEventSourceMessage
+	}
+	if _, ok := msg.(*mqttMessage); ok {
+		return
+	}
+	var topic, src string
+	if m, ok := msg.(ITopicMessage); ok {
+		topic, src = m.GetTopic(), m.GetSrc()
+	}
+	if src == esDoneSrc {
+		return
+	}
+	if err := b.Session.Publish(b.TopicFor(topic, src), b.Qos, false, b.Encoding.Payload(numbered)); err != nil {
+		log.Warnf("failed to publish event of %s: %v", b.Broker.Id, err)
+	}
+}
+
+// Subscribe feeds messages matching the MQTT topic filter into the broker.
+// Text payloads are pushed as strings, others as bytes. A filter that
+// fails to subscribe is not kept.
+func (b *MqttBridge) Subscribe(filter string, qos int) error {
+	broker := b.Broker
+	err := b.Session.Subscribe(filter, qos, func(msg MQTT.Message) {
+		var data any = msg.Payload()
+		if utf8.Valid(msg.Payload()) {
+			data = string(msg.Payload())
+		}
+		// the MQTT client must not block, drop what the broker cannot take
+		select {
+		case broker.Notifier <- &mqttMessage{&MessageBody{Id: broker.Id, Topic: MqttTopic, Src: msg.Topic(), Data: data}}:
+		default:
+		}
+	})
+	if err != nil {
+		// the session would retry it on reconnect, out of reach of Stop
+		b.Session.Unsubscribe(filter)
+		return err
+	}
+	// the session keeps the subscription and renews it on reconnect
+	b.mu.Lock()
+	b.subs = append(b.subs, filter)
+	b.mu.Unlock()
+	return nil
+}
+
+// Stop ends republishing and removes the subscriptions.
+func (b *MqttBridge) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		b.cancel()
+		b.cancel = nil
+	}
+	if len(b.subs) > 0 {
+		b.Session.Unsubscribe(b.subs...)
+		b.subs = nil
+	}
+}
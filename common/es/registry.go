@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package es
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/log"
+	"time"
+)
+
+var (
+	ErrBrokerExists = errors.New("event source broker already exists")
+	ErrBrokerClosed = errors.New("event source broker is closed")
+)
+
+// GCInterval is how often brokers are checked against their IdleTimeout.
+var GCInterval = time.Minute
+
+// BrokerInfo describes a registered broker.
+type BrokerInfo struct {
+	Id          string        `json:"id"`
+	Clients     int           `json:"clients"`
+	Pending     int           `json:"pending"`
+	Logs        int           `json:"logs"`
+	LogBytes    int           `json:"logBytes"`
+	Created     time.Time     `json:"created"`
+	LastActive  time.Time     `json:"lastActive"`
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty" swaggertype:"integer"`
+}
+
+var registry = struct {
+	sync.Mutex
+	brokers map[string]*EventSourceBroker
+	gc      sync.Once
+}{brokers: make(map[string]*EventSourceBroker)}
+
+func init() {
+	// end the streams first so the http server can drain
+	common.OnShutdown(common.ShutdownStageServer, "event sources", func(cx context.Context) error {
+		CloseAll()
+		return nil
+	})
+}
+
+// Create starts and registers a broker; an empty id gets a random one.
+func Create(id string) (*EventSourceBroker, error) {
+	broker := newBroker(id)
+	if !registerBroker(broker) {
+		broker.Close()
+		return nil, ErrBrokerExists
+	}
+	registry.gc.Do(func() {
+		go gcLoop()
+	})
+	return broker, nil
+}
+
+// Get returns the open broker with id, or nil.
+func Get(id string) *EventSourceBroker {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.brokers[id]
+}
+
+// GetOrCreate returns the broker with id, creating it if needed.
+func GetOrCreate(id string) *EventSourceBroker {
+	for {
+		if broker := Get(id); broker != nil {
+			return broker
+		}
+		if broker, err := Create(id); err == nil {
+			return broker
+		}
+	}
+}
+
+// List describes every open broker, sorted by id.
+func List() []*BrokerInfo {
+	registry.Lock()
+	brokers := make([]*EventSourceBroker, 0, len(registry.brokers))
+	for _, broker := range registry.brokers {
+		brokers = append(brokers, broker)
+	}
+	registry.Unlock()
+	list := make([]*BrokerInfo, 0, len(brokers))
+	for _, broker := range brokers {
+		list = append(list, broker.Info())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Close closes the broker with id and reports whether it existed.
+func Close(id string) bool {
+	broker := Get(id)
+	if broker == nil {
+		return false
+	}
+	broker.Close()
+	return true
+}
+
+// CloseAll closes every registered broker.
+func CloseAll() {
+	registry.Lock()
+	brokers := make([]*EventSourceBroker, 0, len(registry.brokers))
+	for _, broker := range registry.brokers {
+		brokers = append(brokers, broker)
+	}
+	registry.Unlock()
+	for _, broker := range brokers {
+		broker.Close()
+	}
+}
+
+func registerBroker(broker *EventSourceBroker) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.brokers[broker.Id]; ok {
+		return false
+	}
+	registry.brokers[broker.Id] = broker
+	return true
+}
+
+func unregisterBroker(broker *EventSourceBroker) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.brokers[broker.Id] == broker {
+		delete(registry.brokers, broker.Id)
+	}
+}
+
+// Info describes the broker.
+func (broker *EventSourceBroker) Info() *BrokerInfo {
+	broker.clientsMu.Lock()
+	clients := len(broker.clients)
+	broker.clientsMu.Unlock()
+	info := &BrokerInfo{
+		Id:          broker.Id,
+		Clients:     clients,
+		Pending:     len(broker.Notifier),
+		Created:     broker.created,
+		LastActive:  time.Unix(0, broker.active.Load()),
+		IdleTimeout: broker.IdleTimeout,
+	}
+	info.Logs, info.LogBytes = broker.Logs.Len()
+	return info
+}
+
+// gcLoop closes brokers that sat without clients and events for longer
+// than their IdleTimeout.
+func gcLoop() {
+	t := time.NewTicker(GCInterval)
+	defer t.Stop()
+	for range t.C {
+		registry.Lock()
+		var idle []*EventSourceBroker
+		for _, broker := range registry.brokers {
+			if broker.IdleTimeout <= 0 || len(broker.Notifier) > 0 {
+				continue
+			}
+			if time.Since(time.Unix(0, broker.active.Load())) < broker.IdleTimeout {
+				continue
+			}
+			broker.clientsMu.Lock()
+			empty := len(broker.clients) == 0
+			broker.clientsMu.Unlock()
+			if empty {
+				idle = append(idle, broker)
+			}
+		}
+		registry.Unlock()
+		for _, broker := range idle {
+			log.Printf("closing idle event source broker %s", broker.Id)
+			broker.Close()
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package es
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"system-conf/common/log"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsReadLimit    = 64 * 1024
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// the event streams answer any origin, see ServeFilter
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// ServeWebSocket is ServeGin for clients without EventSource. Every message
+// is one WebSocket message in the requested format, binary for msgpack and
+// cbor or a raw payload that is not UTF-8, text otherwise; topic, src,
+// overflow, compress and lastEventId work as for ServeGin. Messages from
+// the client are written to input, or dropped when input is nil.
+func (broker *EventSourceBroker) ServeWebSocket(c *gin.Context, input io.Writer, msgs ...string) {
+	client, err := broker.clientFor(c, ParseFilter(c))
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already answered with an error
+		return
+	}
+	defer conn.Close()
+	messageChan := client.ch
+	if !broker.register(client) {
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ErrBrokerClosed.Error()), time.Now().Add(wsWriteTimeout))
+		return
+	}
+	defer broker.unregister(client)
+
+	heartbeat := broker.Heartbeat
+	readDeadline := func() {
+		if heartbeat > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+		}
+	}
+	readDeadline()
+	conn.SetPongHandler(func(string) error {
+		readDeadline()
+		return nil
+	})
+	conn.SetReadLimit(wsReadLimit)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			_, data, e := conn.ReadMessage()
+			if e != nil {
+				return
+			}
+			readDeadline()
+			if input == nil {
+				continue
+			}
+			if _, e = input.Write(data); e != nil {
+				log.Warnf("websocket client %s: %v", client.remote, e)
+			}
+		}
+	}()
+
+	enc := client.enc
+	send := func(msg IEventSourceMessage) bool {
+		data := enc.Payload(msg)
+		typ := websocket.TextMessage
+		if enc.IsBinary() || enc.Format == FormatRaw && !utf8.Valid(data) {
+			typ = websocket.BinaryMessage
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteMessage(typ, data) == nil
+	}
+	if client.lastId == 0 {
+		for _, msg := range msgs {
+			if !send(&MessageStrBody{Id: broker.Id, Src: "prefill", Data: msg}) {
+				return
+			}
+		}
+	}
+	for _, msg := range client.backlog {
+		if !send(msg) {
+			return
+		}
+	}
+	var ping <-chan time.Time
+	if heartbeat > 0 {
+		t := time.NewTicker(heartbeat)
+		defer t.Stop()
+		ping = t.C
+	}
+	for {
+		select {
+		case msg, ok := <-messageChan:
+			if !ok || !send(msg) {
+				return
+			}
+		case <-ping:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+				return
+			}
+		case <-client.gone:
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"), time.Now().Add(wsWriteTimeout))
+			return
+		case <-client.closed:
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteTimeout))
+			return
+		case <-closed:
+			return
+		}
+	}
+}
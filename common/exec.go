@@ -23,12 +23,13 @@ package common
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"os/signal"
-	"syscall"
+	"sync"
+	"system-conf/common/log"
 	"time"
 )
 
@@ -48,48 +49,98 @@ const (
 	ProcStatusDisabled = 8
 )
 
-var sysExitFlag chan bool
+// ExecState is the lifecycle state of a single run of an Exec.
+type ExecState int
 
-func init() {
-	sysExitFlag = make(chan bool)
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		close(sysExitFlag)
-		time.Sleep(time.Millisecond * 100)
-		syscall.Exit(-1)
-	}()
+const (
+	ExecStateIdle ExecState = iota
+	ExecStateStarting
+	ExecStateRunning
+	ExecStateStopping
+	ExecStateExited
+)
+
+func (s ExecState) String() string {
+	switch s {
+	case ExecStateIdle:
+		return "idle"
+	case ExecStateStarting:
+		return "starting"
+	case ExecStateRunning:
+		return "running"
+	case ExecStateStopping:
+		return "stopping"
+	case ExecStateExited:
+		return "exited"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// ExitStatus describes how the last run of an Exec terminated.
+// Code is -1 when the process was killed by a signal or never started.
+type ExitStatus struct {
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+	ErrMsg string `json:"errMsg,omitempty"`
 }
 
+// ExecStateObserver is called on every state transition. It is invoked
+// synchronously, so it must not call back into Start/Stop/Wait.
+type ExecStateObserver func(state ExecState, status ExitStatus)
+
+var (
+	ErrExecRunning     = errors.New("process is already running")
+	ErrExecNotStarted  = errors.New("process has not been started")
+	ErrExecStopTimeout = errors.New("process did not exit in time")
+)
+
+const DefaultStopTimeout = 5 * time.Second
+
+// ProcessMap holds the children that are stopped together with the service,
+// keyed by pid.
+var ProcessMap = sync.Map{}
+
 type Exec struct {
 	WorkDir                string
 	ExecName               string
 	Args                   []string
 	cb                     ProcessOutputCB
 	pipeCb                 PipeCB
+	observer               ExecStateObserver
+	charset                Charset
 	Cmd                    *exec.Cmd
 	cx                     context.Context
 	cl                     context.CancelFunc
-	runFlag                bool
-	isRunning              bool
+	keepDone               chan struct{}
 	ignoreParentExitTerSig bool
 	bCreateSession         bool
+
+	mu      sync.Mutex
+	state   ExecState
+	status  ExitStatus
+	waitErr error
+	done    chan struct{}
 }
 
 func NewExec(wd, execName string) (ex *Exec) {
 	return &Exec{
 		WorkDir:  wd,
 		ExecName: execName,
-		runFlag:  false,
+		status:   ExitStatus{Code: -1},
 	}
 }
 
 func (m *Exec) GetExitCode() int {
-	if m.Cmd != nil && m.Cmd.ProcessState != nil {
-		return m.Cmd.ProcessState.ExitCode()
-	}
-	return -1
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.Code
+}
+
+// ExitStatus returns the exit code and terminating signal of the last run.
+func (m *Exec) ExitStatus() ExitStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
 }
 func (m *Exec) SetIgnoreParentExitTermSig(val bool) *Exec {
 	m.ignoreParentExitTerSig = val
@@ -102,97 +153,381 @@ func (m *Exec) SetPipeCallback(cb func(name string, reader io.ReadCloser)) *Exec
 func (m *Exec) SetCallback(cb ProcessOutputCB) {
 	m.cb = cb
 }
+
+// SetCharset selects how stdout/stderr are decoded for the line callback.
+// The default is UTF8.
+func (m *Exec) SetCharset(cs Charset) *Exec {
+	m.charset = cs
+	return m
+}
 func (m *Exec) SetCreateSession(val bool) *Exec {
 	m.bCreateSession = val
 	return m
 }
+func (m *Exec) SetStateObserver(cb ExecStateObserver) *Exec {
+	m.mu.Lock()
+	m.observer = cb
+	m.mu.Unlock()
+	return m
+}
 
+func (m *Exec) State() ExecState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
 func (m *Exec) IsRunning() bool {
-	return m.isRunning
+	return m.State() == ExecStateRunning
 }
-func (m *Exec) StopRun() {
-	m.Kill()
-	if m.runFlag {
-		m.runFlag = false
-		<-m.cx.Done()
+
+// Done returns a channel closed when the current run exits. It is nil
+// before the first Start.
+func (m *Exec) Done() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done
+}
+
+// setState moves the run forward to state and reports whether it did. A
+// run never goes back, e.g. from Exited to Stopping when the process exits
+// while being stopped; only Start begins a new one.
+func (m *Exec) setState(state ExecState) bool {
+	m.mu.Lock()
+	if state <= m.state && state != ExecStateStarting {
+		m.mu.Unlock()
+		return false
 	}
+	m.state = state
+	cb, status := m.observer, m.status
+	m.mu.Unlock()
+	if cb != nil {
+		cb(state, status)
+	}
+	return true
 }
 
-func (m *Exec) StartRun(mode int, chStatus chan<- ProcessStatus) {
-	if !m.runFlag {
-		m.runFlag = true
-		m.cx, m.cl = context.WithCancel(context.Background())
-		if mode > 0 {
-			go m.keepRun(mode, chStatus)
+func (m *Exec) pid() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Cmd != nil && m.Cmd.Process != nil {
+		return m.Cmd.Process.Pid
+	}
+	return 0
+}
+
+func (m *Exec) track(cmd *exec.Cmd) {
+	pid := cmd.Process.Pid
+	log.Printf("proc(%d) started: %s %v", pid, cmd.Path, cmd.Args)
+	// the process-group shutdown stage terminates what is tracked here
+	if pid > 0 && !m.ignoreParentExitTerSig {
+		ProcessMap.Store(pid, cmd)
+	}
+}
+func (m *Exec) untrack(cmd *exec.Cmd) {
+	ProcessMap.Delete(cmd.Process.Pid)
+}
+
+// terminate asks the whole process tree of the child to exit.
+func (m *Exec) terminate() error {
+	pid := m.pid()
+	if pid == 0 {
+		return ErrExecNotStarted
+	}
+	log.Warnf("try to term process group of pid:%d", pid)
+	return termProcessTree(pid)
+}
+
+// Kill forcibly kills the whole process tree of the child.
+func (m *Exec) Kill() {
+	if pid := m.pid(); pid != 0 {
+		log.Warnf("try to kill process group of pid:%d", pid)
+		if e := killProcessTree(pid); e != nil {
+			log.Warnf("failed to kill process group of pid:%d; err:%v", pid, e)
 		}
+	}
+}
 
+// StopProcessGroups terminates every process group in ProcessMap, waits up
+// to ProcessStopTimeout for them to be reaped and then kills the survivors.
+func StopProcessGroups(cx context.Context) error {
+	pids := func() (list []int) {
+		ProcessMap.Range(func(key, value any) bool {
+			list = append(list, key.(int))
+			return true
+		})
+		return
 	}
+	for _, pid := range pids() {
+		log.Warnf("try to term process group of pid:%d", pid)
+		if e := termProcessTree(pid); e != nil {
+			log.Warnf("failed to term process group of pid:%d; err:%v", pid, e)
+		}
+	}
+	wait, cancel := context.WithTimeout(cx, ProcessStopTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(pids()) > 0 {
+		select {
+		case <-wait.Done():
+			left := pids()
+			for _, pid := range left {
+				log.Warnf("process group of pid:%d did not exit; kill it", pid)
+				_ = killProcessTree(pid)
+			}
+			if len(left) > 0 {
+				return fmt.Errorf("%d process groups were killed", len(left))
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
-func (m *Exec) keepRun(mode int, chState chan<- ProcessStatus) {
+
+// Start launches the process and returns once it is running. Cancelling
+// ctx stops the process the same way Stop does.
+func (m *Exec) Start(ctx context.Context) (err error) {
+	if IsShuttingDown() {
+		return ErrShuttingDown
+	}
+	m.mu.Lock()
+	switch m.state {
+	case ExecStateStarting, ExecStateRunning, ExecStateStopping:
+		m.mu.Unlock()
+		return ErrExecRunning
+	}
+	m.state = ExecStateStarting
+	m.status = ExitStatus{Code: -1}
+	m.waitErr = nil
+	done := make(chan struct{})
+	m.done = done
+	m.mu.Unlock()
+	m.setState(ExecStateStarting)
+
+	cmd := m.newCmd()
+	if m.WorkDir != "" {
+		cmd.Dir = m.WorkDir
+	}
+	var stdout, stderr io.ReadCloser
+	if stdout, err = cmd.StdoutPipe(); err == nil {
+		stderr, err = cmd.StderrPipe()
+	}
+	if err != nil {
+		m.finish(done, nil, err)
+		return
+	}
+	var readers sync.WaitGroup
+	if m.pipeCb == nil {
+		readers.Add(2)
+		go m.readPipe(stdout, false, &readers)
+		go m.readPipe(stderr, true, &readers)
+	} else {
+		m.pipeCb("stdout", stdout)
+		m.pipeCb("stderr", stderr)
+	}
+	if err = cmd.Start(); err != nil {
+		m.finish(done, nil, err)
+		return
+	}
+	m.mu.Lock()
+	m.Cmd = cmd
+	m.mu.Unlock()
+	m.track(cmd)
+	m.setState(ExecStateRunning)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = m.Stop(DefaultStopTimeout)
+		case <-done:
+		}
+	}()
+	go func() {
+		readers.Wait()
+		e := cmd.Wait()
+		m.untrack(cmd)
+		m.finish(done, cmd.ProcessState, e)
+	}()
+	return
+}
+
+func (m *Exec) finish(done chan struct{}, ps *os.ProcessState, err error) {
+	status := ExitStatus{Code: -1}
+	if ps != nil {
+		status.Code = ps.ExitCode()
+		status.Signal = exitSignal(ps)
+	}
+	if err != nil {
+		status.ErrMsg = err.Error()
+		if ps == nil {
+			err = fmt.Errorf("failed to start proc. err: %v", err)
+		} else {
+			err = fmt.Errorf("proc exited. err: %v", err)
+		}
+	}
+	m.mu.Lock()
+	m.status = status
+	m.waitErr = err
+	m.mu.Unlock()
+	m.setState(ExecStateExited)
+	close(done)
+}
+
+// Wait blocks until the current run exits and returns its error.
+func (m *Exec) Wait() error {
+	m.mu.Lock()
+	done := m.done
+	m.mu.Unlock()
+	if done == nil {
+		return ErrExecNotStarted
+	}
+	<-done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.waitErr
+}
+
+// Stop asks the process group to terminate and escalates to a kill when it
+// has not exited within timeout.
+func (m *Exec) Stop(timeout time.Duration) error {
+	m.mu.Lock()
+	state, done := m.state, m.done
+	m.mu.Unlock()
+	if state != ExecStateRunning && state != ExecStateStopping {
+		return nil
+	}
+	// only the caller that moves the run to Stopping signals it; if it has
+	// exited meanwhile done is already closed
+	if m.setState(ExecStateStopping) {
+		if e := m.terminate(); e != nil {
+			m.Kill()
+		}
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+	m.Kill()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrExecStopTimeout
+	}
+}
+
+// Run starts the process and waits for it to exit.
+func (m *Exec) Run() error {
+	if err := m.Start(context.Background()); err != nil {
+		return err
+	}
+	return m.Wait()
+}
+
+func (m *Exec) StopRun() {
+	m.mu.Lock()
+	cl, keepDone := m.cl, m.keepDone
+	m.mu.Unlock()
+	if cl == nil {
+		_ = m.Stop(DefaultStopTimeout)
+		return
+	}
+	cl()
+	_ = m.Stop(DefaultStopTimeout)
+	<-keepDone
+}
+
+func (m *Exec) StartRun(mode int, chStatus chan<- ProcessStatus) {
+	m.mu.Lock()
+	if m.cx != nil && m.cx.Err() == nil {
+		m.mu.Unlock()
+		return
+	}
+	m.cx, m.cl = context.WithCancel(ShutdownContext())
+	cx, cl := m.cx, m.cl
+	keepDone := make(chan struct{})
+	m.keepDone = keepDone
+	m.mu.Unlock()
+	if mode > 0 {
+		go m.keepRun(cx, cl, keepDone, mode, chStatus)
+	} else {
+		close(keepDone)
+	}
+}
+func (m *Exec) keepRun(cx context.Context, cl context.CancelFunc, keepDone chan struct{}, mode int, chState chan<- ProcessStatus) {
+	defer close(keepDone)
 	retry := 2
-	for m.runFlag && retry > 0 {
+	for cx.Err() == nil && retry > 0 {
 		chState <- ProcessStatus{ProcStatusStarting, "启动中"}
 
-		cx, cancel := context.WithCancel(context.Background())
-		go func() {
-			time.Sleep(5 * time.Second)
-			if m.isRunning {
-				chState <- ProcessStatus{ProcStatusStarted, "已启动"}
-			}
-			ticker := time.NewTicker(time.Second * 10)
-			defer ticker.Stop()
-		DONE:
-			for {
+		err := m.Start(cx)
+		if err == nil {
+			done := m.Done()
+			go func() {
 				select {
-				case <-cx.Done():
-					break DONE
-				case <-ticker.C:
-					chState <- ProcessStatus{ProcStatusStarted, "已启动"}
+				case <-done:
+					return
+				case <-time.After(5 * time.Second):
 				}
-			}
-		}()
-		go func() {
-			<-sysExitFlag
-			m.Kill()
-		}()
-		err := m.Run()
-		cancel()
-
-		if m.runFlag {
-			if err != nil {
-				if mode == 1 {
-					retry--
+				if m.IsRunning() {
+					chState <- ProcessStatus{ProcStatusStarted, "已启动"}
 				}
-				chState <- ProcessStatus{ProcStatusError, err.Error()}
-				fmt.Printf("process exited:%v and will be restarted in 3 seconds\n", err)
-			} else {
-				if mode == 1 {
-					fmt.Printf("process exited without error\n")
-					chState <- ProcessStatus{ProcStatusStopped, "done"}
-					m.runFlag = false
+				ticker := time.NewTicker(time.Second * 10)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						chState <- ProcessStatus{ProcStatusStarted, "已启动"}
+					}
 				}
-				fmt.Printf("process exited without error and will be restarted in 3 seconds\n")
-				chState <- ProcessStatus{ProcStatusStopped, ""}
+			}()
+			err = m.Wait()
+		}
 
+		if cx.Err() != nil {
+			break
+		}
+		if err != nil {
+			if mode == 1 {
+				retry--
+			}
+			chState <- ProcessStatus{ProcStatusError, err.Error()}
+			fmt.Printf("process exited:%v and will be restarted in 5 seconds\n", err)
+		} else {
+			if mode == 1 {
+				fmt.Printf("process exited without error\n")
+				chState <- ProcessStatus{ProcStatusStopped, "done"}
+				break
 			}
-			time.Sleep(time.Second * 5)
+			fmt.Printf("process exited without error and will be restarted in 5 seconds\n")
+			chState <- ProcessStatus{ProcStatusStopped, ""}
+		}
+		select {
+		case <-cx.Done():
+		case <-time.After(time.Second * 5):
 		}
 	}
-	m.cl()
+	cl()
 	chState <- ProcessStatus{ProcStatusStopped, "finished"}
 }
-func (m *Exec) readPipe(stream io.ReadCloser, isErr bool) {
-	reader := bufio.NewReader(stream)
+func (m *Exec) readPipe(stream io.ReadCloser, isErr bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	reader := bufio.NewReader(NewCharsetReader(stream, m.charset))
 	for {
-		buf, err2 := reader.ReadBytes('\n')
-		if err2 != nil || io.EOF == err2 {
-			break
+		line, err2 := reader.ReadString('\n')
+		if len(line) > 0 {
+			if m.cb != nil {
+				m.cb(isErr, line)
+			} else {
+				fmt.Print(line)
+			}
 		}
-		line := ConvertByte2String(buf, UTF8)
-		if m.cb != nil {
-			m.cb(isErr, line)
-		} else {
-			fmt.Print(line)
+		if err2 != nil {
+			break
 		}
 	}
 }
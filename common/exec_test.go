@@ -0,0 +1,232 @@
+//go:build !windows
+
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newShellExec(script string) *Exec {
+	ex := NewExec("", "/bin/sh")
+	ex.Args = []string{"-c", script}
+	ex.SetCallback(func(isErr bool, line string) {})
+	return ex
+}
+
+// startAndWaitFor starts ex and returns once it printed line.
+func startAndWaitFor(t *testing.T, ex *Exec, line string) {
+	t.Helper()
+	ready := make(chan struct{})
+	var once sync.Once
+	ex.SetCallback(func(isErr bool, s string) {
+		if strings.TrimSpace(s) == line {
+			once.Do(func() { close(ready) })
+		}
+	})
+	if err := ex.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("process did not print %q", line)
+	}
+}
+
+func TestExecWaitBeforeStart(t *testing.T) {
+	if err := newShellExec("true").Wait(); !errors.Is(err, ErrExecNotStarted) {
+		t.Fatalf("Wait = %v, want ErrExecNotStarted", err)
+	}
+}
+
+func TestExecRunExitCode(t *testing.T) {
+	ex := newShellExec("exit 3")
+	if err := ex.Run(); err == nil {
+		t.Fatal("Run of a failing process returned nil")
+	}
+	if st := ex.ExitStatus(); st.Code != 3 || st.Signal != "" {
+		t.Fatalf("ExitStatus = %+v, want code 3", st)
+	}
+	if s := ex.State(); s != ExecStateExited {
+		t.Fatalf("State = %v, want exited", s)
+	}
+}
+
+func TestExecStartTwice(t *testing.T) {
+	ex := newShellExec("sleep 30")
+	if err := ex.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ex.Stop(time.Second)
+	if err := ex.Start(context.Background()); !errors.Is(err, ErrExecRunning) {
+		t.Fatalf("second Start = %v, want ErrExecRunning", err)
+	}
+}
+
+func TestExecStop(t *testing.T) {
+	ex := newShellExec("echo ready; exec sleep 30")
+	startAndWaitFor(t, ex, "ready")
+	if err := ex.Stop(5 * time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if st := ex.ExitStatus(); st.Signal != "terminated" {
+		t.Fatalf("ExitStatus = %+v, want terminated", st)
+	}
+	if s := ex.State(); s != ExecStateExited {
+		t.Fatalf("State = %v, want exited", s)
+	}
+	<-ex.Done()
+}
+
+func TestExecStopEscalatesToKill(t *testing.T) {
+	ex := newShellExec(`trap "" TERM; echo ready; sleep 30`)
+	startAndWaitFor(t, ex, "ready")
+	start := time.Now()
+	if err := ex.Stop(300 * time.Millisecond); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("Stop returned after %v, before the TERM timeout", d)
+	}
+	if st := ex.ExitStatus(); st.Signal != "killed" {
+		t.Fatalf("ExitStatus = %+v, want killed", st)
+	}
+}
+
+func TestExecStopWhenExited(t *testing.T) {
+	ex := newShellExec("true")
+	if err := ex.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := ex.Stop(time.Second); err != nil {
+		t.Fatalf("Stop after exit: %v", err)
+	}
+	if s := ex.State(); s != ExecStateExited {
+		t.Fatalf("State = %v, want exited", s)
+	}
+}
+
+func TestExecRestartAfterExit(t *testing.T) {
+	ex := newShellExec("exit 0")
+	for i := 0; i < 3; i++ {
+		if err := ex.Run(); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+	ex.Args = []string{"-c", "echo ready; exec sleep 30"}
+	startAndWaitFor(t, ex, "ready")
+	if err := ex.Stop(5 * time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	ex.Args = []string{"-c", "exit 0"}
+	if err := ex.Run(); err != nil {
+		t.Fatalf("run after stop: %v", err)
+	}
+}
+
+// Stop may have seen the run as running just before it exited; its move to
+// Stopping must not undo Exited, or Start refuses to run it again.
+func TestExecStaleStopAfterExit(t *testing.T) {
+	ex := newShellExec("exit 0")
+	if err := ex.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if ex.setState(ExecStateStopping) {
+		t.Fatal("setState moved an exited run to stopping")
+	}
+	if s := ex.State(); s != ExecStateExited {
+		t.Fatalf("State = %v, want exited", s)
+	}
+	if err := ex.Run(); err != nil {
+		t.Fatalf("run after stale stop: %v", err)
+	}
+}
+
+// A process exiting while it is being stopped must still end as exited,
+// so it can be started again.
+func TestExecStopRacesExit(t *testing.T) {
+	ex := newShellExec("exit 0")
+	for i := 0; i < 100; i++ {
+		if err := ex.Start(context.Background()); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = ex.Stop(time.Second)
+			}()
+		}
+		wg.Wait()
+		_ = ex.Wait()
+		if s := ex.State(); s != ExecStateExited {
+			t.Fatalf("iteration %d: State = %v, want exited", i, s)
+		}
+	}
+}
+
+func TestExecStatesOnlyMoveForward(t *testing.T) {
+	var mu sync.Mutex
+	var states []ExecState
+	ex := newShellExec("echo ready; exec sleep 30")
+	ex.SetStateObserver(func(state ExecState, status ExitStatus) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	})
+	startAndWaitFor(t, ex, "ready")
+	if err := ex.Stop(5 * time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []ExecState{ExecStateStarting, ExecStateRunning, ExecStateStopping, ExecStateExited}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+}
+
+func TestExecCancelContextStops(t *testing.T) {
+	ex := newShellExec("exec sleep 30")
+	cx, cancel := context.WithCancel(context.Background())
+	if err := ex.Start(cx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	cancel()
+	select {
+	case <-ex.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not stop the process")
+	}
+}
@@ -21,12 +21,10 @@
 package common
 
 import (
-	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"syscall"
-	"system-conf/common/log"
 )
 
 func CloseCurrentProcessGroup() error {
@@ -41,57 +39,22 @@ func CloseCurrentProcessGroup() error {
 	}
 	return nil
 }
-func (m *Exec) Kill() {
-	if m.Cmd != nil && m.Cmd.Process != nil {
-		killCmd := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(m.Cmd.Process.Pid))
-		go killCmd.Run()
-		//err := killCmd.Run()
-		//if err != nil {
-		//	log.Warnf("杀掉进程时出错: %v", err)
-		//}
-		//m.Cmd.Process.Kill()
-		//m.Cmd.Process.Release()
-	}
-}
-
-func (m *Exec) Run() error {
-
-	m.Cmd = exec.Command(m.ExecName, m.Args...)
 
-	if m.WorkDir != "" {
-		m.Cmd.Dir = m.WorkDir
-	}
-	m.Cmd.SysProcAttr = &syscall.SysProcAttr{
+func (m *Exec) newCmd() *exec.Cmd {
+	cmd := exec.Command(m.ExecName, m.Args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
 		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
 	}
+	return cmd
+}
 
-	stdout, _ := m.Cmd.StdoutPipe()
-	defer stdout.Close()
-	stderr, _ := m.Cmd.StderrPipe()
-	defer stderr.Close()
-	if m.pipeCb == nil {
-		go m.readPipe(stdout, false)
-		go m.readPipe(stderr, true)
-	} else {
-		m.pipeCb("stdout", stdout)
-		m.pipeCb("stderr", stderr)
-	}
-
-	err := m.Cmd.Start()
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	log.Printf("proc started: %s %v", m.Cmd.Path, m.Cmd.Args)
-
-	m.isRunning = true
-	defer func() {
-		m.isRunning = false
-	}()
+func termProcessTree(pid int) error {
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(pid)).Run()
+}
+func killProcessTree(pid int) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
 
-	err = m.Cmd.Wait()
-	if err != nil {
-		err = fmt.Errorf("failed to start proc. err: %v", err)
-	}
-	return err
+func exitSignal(ps *os.ProcessState) string {
+	return ""
 }
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	FuncReadCoils              = 0x01
+	FuncReadDiscreteInputs     = 0x02
+	FuncReadHoldingRegisters   = 0x03
+	FuncReadInputRegisters     = 0x04
+	FuncWriteSingleCoil        = 0x05
+	FuncWriteSingleRegister    = 0x06
+	FuncWriteMultipleCoils     = 0x0F
+	FuncWriteMultipleRegisters = 0x10
+
+	ExceptionIllegalFunction    = 0x01
+	ExceptionIllegalAddress     = 0x02
+	ExceptionIllegalValue       = 0x03
+	ExceptionServerDeviceFailed = 0x04
+
+	// MaxADUSize is the largest RTU frame: unit + 253 bytes PDU + CRC
+	MaxADUSize = 256
+
+	maxReadBits      = 2000
+	maxReadRegisters = 125
+	maxWriteBits     = 1968
+	maxWriteRegs     = 123
+)
+
+var (
+	ErrCRC       = errors.New("modbus: crc mismatch")
+	ErrShortADU  = errors.New("modbus: frame too short")
+	ErrTimeout   = errors.New("modbus: response timeout")
+	ErrMismatch  = errors.New("modbus: response does not match request")
+	ErrBadLength = errors.New("modbus: bad length")
+)
+
+// Exception is a Modbus exception response.
+type Exception struct {
+	Function byte `json:"function"`
+	Code     byte `json:"code"`
+}
+
+func (e *Exception) Error() string {
+	var name string
+	switch e.Code {
+	case ExceptionIllegalFunction:
+		name = "illegal function"
+	case ExceptionIllegalAddress:
+		name = "illegal data address"
+	case ExceptionIllegalValue:
+		name = "illegal data value"
+	case ExceptionServerDeviceFailed:
+		name = "server device failure"
+	default:
+		name = "unknown exception"
+	}
+	return fmt.Sprintf("modbus: function 0x%02X: %s (0x%02X)", e.Function, name, e.Code)
+}
+
+// CRC16 computes the Modbus RTU checksum (poly 0xA001, init 0xFFFF).
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// EncodeRTU builds an RTU frame: unit, pdu and the CRC in little endian.
+func EncodeRTU(unit byte, pdu []byte) []byte {
+	adu := make([]byte, 0, len(pdu)+3)
+	adu = append(adu, unit)
+	adu = append(adu, pdu...)
+	return binary.LittleEndian.AppendUint16(adu, CRC16(adu))
+}
+
+// DecodeRTU validates the CRC of a frame and splits it into unit and pdu.
+func DecodeRTU(adu []byte) (unit byte, pdu []byte, err error) {
+	if len(adu) < 4 {
+		return 0, nil, ErrShortADU
+	}
+	n := len(adu) - 2
+	if CRC16(adu[:n]) != binary.LittleEndian.Uint16(adu[n:]) {
+		return 0, nil, ErrCRC
+	}
+	return adu[0], adu[1:n], nil
+}
+
+// CharTime is the duration of one 11-bit character at the given baud rate.
+func CharTime(baud int) time.Duration {
+	if baud <= 0 {
+		baud = 9600
+	}
+	return time.Duration(11 * int64(time.Second) / int64(baud))
+}
+
+// FrameGap returns the 3.5 character silence that delimits RTU frames; the
+// spec fixes it at 1.75ms above 19200 baud.
+func FrameGap(baud int) time.Duration {
+	if baud > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return CharTime(baud) * 7 / 2
+}
+
+// MinIdleGap is the shortest silence taken as the end of a frame when
+// reading. OS read timeouts are coarse and USB adapters split frames
+// across reads, so the 3.5 character gap alone cuts frames apart.
+const MinIdleGap = 20 * time.Millisecond
+
+// IdleGap is FrameGap, but at least MinIdleGap.
+func IdleGap(baud int) time.Duration {
+	if gap := FrameGap(baud); gap > MinIdleGap {
+		return gap
+	}
+	return MinIdleGap
+}
+
+func packBits(values []bool) []byte {
+	buf := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			buf[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+	return buf
+}
+
+func unpackBits(buf []byte, qty int) []bool {
+	values := make([]bool, qty)
+	for i := range values {
+		values[i] = buf[i/8]&(1<<(uint(i)%8)) != 0
+	}
+	return values
+}
+
+func packRegisters(values []uint16) []byte {
+	buf := make([]byte, 0, len(values)*2)
+	for _, v := range values {
+		buf = binary.BigEndian.AppendUint16(buf, v)
+	}
+	return buf
+}
+
+func unpackRegisters(buf []byte) []uint16 {
+	values := make([]uint16, len(buf)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(buf[i*2:])
+	}
+	return values
+}
+
+// responseLength returns the expected RTU response length for the first
+// bytes of a frame, or 0 if more bytes are needed to tell.
+func responseLength(head []byte) int {
+	if len(head) < 2 {
+		return 0
+	}
+	fc := head[1]
+	if fc&0x80 != 0 {
+		return 5
+	}
+	switch fc {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if len(head) < 3 {
+			return 0
+		}
+		return 3 + int(head[2]) + 2
+	case FuncWriteSingleCoil, FuncWriteSingleRegister, FuncWriteMultipleCoils, FuncWriteMultipleRegisters:
+		return 8
+	}
+	return -1
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Table identifies one of the four Modbus data tables.
+type Table int
+
+const (
+	Coils Table = iota
+	DiscreteInputs
+	HoldingRegisters
+	InputRegisters
+)
+
+var tableNames = []string{"coils", "discrete", "holding", "input"}
+
+func (t Table) String() string {
+	if t >= 0 && int(t) < len(tableNames) {
+		return tableNames[t]
+	}
+	return fmt.Sprintf("table(%d)", int(t))
+}
+
+// IsBit reports whether the table holds single-bit values.
+func (t Table) IsBit() bool {
+	return t == Coils || t == DiscreteInputs
+}
+
+// ParseTable accepts the names returned by Table.String.
+func ParseTable(name string) (Table, error) {
+	for i, n := range tableNames {
+		if n == name {
+			return Table(i), nil
+		}
+	}
+	return 0, fmt.Errorf("modbus: unknown table %q", name)
+}
+
+var ErrIllegalAddress = errors.New("modbus: illegal data address")
+
+// RegisterChange is passed to observers after a table was written.
+type RegisterChange struct {
+	Table   Table
+	Address uint16
+	Values  []uint16
+	// Remote is true when the write came from a Modbus master.
+	Remote bool
+}
+
+// RegisterMap is an in-memory data model shared by the RTU slave and the
+// rest of the service. Bit tables store 0 or 1 per address.
+type RegisterMap struct {
+	mu        sync.RWMutex
+	tables    [4][]uint16
+	observers []func(RegisterChange)
+}
+
+func NewRegisterMap(coils, discrete, holding, input int) *RegisterMap {
+	m := &RegisterMap{}
+	for i, n := range []int{coils, discrete, holding, input} {
+		if n < 0 {
+			n = 0
+		} else if n > 0x10000 {
+			n = 0x10000
+		}
+		m.tables[i] = make([]uint16, n)
+	}
+	return m
+}
+
+// Size returns the number of addresses in a table.
+func (m *RegisterMap) Size(t Table) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if t < 0 || int(t) >= len(m.tables) {
+		return 0
+	}
+	return len(m.tables[t])
+}
+
+// Observe registers fn to be called after every write to the map.
+func (m *RegisterMap) Observe(fn func(RegisterChange)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+func (m *RegisterMap) table(t Table, addr uint16, qty int) ([]uint16, error) {
+	if t < 0 || int(t) >= len(m.tables) {
+		return nil, ErrIllegalAddress
+	}
+	tab := m.tables[t]
+	if qty <= 0 || int(addr)+qty > len(tab) {
+		return nil, ErrIllegalAddress
+	}
+	return tab[int(addr) : int(addr)+qty], nil
+}
+
+// Get returns a copy of qty values starting at addr.
+func (m *RegisterMap) Get(t Table, addr uint16, qty int) ([]uint16, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	src, err := m.table(t, addr, qty)
+	if err != nil {
+		return nil, err
+	}
+	return append([]uint16(nil), src...), nil
+}
+
+// Set writes values starting at addr; any non-zero value sets a bit.
+func (m *RegisterMap) Set(t Table, addr uint16, values ...uint16) error {
+	return m.set(t, addr, values, false)
+}
+
+func (m *RegisterMap) set(t Table, addr uint16, values []uint16, remote bool) error {
+	m.mu.Lock()
+	dst, err := m.table(t, addr, len(values))
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	for i, v := range values {
+		if t.IsBit() && v != 0 {
+			v = 1
+		}
+		dst[i] = v
+	}
+	observers := m.observers
+	change := RegisterChange{Table: t, Address: addr, Values: append([]uint16(nil), dst...), Remote: remote}
+	m.mu.Unlock()
+	for _, fn := range observers {
+		fn(change)
+	}
+	return nil
+}
+
+func (m *RegisterMap) GetBits(t Table, addr uint16, qty int) ([]bool, error) {
+	values, err := m.Get(t, addr, qty)
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]bool, len(values))
+	for i, v := range values {
+		bits[i] = v != 0
+	}
+	return bits, nil
+}
+
+func (m *RegisterMap) SetBits(t Table, addr uint16, bits ...bool) error {
+	values := make([]uint16, len(bits))
+	for i, b := range bits {
+		if b {
+			values[i] = 1
+		}
+	}
+	return m.Set(t, addr, values...)
+}
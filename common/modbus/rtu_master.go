@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.bug.st/serial"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/log"
+	"time"
+)
+
+const (
+	DefaultTimeout = time.Second
+	DefaultRetries = 2
+)
+
+type retriesKey struct{}
+
+// WithRetries overrides RTUMaster.Retries for requests issued with cx.
+func WithRetries(cx context.Context, retries int) context.Context {
+	return context.WithValue(cx, retriesKey{}, retries)
+}
+
+// RTUMaster issues Modbus RTU requests over a SerialCtx. Requests are
+// serialized, separated by the 3.5 character silence and retried on
+// timeout or corrupted replies; exception responses are not retried.
+type RTUMaster struct {
+	Serial  *common.SerialCtx
+	Timeout time.Duration
+	Retries int
+	Debug   bool
+
+	lastIdle time.Time
+}
+
+var masters = sync.Map{}
+
+// GetRTUMaster returns the master bound to a SerialCtx, creating it once.
+func GetRTUMaster(ctx *common.SerialCtx) *RTUMaster {
+	v, _ := masters.LoadOrStore(ctx, NewRTUMaster(ctx))
+	return v.(*RTUMaster)
+}
+
+func NewRTUMaster(ctx *common.SerialCtx) *RTUMaster {
+	return &RTUMaster{Serial: ctx, Timeout: DefaultTimeout, Retries: DefaultRetries}
+}
+
+func (m *RTUMaster) baud() int {
+	return m.Serial.Mode().BaudRate
+}
+
+// Do sends a request PDU to unit and returns the response PDU. Unit 0 is a
+// broadcast: nothing is read back and a nil PDU is returned.
+func (m *RTUMaster) Do(cx context.Context, unit byte, pdu []byte) (resp []byte, err error) {
+	if len(pdu) == 0 || len(pdu) > MaxADUSize-3 {
+		return nil, ErrBadLength
+	}
+	retries := m.Retries
+	if v, ok := cx.Value(retriesKey{}).(int); ok {
+		retries = v
+	}
+	// share the port's queue with other request/response users
+	release, err := m.Serial.Acquire(cx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = cx.Err(); err != nil {
+			return
+		}
+		resp, err = m.transact(cx, unit, pdu)
+		var ex *Exception
+		if err == nil || errors.As(err, &ex) {
+			return
+		}
+		if m.Debug {
+			log.Warnf("modbus request to unit %d failed (attempt %d): %v", unit, attempt+1, err)
+		}
+	}
+	return
+}
+
+func (m *RTUMaster) transact(cx context.Context, unit byte, pdu []byte) ([]byte, error) {
+	port, err := m.Serial.OpenPort()
+	if err != nil {
+		return nil, err
+	}
+	gap := FrameGap(m.baud())
+	if wait := gap - time.Since(m.lastIdle); wait > 0 {
+		time.Sleep(wait)
+	}
+	_ = port.ResetInputBuffer()
+	adu := EncodeRTU(unit, pdu)
+	if _, err = port.Write(adu); err != nil {
+		m.Serial.ClosePort()
+		return nil, err
+	}
+	// the request itself occupies the line for len(adu) characters
+	sent := time.Now().Add(CharTime(m.baud()) * time.Duration(len(adu)))
+	defer func() { m.lastIdle = time.Now() }()
+	if unit == 0 {
+		return nil, nil
+	}
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	deadline := sent.Add(timeout)
+	if d, ok := cx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	frame, err := m.readFrame(port, deadline, gap)
+	if err != nil {
+		return nil, err
+	}
+	if m.Debug {
+		log.Printf("modbus tx:% X rx:% X", adu, frame)
+	}
+	u, resp, err := DecodeRTU(frame)
+	if err != nil {
+		return nil, err
+	}
+	if u != unit || resp[0]&0x7F != pdu[0] {
+		return nil, ErrMismatch
+	}
+	if resp[0]&0x80 != 0 {
+		// a valid CRC over a bare function code still leaves no exception code
+		if len(resp) < 2 {
+			return nil, ErrShortADU
+		}
+		return nil, &Exception{Function: pdu[0], Code: resp[1]}
+	}
+	return resp, nil
+}
+
+// readFrame reads until the expected length is reached; a silence longer
+// than gap after some bytes also ends the frame.
+func (m *RTUMaster) readFrame(port serial.Port, deadline time.Time, gap time.Duration) ([]byte, error) {
+	frame := make([]byte, 0, MaxADUSize)
+	buf := make([]byte, MaxADUSize)
+	idle := gap
+	if idle < MinIdleGap {
+		idle = MinIdleGap
+	}
+	for {
+		wait := time.Until(deadline)
+		if len(frame) > 0 && wait > idle {
+			wait = idle
+		}
+		if wait <= 0 {
+			if len(frame) == 0 {
+				return nil, ErrTimeout
+			}
+			return frame, nil
+		}
+		if err := port.SetReadTimeout(wait); err != nil {
+			return nil, err
+		}
+		n, err := port.Read(buf)
+		if err != nil {
+			m.Serial.ClosePort()
+			return nil, err
+		}
+		if n == 0 {
+			if len(frame) > 0 {
+				return frame, nil
+			}
+			continue
+		}
+		frame = append(frame, buf[:n]...)
+		if want := responseLength(frame); want > 0 && len(frame) >= want {
+			return frame[:want], nil
+		} else if want < 0 || len(frame) >= MaxADUSize {
+			return frame, nil
+		}
+	}
+}
+
+func readRequest(fc byte, addr, qty uint16) []byte {
+	pdu := []byte{fc}
+	pdu = binary.BigEndian.AppendUint16(pdu, addr)
+	return binary.BigEndian.AppendUint16(pdu, qty)
+}
+
+func (m *RTUMaster) readBits(cx context.Context, fc, unit byte, addr, qty uint16) ([]bool, error) {
+	if qty == 0 || qty > maxReadBits {
+		return nil, ErrBadLength
+	}
+	resp, err := m.Do(cx, unit, readRequest(fc, addr, qty))
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != (int(qty)+7)/8 || len(resp) != 2+int(resp[1]) {
+		return nil, ErrBadLength
+	}
+	return unpackBits(resp[2:], int(qty)), nil
+}
+
+func (m *RTUMaster) readRegisters(cx context.Context, fc, unit byte, addr, qty uint16) ([]uint16, error) {
+	if qty == 0 || qty > maxReadRegisters {
+		return nil, ErrBadLength
+	}
+	resp, err := m.Do(cx, unit, readRequest(fc, addr, qty))
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != int(qty)*2 || len(resp) != 2+int(resp[1]) {
+		return nil, ErrBadLength
+	}
+	return unpackRegisters(resp[2:]), nil
+}
+
+func (m *RTUMaster) ReadCoils(cx context.Context, unit byte, addr, qty uint16) ([]bool, error) {
+	return m.readBits(cx, FuncReadCoils, unit, addr, qty)
+}
+
+func (m *RTUMaster) ReadDiscreteInputs(cx context.Context, unit byte, addr, qty uint16) ([]bool, error) {
+	return m.readBits(cx, FuncReadDiscreteInputs, unit, addr, qty)
+}
+
+func (m *RTUMaster) ReadHoldingRegisters(cx context.Context, unit byte, addr, qty uint16) ([]uint16, error) {
+	return m.readRegisters(cx, FuncReadHoldingRegisters, unit, addr, qty)
+}
+
+func (m *RTUMaster) ReadInputRegisters(cx context.Context, unit byte, addr, qty uint16) ([]uint16, error) {
+	return m.readRegisters(cx, FuncReadInputRegisters, unit, addr, qty)
+}
+
+// checkEcho verifies the echo returned by single/multiple write requests.
+func checkEcho(resp, req []byte) error {
+	if resp != nil && (len(resp) != 5 || string(resp) != string(req[:5])) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func (m *RTUMaster) WriteSingleCoil(cx context.Context, unit byte, addr uint16, value bool) error {
+	v := uint16(0x0000)
+	if value {
+		v = 0xFF00
+	}
+	req := readRequest(FuncWriteSingleCoil, addr, v)
+	resp, err := m.Do(cx, unit, req)
+	if err != nil {
+		return err
+	}
+	return checkEcho(resp, req)
+}
+
+func (m *RTUMaster) WriteSingleRegister(cx context.Context, unit byte, addr, value uint16) error {
+	req := readRequest(FuncWriteSingleRegister, addr, value)
+	resp, err := m.Do(cx, unit, req)
+	if err != nil {
+		return err
+	}
+	return checkEcho(resp, req)
+}
+
+func (m *RTUMaster) WriteMultipleCoils(cx context.Context, unit byte, addr uint16, values []bool) error {
+	if len(values) == 0 || len(values) > maxWriteBits {
+		return ErrBadLength
+	}
+	data := packBits(values)
+	req := readRequest(FuncWriteMultipleCoils, addr, uint16(len(values)))
+	req = append(append(req, byte(len(data))), data...)
+	resp, err := m.Do(cx, unit, req)
+	if err != nil {
+		return err
+	}
+	return checkEcho(resp, req)
+}
+
+func (m *RTUMaster) WriteMultipleRegisters(cx context.Context, unit byte, addr uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > maxWriteRegs {
+		return ErrBadLength
+	}
+	data := packRegisters(values)
+	req := readRequest(FuncWriteMultipleRegisters, addr, uint16(len(values)))
+	req = append(append(req, byte(len(data))), data...)
+	resp, err := m.Do(cx, unit, req)
+	if err != nil {
+		return err
+	}
+	return checkEcho(resp, req)
+}
+
+func (m *RTUMaster) String() string {
+	return fmt.Sprintf("modbus rtu master on %s", m.Serial.Params.Name)
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/log"
+	"time"
+)
+
+// RTUSlave answers Modbus RTU requests addressed to UnitId from Registers.
+// Frames are assembled from the serial stream and delimited by a silence
+// of IdleGap; frames with a bad CRC or for other units are dropped
+// and broadcasts (unit 0) are executed without a reply.
+type RTUSlave struct {
+	Serial    *common.SerialCtx
+	UnitId    byte
+	Registers *RegisterMap
+	Debug     bool
+
+	mu       sync.Mutex
+	buf      []byte
+	lastRecv time.Time
+	stats    SlaveStats
+}
+
+// SlaveStats counts the frames seen by an RTUSlave.
+type SlaveStats struct {
+	Requests   uint64 `json:"requests"`
+	Exceptions uint64 `json:"exceptions"`
+	CRCErrors  uint64 `json:"crcErrors"`
+	Ignored    uint64 `json:"ignored"`
+}
+
+var slaves = sync.Map{}
+
+// GetRTUSlave returns the slave running on a SerialCtx, if any. Slaves whose
+// port was stopped elsewhere, e.g. by disabling it, are forgotten.
+func GetRTUSlave(ctx *common.SerialCtx) *RTUSlave {
+	if v, ok := slaves.Load(ctx); ok {
+		if ctx.IsRunning() {
+			return v.(*RTUSlave)
+		}
+		slaves.CompareAndDelete(ctx, v)
+	}
+	return nil
+}
+
+func NewRTUSlave(ctx *common.SerialCtx, unit byte, registers *RegisterMap) *RTUSlave {
+	return &RTUSlave{Serial: ctx, UnitId: unit, Registers: registers}
+}
+
+var ErrSlaveRunning = errors.New("modbus: a slave is already running on this port")
+
+// Start runs the slave on its serial port until Stop is called.
+func (s *RTUSlave) Start() error {
+	if s.UnitId == 0 || s.UnitId > 247 {
+		return errors.New("modbus: unit id must be in 1..247")
+	}
+	GetRTUSlave(s.Serial)
+	if _, loaded := slaves.LoadOrStore(s.Serial, s); loaded {
+		return ErrSlaveRunning
+	}
+	if s.Serial.IsRunning() {
+		slaves.Delete(s.Serial)
+		return common.ErrSerialBusy
+	}
+	s.Serial.ClosePort()
+	s.Serial.IdleTimeout = IdleGap(s.Serial.Mode().BaudRate)
+	s.Serial.RunAsSlave(s.onData)
+	log.Printf("modbus slave %d started on %s", s.UnitId, s.Serial.Params.Name)
+	return nil
+}
+
+func (s *RTUSlave) Stop() {
+	s.Serial.Stop()
+	s.Serial.IdleTimeout = 0
+	slaves.CompareAndDelete(s.Serial, s)
+	log.Printf("modbus slave %d stopped on %s", s.UnitId, s.Serial.Params.Name)
+}
+
+func (s *RTUSlave) Stats() SlaveStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// onData is the RunAsSlave callback. An empty chunk means the read timed
+// out after a frame gap, so any pending bytes form a complete frame.
+func (s *RTUSlave) onData(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	gap := IdleGap(s.Serial.Mode().BaudRate)
+	if len(data) == 0 {
+		if len(s.buf) == 0 {
+			return nil
+		}
+		return s.frame(len(s.buf))
+	}
+	if len(s.buf) > 0 && now.Sub(s.lastRecv) >= gap {
+		// the previous frame ended without reaching its expected length
+		reply := s.frame(len(s.buf))
+		if len(reply) > 0 {
+			s.buf = append(s.buf[:0], data...)
+			s.lastRecv = now
+			return reply
+		}
+	}
+	s.lastRecv = now
+	s.buf = append(s.buf, data...)
+	if len(s.buf) > MaxADUSize {
+		s.stats.Ignored++
+		s.buf = s.buf[:0]
+		return nil
+	}
+	if n := requestLength(s.buf); n > 0 && len(s.buf) >= n {
+		return s.frame(n)
+	}
+	return nil
+}
+
+// frame consumes n bytes of the buffer as one ADU and returns the reply.
+func (s *RTUSlave) frame(n int) []byte {
+	adu := s.buf[:n]
+	defer func() { s.buf = append(s.buf[:0], s.buf[n:]...) }()
+	unit, pdu, err := DecodeRTU(adu)
+	if err != nil {
+		s.stats.CRCErrors++
+		if s.Debug {
+			log.Warnf("modbus slave: drop % X: %v", adu, err)
+		}
+		return nil
+	}
+	if unit != s.UnitId && unit != 0 {
+		s.stats.Ignored++
+		return nil
+	}
+	s.stats.Requests++
+	resp := s.Handle(pdu)
+	if resp[0]&0x80 != 0 {
+		s.stats.Exceptions++
+	}
+	if s.Debug {
+		log.Printf("modbus slave: req % X resp % X", adu, resp)
+	}
+	if unit == 0 {
+		return nil
+	}
+	return EncodeRTU(unit, resp)
+}
+
+// requestLength returns the expected RTU request length for the first bytes
+// of a frame, 0 if more bytes are needed to tell, or -1 for function codes
+// whose length is only known from the frame gap.
+func requestLength(head []byte) int {
+	if len(head) < 2 {
+		return 0
+	}
+	switch head[1] {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters,
+		FuncWriteSingleCoil, FuncWriteSingleRegister:
+		return 8
+	case FuncWriteMultipleCoils, FuncWriteMultipleRegisters:
+		if len(head) < 7 {
+			return 0
+		}
+		return 9 + int(head[6])
+	}
+	return -1
+}
+
+func exception(fc, code byte) []byte {
+	return []byte{fc | 0x80, code}
+}
+
+// Handle executes a request PDU against the register map and returns the
+// response PDU, which is an exception response on failure.
+func (s *RTUSlave) Handle(pdu []byte) []byte {
+	fc := pdu[0]
+	if requestLength([]byte{0, fc}) < 0 {
+		return exception(fc, ExceptionIllegalFunction)
+	}
+	if len(pdu) < 5 {
+		return exception(fc, ExceptionIllegalValue)
+	}
+	addr := binary.BigEndian.Uint16(pdu[1:])
+	arg := binary.BigEndian.Uint16(pdu[3:])
+	regs := s.Registers
+	switch fc {
+	case FuncReadCoils, FuncReadDiscreteInputs:
+		if arg == 0 || arg > maxReadBits {
+			return exception(fc, ExceptionIllegalValue)
+		}
+		t := Coils
+		if fc == FuncReadDiscreteInputs {
+			t = DiscreteInputs
+		}
+		bits, err := regs.GetBits(t, addr, int(arg))
+		if err != nil {
+			return exception(fc, ExceptionIllegalAddress)
+		}
+		data := packBits(bits)
+		return append([]byte{fc, byte(len(data))}, data...)
+	case FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if arg == 0 || arg > maxReadRegisters {
+			return exception(fc, ExceptionIllegalValue)
+		}
+		t := HoldingRegisters
+		if fc == FuncReadInputRegisters {
+			t = InputRegisters
+		}
+		values, err := regs.Get(t, addr, int(arg))
+		if err != nil {
+			return exception(fc, ExceptionIllegalAddress)
+		}
+		data := packRegisters(values)
+		return append([]byte{fc, byte(len(data))}, data...)
+	case FuncWriteSingleCoil:
+		if arg != 0xFF00 && arg != 0x0000 {
+			return exception(fc, ExceptionIllegalValue)
+		}
+		if regs.set(Coils, addr, []uint16{arg >> 15}, true) != nil {
+			return exception(fc, ExceptionIllegalAddress)
+		}
+		return pdu[:5]
+	case FuncWriteSingleRegister:
+		if regs.set(HoldingRegisters, addr, []uint16{arg}, true) != nil {
+			return exception(fc, ExceptionIllegalAddress)
+		}
+		return pdu[:5]
+	case FuncWriteMultipleCoils, FuncWriteMultipleRegisters:
+		if len(pdu) < 6 || len(pdu) != 6+int(pdu[5]) {
+			return exception(fc, ExceptionIllegalValue)
+		}
+		var values []uint16
+		t := HoldingRegisters
+		if fc == FuncWriteMultipleCoils {
+			if arg == 0 || arg > maxWriteBits || int(pdu[5]) != (int(arg)+7)/8 {
+				return exception(fc, ExceptionIllegalValue)
+			}
+			t = Coils
+			for i, b := range unpackBits(pdu[6:], int(arg)) {
+				values = append(values, 0)
+				if b {
+					values[i] = 1
+				}
+			}
+		} else {
+			if arg == 0 || arg > maxWriteRegs || int(pdu[5]) != int(arg)*2 {
+				return exception(fc, ExceptionIllegalValue)
+			}
+			values = unpackRegisters(pdu[6:])
+		}
+		if regs.set(t, addr, values, true) != nil {
+			return exception(fc, ExceptionIllegalAddress)
+		}
+		return pdu[:5]
+	}
+	return exception(fc, ExceptionIllegalFunction)
+}
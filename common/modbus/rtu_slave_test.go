@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package modbus
+
+import (
+	"bytes"
+	"go.bug.st/serial"
+	"system-conf/common"
+	"testing"
+	"time"
+)
+
+func newTestSlave(t *testing.T, baud int) *RTUSlave {
+	t.Helper()
+	regs := NewRegisterMap(0, 0, 4, 0)
+	if err := regs.Set(HoldingRegisters, 1, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	ctx := common.NewSerialCtx(&common.SerialParams{Name: "test", Mode: serial.Mode{BaudRate: baud}})
+	return NewRTUSlave(ctx, 1, regs)
+}
+
+// A USB adapter may hand one request over in several reads with a pause
+// longer than the 3.5 character gap; the slave must still answer it.
+func TestRTUSlaveSplitRequest(t *testing.T) {
+	s := newTestSlave(t, 9600)
+	req := EncodeRTU(1, []byte{FuncReadHoldingRegisters, 0, 1, 0, 1})
+	want := EncodeRTU(1, []byte{FuncReadHoldingRegisters, 2, 0x12, 0x34})
+
+	if reply := s.onData(req[:3]); reply != nil {
+		t.Fatalf("reply % X to half a request", reply)
+	}
+	// well over FrameGap(9600), about 4ms, but under the idle gap
+	time.Sleep(2 * FrameGap(9600))
+	if reply := s.onData(req[3:]); !bytes.Equal(reply, want) {
+		t.Fatalf("reply % X, want % X", reply, want)
+	}
+	if st := s.Stats(); st.Requests != 1 || st.CRCErrors != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+
+	// a request that ends early is completed by the read timeout
+	s.onData([]byte{1, 0x99, 0, 0})
+	if reply := s.onData(nil); reply != nil {
+		t.Fatalf("reply % X to a bad frame", reply)
+	}
+	if st := s.Stats(); st.CRCErrors != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestIdleGap(t *testing.T) {
+	for _, baud := range []int{1200, 9600, 115200} {
+		if gap := IdleGap(baud); gap < MinIdleGap || gap < FrameGap(baud) {
+			t.Errorf("IdleGap(%d) = %v", baud, gap)
+		}
+	}
+}
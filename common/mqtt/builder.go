@@ -0,0 +1,258 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"system-conf/common/log"
+	"time"
+)
+
+// DefaultConnectRetryInterval is used when Options.RetryInterval is unset.
+const DefaultConnectRetryInterval = 20 * time.Second
+
+// Builder creates sessions; the New*Session constructors are presets of it.
+// Options.StorePath selects the store: none if empty, "@mem" for memory,
+// else a file store directory.
+type Builder struct {
+	Options *Options
+	// ProtocolVersion is 3 (MQTT 3.1) or 4 (MQTT 3.1.1); 0 tries 4, then 3.
+	// The client does not implement MQTT 5.
+	ProtocolVersion uint
+	// ClientId makes the client id if Options.ClientId is empty,
+	// RandomClientId by default
+	ClientId func() string
+	// ConnectRetry retries the first connection every Options.RetryInterval
+	// in the background, so Build does not wait for the broker
+	ConnectRetry bool
+	// ResumeSubs lets the client keep subscriptions made while it is not
+	// connected and send them once it is
+	ResumeSubs bool
+	// Resubscribe restores Session.Subscriptions whenever the client
+	// connects, after ResubscribeDelay on reconnects
+	Resubscribe      bool
+	ResubscribeDelay time.Duration
+	// Will is published by the broker if the connection drops without a
+	// disconnect; none if nil
+	Will *Will
+	// DefaultHandler receives messages no subscription claims,
+	// Session.DefaultHandler if nil
+	DefaultHandler   MessageHandler
+	OnConnect        func(s *Session)
+	OnConnectionLost func(s *Session, err error)
+}
+
+// Will is the last will and testament sent with every CONNECT.
+type Will struct {
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retained bool
+}
+
+func NewBuilder(opt *Options) *Builder {
+	return &Builder{Options: opt, Resubscribe: true}
+}
+
+func (b *Builder) SetProtocolVersion(version uint) *Builder {
+	b.ProtocolVersion = version
+	return b
+}
+func (b *Builder) SetClientId(fn func() string) *Builder {
+	b.ClientId = fn
+	return b
+}
+func (b *Builder) SetConnectRetry(retry bool) *Builder {
+	b.ConnectRetry = retry
+	return b
+}
+func (b *Builder) SetResumeSubs(resume bool) *Builder {
+	b.ResumeSubs = resume
+	return b
+}
+func (b *Builder) SetResubscribe(resubscribe bool, delay time.Duration) *Builder {
+	b.Resubscribe, b.ResubscribeDelay = resubscribe, delay
+	return b
+}
+func (b *Builder) SetWill(topic string, payload []byte, qos byte, retained bool) *Builder {
+	b.Will = &Will{Topic: topic, Payload: payload, Qos: qos, Retained: retained}
+	return b
+}
+func (b *Builder) SetDefaultHandler(handler MessageHandler) *Builder {
+	b.DefaultHandler = handler
+	return b
+}
+func (b *Builder) SetOnConnect(fn func(s *Session)) *Builder {
+	b.OnConnect = fn
+	return b
+}
+func (b *Builder) SetOnConnectionLost(fn func(s *Session, err error)) *Builder {
+	b.OnConnectionLost = fn
+	return b
+}
+
+// RandomClientId is <proc>_<pid>@<host>_<uuid>, unique per session.
+func RandomClientId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s_%d@%s_%s", log.ProcName, os.Getpid(), hostname, uuid.New().String())
+}
+
+// SnClientId is <proc>_<pid>@<host>#<sn>.
+func SnClientId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s_%d@%s#%s", log.ProcName, os.Getpid(), hostname, log.Sn)
+}
+
+// Build creates the session and connects it. Without ConnectRetry it
+// fails if the first connection does; either way the client reconnects on
+// its own afterwards. The session is closed by CloseSessions.
+func (b *Builder) Build() (session *Session, err error) {
+	cfg := *b
+	opt := cfg.Options
+	if opt == nil || opt.Addr == "" {
+		err = fmt.Errorf("invalid value of addr")
+		return
+	}
+	switch cfg.ProtocolVersion {
+	case 0, 3, 4:
+	default:
+		err = fmt.Errorf("unsupported mqtt protocol version %d", cfg.ProtocolVersion)
+		return
+	}
+	if w := cfg.Will; w != nil && (w.Topic == "" || w.Qos > 2) {
+		err = fmt.Errorf("invalid will: topic %q qos %d", w.Topic, w.Qos)
+		return
+	}
+	if opt.Un == "hjjn" && opt.Pw == "" {
+		opt.Pw = "public"
+	}
+	if opt.Un == "bymqtt" && opt.Pw == "" {
+		opt.Pw = "bymqtt.public"
+	}
+
+	s := &Session{Options: opt, Subscriptions: make(map[string]*SubscribeObject)}
+	opts := MQTT.NewClientOptions()
+	for _, addr := range strings.Split(opt.Addr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			opts.AddBroker(addr)
+		}
+	}
+	if len(opts.Servers) == 0 {
+		err = fmt.Errorf("addr list is empty")
+		return
+	}
+	s.setStore(opts)
+
+	if opt.ClientId != "" {
+		opts.SetClientID(opt.ClientId)
+	} else if cfg.ClientId != nil {
+		opts.SetClientID(cfg.ClientId())
+	} else {
+		opts.SetClientID(RandomClientId())
+	}
+	if opt.Un != "" {
+		opts.SetUsername(opt.Un)
+	}
+	if opt.Pw != "" {
+		opts.SetPassword(opt.Pw)
+	}
+	opts.SetCredentialsProvider(func() (un, pw string) {
+		return opt.Un, opt.Pw
+	})
+	if cfg.ProtocolVersion > 0 {
+		opts.SetProtocolVersion(cfg.ProtocolVersion)
+	}
+	if w := cfg.Will; w != nil {
+		opts.SetBinaryWill(w.Topic, w.Payload, w.Qos, w.Retained)
+	}
+	opts.SetConnectTimeout(opt.Timeout)
+	opts.SetAutoReconnect(true)
+	opts.SetResumeSubs(cfg.ResumeSubs)
+	if cfg.ConnectRetry {
+		opts.SetConnectRetry(true)
+		if opt.RetryInterval > 0 {
+			opts.SetConnectRetryInterval(opt.RetryInterval)
+		} else {
+			opts.SetConnectRetryInterval(DefaultConnectRetryInterval)
+		}
+	}
+
+	cid := opts.ClientID
+	opts.SetReconnectingHandler(func(client MQTT.Client, opts *MQTT.ClientOptions) {
+		log.Printf("try to reconnect mqtt. ")
+	})
+	// the client calls this on its own goroutine, so it may wait
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		times := atomic.AddInt64(&s.ReconnectCount, 1)
+		log.Warnf("mqtt client(%v) is connected(connect times:%d).", cid, times)
+		if cfg.Resubscribe && len(s.subscriptions()) > 0 {
+			if times > 1 && cfg.ResubscribeDelay > 0 {
+				log.Printf("resubscribe after %v", cfg.ResubscribeDelay)
+				time.Sleep(cfg.ResubscribeDelay)
+			}
+			s.Resubscribe()
+		}
+		if cfg.OnConnect != nil {
+			cfg.OnConnect(s)
+		}
+	})
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		log.Warnf("mqtt connection lost: %v", err)
+		if cfg.OnConnectionLost != nil {
+			cfg.OnConnectionLost(s, err)
+		}
+	})
+	if handler := cfg.DefaultHandler; handler != nil {
+		opts.SetDefaultPublishHandler(func(client MQTT.Client, msg MQTT.Message) {
+			handler(msg)
+		})
+	} else {
+		opts.SetDefaultPublishHandler(s.DefaultHandler)
+	}
+
+	s.Client = MQTT.NewClient(opts)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if cfg.ConnectRetry {
+		token := s.Client.Connect()
+		go func() {
+			token.Wait()
+			if e := token.Error(); e != nil {
+				log.Printf("failed to connect mqtt broker; err:%v", e)
+			}
+		}()
+	} else if err = s.connectV1(); err != nil {
+		return
+	}
+	SessionCache.Store(cid, s)
+	session = s
+	return
+}
+
+// setStore applies Options.StorePath, relative paths being below BasePath.
+func (m *Session) setStore(opts *MQTT.ClientOptions) {
+	opt := m.Options
+	switch opt.StorePath {
+	case "":
+	case "@mem":
+		m.MemStore = MQTT.NewMemoryStore()
+		opts.SetStore(m.MemStore)
+	default:
+		if !filepath.IsAbs(opt.StorePath) {
+			tmp := opt.StorePath
+			if opt.BasePath != "" {
+				tmp = filepath.Join(opt.BasePath, opt.StorePath)
+			}
+			if v, e := filepath.Abs(tmp); e == nil {
+				opt.StorePath = v
+			}
+		}
+		fmt.Printf("storage path: %s\n", opt.StorePath)
+		m.FileStroe = MQTT.NewFileStore(opt.StorePath)
+		opts.SetStore(m.FileStroe)
+	}
+}
@@ -0,0 +1,574 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connectInfo is what testBroker records of a CONNECT packet.
+type connectInfo struct {
+	ClientId     string
+	Protocol     string
+	Level        byte
+	CleanSession bool
+	KeepAlive    uint16
+	Username     string
+	Password     string
+	Will         *Will
+}
+
+// testBroker is just enough of an MQTT 3.1.1 broker for the session tests:
+// it accepts every CONNECT, routes publishes at qos 0, acknowledges qos 1
+// and sends the will of a connection that ends without DISCONNECT.
+type testBroker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu       sync.Mutex
+	conns    map[*brokerConn]bool
+	connects []connectInfo
+	subs     map[string][]string // client id -> filters, over all connections
+}
+
+type brokerConn struct {
+	net.Conn
+	wmu     sync.Mutex
+	info    connectInfo
+	filters []string
+}
+
+func startBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveBroker(t, ln)
+}
+
+func serveBroker(t *testing.T, ln net.Listener) *testBroker {
+	b := &testBroker{t: t, ln: ln, conns: map[*brokerConn]bool{}, subs: map[string][]string{}}
+	t.Cleanup(b.close)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&brokerConn{Conn: conn})
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) options(cid string) *Options {
+	return &Options{
+		Addr:          "tcp://" + b.ln.Addr().String(),
+		ClientId:      cid,
+		Timeout:       5 * time.Second,
+		RetryInterval: 100 * time.Millisecond,
+	}
+}
+
+func (b *testBroker) close() {
+	_ = b.ln.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		_ = c.Close()
+	}
+}
+
+// drop closes the connections of a client as a network failure would.
+func (b *testBroker) drop(cid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		if c.info.ClientId == cid {
+			_ = c.Close()
+		}
+	}
+}
+
+// connectsOf returns the CONNECT packets a client sent, oldest first.
+func (b *testBroker) connectsOf(cid string) (list []connectInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, info := range b.connects {
+		if info.ClientId == cid {
+			list = append(list, info)
+		}
+	}
+	return
+}
+
+// subscribes counts the SUBSCRIBE requests of a client for filter.
+func (b *testBroker) subscribes(cid, filter string) (n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range b.subs[cid] {
+		if f == filter {
+			n++
+		}
+	}
+	return
+}
+
+func (b *testBroker) serve(c *brokerConn) {
+	graceful := false
+	defer func() {
+		_ = c.Close()
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+		if w := c.info.Will; w != nil && !graceful {
+			b.route(w.Topic, w.Payload)
+		}
+	}()
+	r := bufio.NewReader(c)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			if c.info, err = parseConnect(body); err != nil {
+				b.t.Errorf("bad CONNECT: %v", err)
+				return
+			}
+			b.mu.Lock()
+			b.conns[c] = true
+			b.connects = append(b.connects, c.info)
+			b.mu.Unlock()
+			c.write(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			qos := header >> 1 & 3
+			n := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+n]), body[2+n:]
+			if qos > 0 {
+				c.write(0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.route(topic, rest)
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			granted := []byte{}
+			for len(rest) > 0 {
+				n := int(binary.BigEndian.Uint16(rest))
+				filter := string(rest[2 : 2+n])
+				rest = rest[3+n:]
+				b.mu.Lock()
+				c.filters = append(c.filters, filter)
+				b.subs[c.info.ClientId] = append(b.subs[c.info.ClientId], filter)
+				b.mu.Unlock()
+				granted = append(granted, 0)
+			}
+			c.write(0x90, append(append([]byte{}, id...), granted...))
+		case 10: // UNSUBSCRIBE
+			c.write(0xB0, body[:2])
+		case 12: // PINGREQ
+			c.write(0xD0, nil)
+		case 14: // DISCONNECT
+			graceful = true
+			return
+		}
+	}
+}
+
+// route publishes at qos 0 to every connection with a matching filter.
+func (b *testBroker) route(topic string, payload []byte) {
+	b.mu.Lock()
+	var to []*brokerConn
+	for c := range b.conns {
+		for _, f := range c.filters {
+			if topicMatch(f, topic) {
+				to = append(to, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	body := append(mqttString(topic), payload...)
+	for _, c := range to {
+		c.write(0x30, body)
+	}
+}
+
+func (c *brokerConn) write(header byte, body []byte) {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		if n /= 128; n > 0 {
+			d |= 0x80
+		}
+		pkt = append(pkt, d)
+		if n == 0 {
+			break
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, _ = c.Write(append(pkt, body...))
+}
+
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	if header, err = r.ReadByte(); err != nil {
+		return
+	}
+	n, shift := 0, 0
+	for {
+		var d byte
+		if d, err = r.ReadByte(); err != nil {
+			return
+		}
+		n |= int(d&0x7F) << shift
+		if d&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body = make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func parseConnect(body []byte) (info connectInfo, err error) {
+	next := func() []byte {
+		if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+			err = errors.New("short packet")
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		v := body[2 : 2+n]
+		body = body[2+n:]
+		return v
+	}
+	info.Protocol = string(next())
+	if err != nil || len(body) < 4 {
+		return info, errors.New("short packet")
+	}
+	flags := body[1]
+	info.Level = body[0]
+	info.KeepAlive = binary.BigEndian.Uint16(body[2:])
+	info.CleanSession = flags&0x02 != 0
+	body = body[4:]
+	info.ClientId = string(next())
+	if flags&0x04 != 0 {
+		w := &Will{Topic: string(next()), Qos: flags >> 3 & 3, Retained: flags&0x20 != 0}
+		w.Payload = append([]byte(nil), next()...)
+		info.Will = w
+	}
+	if flags&0x80 != 0 {
+		info.Username = string(next())
+	}
+	if flags&0x40 != 0 {
+		info.Password = string(next())
+	}
+	return
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func topicMatch(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func build(t *testing.T, b *Builder) *Session {
+	t.Helper()
+	s, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// receiver returns a handler that forwards payloads to the returned channel.
+func receiver() (MessageHandler, chan string) {
+	ch := make(chan string, 16)
+	return func(msg MQTT.Message) { ch <- string(msg.Payload()) }, ch
+}
+
+func expectMessage(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got message %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message, want %q", want)
+	}
+}
+
+func TestBuilderConnect(t *testing.T) {
+	b := startBroker(t)
+	opt := b.options("connect")
+	opt.Un, opt.Pw = "user", "secret"
+	connected := make(chan struct{}, 1)
+	s := build(t, NewBuilder(opt).SetOnConnect(func(*Session) { connected <- struct{}{} }))
+
+	infos := b.connectsOf("connect")
+	if len(infos) != 1 {
+		t.Fatalf("got %d CONNECTs, want 1", len(infos))
+	}
+	info := infos[0]
+	if info.Protocol != "MQTT" || info.Level != 4 || !info.CleanSession ||
+		info.Username != "user" || info.Password != "secret" || info.Will != nil {
+		t.Fatalf("unexpected CONNECT %+v", info)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnect was not called")
+	}
+
+	handler, ch := receiver()
+	if err := s.Subscribe("test/+/in", 1, handler); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishSync("test/1/in", 1, false, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, ch, "hello")
+	if v, ok := SessionCache.Load("connect"); !ok || v != s {
+		t.Fatal("session is not cached under its client id")
+	}
+}
+
+func TestBuilderProtocolVersion(t *testing.T) {
+	b := startBroker(t)
+	build(t, NewBuilder(b.options("v3")).SetProtocolVersion(3))
+	if info := b.connectsOf("v3"); len(info) != 1 || info[0].Protocol != "MQIsdp" || info[0].Level != 3 {
+		t.Fatalf("unexpected CONNECT %+v", info)
+	}
+	if _, err := NewBuilder(b.options("v5")).SetProtocolVersion(5).Build(); err == nil {
+		t.Fatal("MQTT 5 was accepted")
+	}
+	if _, err := NewBuilder(&Options{}).Build(); err == nil {
+		t.Fatal("empty addr was accepted")
+	}
+}
+
+func TestBuilderReconnectRestoresSubscriptions(t *testing.T) {
+	b := startBroker(t)
+	var connects, lost atomic.Int32
+	s := build(t, NewBuilder(b.options("reconnect")).
+		SetOnConnect(func(*Session) { connects.Add(1) }).
+		SetOnConnectionLost(func(*Session, error) { lost.Add(1) }))
+	handler, ch := receiver()
+	if err := s.Subscribe("dev/+/cmd", 0, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	b.drop("reconnect")
+	waitFor(t, "reconnect", 10*time.Second, func() bool { return len(b.connectsOf("reconnect")) == 2 })
+	waitFor(t, "resubscribe", 5*time.Second, func() bool { return b.subscribes("reconnect", "dev/+/cmd") == 2 })
+	b.route("dev/1/cmd", []byte("after"))
+	expectMessage(t, ch, "after")
+	waitFor(t, "OnConnect", 5*time.Second, func() bool { return connects.Load() == 2 })
+	if n := atomic.LoadInt64(&s.ReconnectCount); n != 2 {
+		t.Fatalf("ReconnectCount is %d, want 2", n)
+	}
+	if n := lost.Load(); n != 1 {
+		t.Fatalf("OnConnectionLost called %d times, want 1", n)
+	}
+}
+
+func TestBuilderWithoutResubscribe(t *testing.T) {
+	b := startBroker(t)
+	s := build(t, NewBuilder(b.options("nosubs")).SetResubscribe(false, 0))
+	handler, _ := receiver()
+	if err := s.Subscribe("dev/+/cmd", 0, handler); err != nil {
+		t.Fatal(err)
+	}
+	b.drop("nosubs")
+	waitFor(t, "reconnect", 10*time.Second, func() bool { return len(b.connectsOf("nosubs")) == 2 })
+	time.Sleep(200 * time.Millisecond)
+	if n := b.subscribes("nosubs", "dev/+/cmd"); n != 1 {
+		t.Fatalf("subscribed %d times, want 1", n)
+	}
+}
+
+func TestBuilderConnectRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	opt := &Options{Addr: "tcp://" + addr, ClientId: "retry", Timeout: time.Second, RetryInterval: 50 * time.Millisecond}
+	if _, err = NewBuilder(opt).Build(); err == nil {
+		t.Fatal("Build without ConnectRetry succeeded with the broker down")
+	}
+	s := build(t, NewBuilder(opt).SetConnectRetry(true))
+	if s.Client.IsConnectionOpen() {
+		t.Fatal("connected with the broker down")
+	}
+	handler, ch := receiver()
+	_ = s.Subscribe("late/topic", 0, handler)
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	b := serveBroker(t, ln)
+	waitFor(t, "connect", 10*time.Second, func() bool { return s.Client.IsConnectionOpen() })
+	// made while offline, the subscription is sent once connected
+	waitFor(t, "subscribe", 5*time.Second, func() bool { return b.subscribes("retry", "late/topic") > 0 })
+	b.route("late/topic", []byte("hi"))
+	expectMessage(t, ch, "hi")
+}
+
+func TestBuilderWill(t *testing.T) {
+	b := startBroker(t)
+	watcher := build(t, NewBuilder(b.options("watcher")))
+	handler, ch := receiver()
+	if err := watcher.Subscribe("dev/+/status", 0, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	build(t, NewBuilder(b.options("dev1")).SetWill("dev/1/status", []byte("offline"), 1, true))
+	info := b.connectsOf("dev1")[0]
+	if w := info.Will; w == nil || w.Topic != "dev/1/status" || string(w.Payload) != "offline" || w.Qos != 1 || !w.Retained {
+		t.Fatalf("unexpected will %+v", info.Will)
+	}
+	b.drop("dev1")
+	expectMessage(t, ch, "offline")
+
+	// a clean disconnect does not trigger the will
+	s := build(t, NewBuilder(b.options("dev2")).SetWill("dev/2/status", []byte("offline"), 0, false))
+	s.Close()
+	select {
+	case msg := <-ch:
+		t.Fatalf("got %q after a clean disconnect", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if _, err := NewBuilder(b.options("dev3")).SetWill("", nil, 0, false).Build(); err == nil {
+		t.Fatal("will without a topic was accepted")
+	}
+	if _, err := NewBuilder(b.options("dev3")).SetWill("dev/3/status", nil, 3, false).Build(); err == nil {
+		t.Fatal("will with qos 3 was accepted")
+	}
+}
+
+// The constructors in helper.go are Builder presets; their sessions must
+// connect like the Builder they stand for and restore subscriptions.
+func TestLegacyConstructors(t *testing.T) {
+	b := startBroker(t)
+	same := func(t *testing.T, got, want connectInfo) {
+		t.Helper()
+		got.ClientId, want.ClientId = "", ""
+		if got.Protocol != want.Protocol || got.Level != want.Level || got.CleanSession != want.CleanSession ||
+			got.KeepAlive != want.KeepAlive || got.Username != want.Username || got.Password != want.Password {
+			t.Fatalf("CONNECT %+v, want %+v", got, want)
+		}
+	}
+	restores := func(t *testing.T, s *Session, cid string, within time.Duration) {
+		t.Helper()
+		t.Cleanup(s.Close)
+		handler, ch := receiver()
+		if err := s.Subscribe(cid+"/in", 0, handler); err != nil {
+			t.Fatal(err)
+		}
+		b.drop(cid)
+		waitFor(t, "resubscribe", within, func() bool { return b.subscribes(cid, cid+"/in") == 2 })
+		b.route(cid+"/in", []byte("again"))
+		expectMessage(t, ch, "again")
+	}
+	opt := func(cid string) *Options {
+		o := b.options(cid)
+		o.Un, o.Pw = "user", "pw"
+		return o
+	}
+	build(t, NewBuilder(opt("builder")).SetResumeSubs(true))
+	want := b.connectsOf("builder")[0]
+
+	t.Run("NewSession", func(t *testing.T) {
+		s, err := NewSession(opt("legacy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		same(t, b.connectsOf("legacy")[0], want)
+		restores(t, s, "legacy", 10*time.Second)
+	})
+	t.Run("NewSessionEx", func(t *testing.T) {
+		s, err := NewSessionEx(opt("legacy-ex"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		same(t, b.connectsOf("legacy-ex")[0], want)
+		restores(t, s, "legacy-ex", 10*time.Second)
+	})
+	t.Run("NewMqttSession", func(t *testing.T) {
+		s, err := NewMqttSession(opt("").Addr, "mqtt-session", "user", "pw", 0, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		same(t, b.connectsOf("mqtt-session")[0], want)
+		restores(t, s, "mqtt-session", 10*time.Second)
+	})
+	t.Run("NewPersistSession", func(t *testing.T) {
+		o := opt("")
+		s := NewPersistSession(o)
+		cid := SnClientId()
+		waitFor(t, "connect", 10*time.Second, func() bool { return len(b.connectsOf(cid)) == 1 })
+		same(t, b.connectsOf(cid)[0], want)
+		// resubscribes 5s after a reconnect
+		restores(t, s, cid, 15*time.Second)
+	})
+}
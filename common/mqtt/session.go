@@ -3,6 +3,7 @@ package mqtt
 import (
 	"context"
 	"fmt"
+	"system-conf/common"
 	"system-conf/common/log"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -29,6 +30,9 @@ type Session struct {
 	cancel         context.CancelFunc
 	Subscriptions  map[string]*SubscribeObject
 	ReconnectCount int64
+	// subsMu guards Subscriptions, which the client resubscribes from its
+	// own goroutine
+	subsMu sync.Mutex
 }
 
 type MessageHandler func(msg MQTT.Message)
@@ -51,17 +55,21 @@ func NewSubscribeObject(topic string, qos int, handler MessageHandler) (so *Subs
 var SessionCache = sync.Map{}
 
 func (m *Session) Resubscribe() {
-	for _, v := range m.Subscriptions {
+	for _, v := range m.subscriptions() {
 		log.Printf("try to resubscribe: %s", v.Topic)
 		if e := m.subscribe(v); e != nil {
 			log.Warnf("failed to resubscribe: %s; err:%v", v.Topic, e)
 		}
 	}
 }
-func (m *Session) onReconnect(client MQTT.Client) {
+func (m *Session) subscriptions() []*SubscribeObject {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	list := make([]*SubscribeObject, 0, len(m.Subscriptions))
 	for _, v := range m.Subscriptions {
-		_ = m.subscribe(v)
+		list = append(list, v)
 	}
+	return list
 }
 func (m *Session) connect() (err error) {
 	if m.Client != nil {
@@ -126,7 +134,9 @@ func (m *Session) Subscribe(topic string, qos int, handler MessageHandler) (err
 	if err != nil {
 		log.Warnf("subscribe %s failed; err:%v", topic, err)
 	}
+	m.subsMu.Lock()
 	m.Subscriptions[so.Topic] = so
+	m.subsMu.Unlock()
 	return
 }
 func (m *Session) SubscribeV1(topic string, qos int, handler MessageHandler) (err error) {
@@ -135,13 +145,17 @@ func (m *Session) SubscribeV1(topic string, qos int, handler MessageHandler) (er
 	if err != nil {
 		log.Warnf("subscribe %s failed; err:%v", topic, err)
 	}
+	m.subsMu.Lock()
 	m.Subscriptions[so.Topic] = so
+	m.subsMu.Unlock()
 	return
 }
 func (m *Session) Unsubscribe(topics ...string) {
+	m.subsMu.Lock()
 	for _, topic := range topics {
 		delete(m.Subscriptions, topic)
 	}
+	m.subsMu.Unlock()
 	m.Client.Unsubscribe(topics...)
 }
 func (m *Session) Publish(topic string, qos int, retained bool, payload interface{}) error {
@@ -189,3 +203,23 @@ func (m *Session) Close() {
 	m.Client.Disconnect(250)
 	//<-m.ctx.Done()
 }
+
+func init() {
+	common.OnShutdown(common.ShutdownStageSession, "mqtt sessions", CloseSessions)
+}
+
+// CloseSessions disconnects every cached session.
+func CloseSessions(cx context.Context) error {
+	closed := make(map[*Session]bool)
+	SessionCache.Range(func(key, value any) bool {
+		if s, ok := value.(*Session); ok && !closed[s] {
+			closed[s] = true
+			if !s.Closed && s.Client != nil {
+				s.Close()
+			}
+		}
+		SessionCache.Delete(key)
+		return cx.Err() == nil
+	})
+	return cx.Err()
+}
@@ -0,0 +1,490 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package profile describes serial devices declaratively: which port they
+// sit on, the commands that poll them and how the replies decode into
+// named, scaled values. A Runner executes the profiles and publishes the
+// readings over MQTT, so the same sensor on every vehicle only needs a
+// profile file instead of code.
+package profile
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"system-conf/common"
+	"system-conf/common/codec"
+	"time"
+)
+
+const (
+	DefaultInterval = 5 * time.Second
+	DefaultTopic    = "serial/{sn}/{name}"
+)
+
+var ErrShortReply = errors.New("reply too short")
+
+// PortSettings selects and configures the serial port of a profile. Zero
+// values keep whatever the port is already configured with; Match binds the
+// port name to a USB adapter as in SerialPortConf.
+type PortSettings struct {
+	Name     string                  `yaml:"name" json:"name" example:"/dev/ttyUSB0"`
+	BaudRate int                     `yaml:"baudRate,omitempty" json:"baudRate,omitempty" example:"9600"`
+	DataBits int                     `yaml:"dataBits,omitempty" json:"dataBits,omitempty"`
+	Parity   string                  `yaml:"parity,omitempty" json:"parity,omitempty"`
+	StopBits string                  `yaml:"stopBits,omitempty" json:"stopBits,omitempty"`
+	Match    *common.SerialPortMatch `yaml:"match,omitempty" json:"match,omitempty"`
+}
+
+// Profile is one serial device. Topic is a template where {sn} is the
+// vehicle serial number, {name} the profile name and {poll} the poll name;
+// readings of every poll are published as one JSON object on it, and each
+// value additionally on <topic>/<value> when ValueTopics is set.
+type Profile struct {
+	Name        string        `yaml:"name" json:"name" example:"fuel"`
+	Desc        string        `yaml:"desc,omitempty" json:"desc,omitempty"`
+	Disabled    bool          `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	Port        PortSettings  `yaml:"port" json:"port"`
+	Interval    time.Duration `yaml:"interval,omitempty" json:"interval,omitempty" swaggertype:"integer"`
+	Topic       string        `yaml:"topic,omitempty" json:"topic,omitempty" example:"serial/{sn}/{name}"`
+	Qos         int           `yaml:"qos,omitempty" json:"qos,omitempty"`
+	Retain      bool          `yaml:"retain,omitempty" json:"retain,omitempty"`
+	ValueTopics bool          `yaml:"valueTopics,omitempty" json:"valueTopics,omitempty"`
+	Polls       []*Poll       `yaml:"polls" json:"polls"`
+
+	File string `yaml:"-" json:"file,omitempty"`
+}
+
+// ModbusPoll reads a block with function 1, 2, 3 or 4. Register replies
+// are decoded as big endian bytes, 2 per register; coil and discrete input
+// replies as one byte (0 or 1) per bit.
+type ModbusPoll struct {
+	Unit     byte   `yaml:"unit" json:"unit" example:"1"`
+	Function byte   `yaml:"function" json:"function" example:"3"`
+	Address  uint16 `yaml:"address" json:"address"`
+	Quantity uint16 `yaml:"quantity" json:"quantity" example:"2"`
+}
+
+// Poll is one request and the values decoded from its reply: either a
+// Modbus read or a raw request whose reply ends after Length bytes, at
+// Delimiter or once the line goes quiet. Timeout only applies to raw
+// requests, Modbus reads use the timeout of the port's RTUMaster.
+type Poll struct {
+	Name   string      `yaml:"name" json:"name"`
+	Modbus *ModbusPoll `yaml:"modbus,omitempty" json:"modbus,omitempty"`
+	// Request is sent as is with Encoding text (the default, with \r \n
+	// \t and \xNN escapes) or parsed as hex digits with Encoding hex
+	Request   string        `yaml:"request,omitempty" json:"request,omitempty" example:"READ\\r\\n"`
+	Encoding  string        `yaml:"encoding,omitempty" json:"encoding,omitempty" enums:"text,hex"`
+	Length    int           `yaml:"length,omitempty" json:"length,omitempty"`
+	Delimiter string        `yaml:"delimiter,omitempty" json:"delimiter,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty" swaggertype:"integer"`
+	Retries   int           `yaml:"retries,omitempty" json:"retries,omitempty"`
+	Values    []*Value      `yaml:"values" json:"values"`
+
+	request []byte
+}
+
+// Value decodes one reading from a reply. Binary types read from Offset;
+// Order is be (the default), le, or swap for 32 and 64 bit values split
+// into big endian 16 bit words sent low word first. With Pattern the reply
+// is treated as text and the first group (or the whole match) is parsed.
+// The result is raw*Scale+Add; a zero Scale counts as 1.
+type Value struct {
+	Name    string  `yaml:"name" json:"name" example:"level"`
+	Type    string  `yaml:"type,omitempty" json:"type,omitempty" enums:"u8,i8,u16,i16,u32,i32,u64,i64,f32,f64,bcd,ascii,bit,number,string"`
+	Offset  int     `yaml:"offset,omitempty" json:"offset,omitempty"`
+	Size    int     `yaml:"size,omitempty" json:"size,omitempty"`
+	Bit     int     `yaml:"bit,omitempty" json:"bit,omitempty"`
+	Order   string  `yaml:"order,omitempty" json:"order,omitempty" enums:"be,le,swap"`
+	Pattern string  `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	Scale   float64 `yaml:"scale,omitempty" json:"scale,omitempty"`
+	Add     float64 `yaml:"add,omitempty" json:"add,omitempty"`
+	Unit    string  `yaml:"unit,omitempty" json:"unit,omitempty" example:"L"`
+
+	re *regexp.Regexp
+}
+
+var typeSizes = map[string]int{
+	"u8": 1, "i8": 1, "bit": 1,
+	"u16": 2, "i16": 2,
+	"u32": 4, "i32": 4, "f32": 4,
+	"u64": 8, "i64": 8, "f64": 8,
+}
+
+// Parse decodes a YAML or JSON profile and checks it.
+func Parse(data []byte) (*Profile, error) {
+	p := &Profile{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if err := p.Prepare(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Load reads a profile file.
+func Load(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p.File = path
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return p, nil
+}
+
+// LoadDir reads every .yaml, .yml and .json file in dir, sorted by name. A
+// missing dir holds no profiles.
+func LoadDir(dir string) (profiles []*Profile, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		p, e := Load(filepath.Join(dir, e.Name()))
+		if e != nil {
+			return nil, e
+		}
+		if f, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("%s: profile %s is already defined in %s", p.File, p.Name, f)
+		}
+		names[p.Name] = p.File
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return
+}
+
+// Prepare fills in defaults and validates the profile; Parse calls it.
+func (p *Profile) Prepare() error {
+	if p.Port.Name == "" {
+		return fmt.Errorf("port name is required")
+	}
+	if p.Interval <= 0 {
+		p.Interval = DefaultInterval
+	}
+	if p.Topic == "" {
+		p.Topic = DefaultTopic
+	}
+	if p.Qos < 0 || p.Qos > 2 {
+		return fmt.Errorf("invalid qos %d", p.Qos)
+	}
+	if len(p.Polls) == 0 {
+		return fmt.Errorf("no polls")
+	}
+	seen := map[string]bool{}
+	for i, poll := range p.Polls {
+		if poll.Name == "" {
+			poll.Name = strconv.Itoa(i)
+		}
+		if err := poll.prepare(); err != nil {
+			return fmt.Errorf("poll %s: %w", poll.Name, err)
+		}
+		for _, v := range poll.Values {
+			if seen[v.Name] {
+				return fmt.Errorf("poll %s: duplicate value %s", poll.Name, v.Name)
+			}
+			seen[v.Name] = true
+		}
+	}
+	return nil
+}
+
+// PortConf merges the port settings of the profile over conf and enables it.
+func (p *Profile) PortConf(conf *common.SerialPortConf) *common.SerialPortConf {
+	s := p.Port
+	if s.BaudRate > 0 {
+		conf.BaudRate = s.BaudRate
+	}
+	if s.DataBits > 0 {
+		conf.DataBits = s.DataBits
+	}
+	if s.Parity != "" {
+		conf.Parity = s.Parity
+	}
+	if s.StopBits != "" {
+		conf.StopBits = s.StopBits
+	}
+	if s.Match != nil {
+		m := *s.Match
+		conf.Match = &m
+	}
+	conf.Enabled = true
+	return conf
+}
+
+// TopicFor expands the topic template.
+func (p *Profile) TopicFor(sn, poll string) string {
+	return strings.NewReplacer("{sn}", sn, "{name}", p.Name, "{poll}", poll).Replace(p.Topic)
+}
+
+func (poll *Poll) prepare() (err error) {
+	if poll.Modbus != nil {
+		if poll.Request != "" {
+			return fmt.Errorf("modbus and request are exclusive")
+		}
+		mb := poll.Modbus
+		if mb.Function < 1 || mb.Function > 4 {
+			return fmt.Errorf("unsupported modbus function %d", mb.Function)
+		}
+		if mb.Quantity == 0 {
+			return fmt.Errorf("modbus quantity is required")
+		}
+	} else {
+		switch poll.Encoding {
+		case "", "text":
+			poll.request = []byte(unescape(poll.Request))
+		case "hex":
+			poll.request, err = hex.DecodeString(strings.Join(strings.Fields(poll.Request), ""))
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown encoding %s", poll.Encoding)
+		}
+		if len(poll.request) == 0 {
+			return fmt.Errorf("request is empty")
+		}
+	}
+	if len(poll.Values) == 0 {
+		return fmt.Errorf("no values")
+	}
+	for _, v := range poll.Values {
+		if err = v.prepare(); err != nil {
+			return fmt.Errorf("value %s: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// matcher tells where the reply to a raw request ends.
+func (poll *Poll) matcher() common.ReplyMatcher {
+	switch {
+	case poll.Length > 0:
+		return common.MatchLength(poll.Length)
+	case poll.Delimiter != "":
+		return common.MatchDelimiter([]byte(unescape(poll.Delimiter)))
+	}
+	return nil
+}
+
+func (v *Value) prepare() (err error) {
+	if v.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if v.Pattern != "" {
+		if v.re, err = regexp.Compile(v.Pattern); err != nil {
+			return err
+		}
+		switch v.Type {
+		case "":
+			v.Type = "number"
+		case "number", "string":
+		default:
+			return fmt.Errorf("type %s cannot be used with a pattern", v.Type)
+		}
+		return nil
+	}
+	if v.Type == "" {
+		v.Type = "u16"
+	}
+	switch v.Order {
+	case "", "be", "le", "swap":
+	default:
+		return fmt.Errorf("unknown order %s", v.Order)
+	}
+	if v.Offset < 0 {
+		return fmt.Errorf("negative offset")
+	}
+	switch v.Type {
+	case "bcd", "ascii":
+		if v.Size <= 0 {
+			return fmt.Errorf("size is required for %s", v.Type)
+		}
+	case "number", "string":
+		return fmt.Errorf("type %s requires a pattern", v.Type)
+	default:
+		if _, ok := typeSizes[v.Type]; !ok {
+			return fmt.Errorf("unknown type %s", v.Type)
+		}
+		v.Size = typeSizes[v.Type]
+	}
+	if v.Type == "bit" && (v.Bit < 0 || v.Bit > 7) {
+		return fmt.Errorf("bit %d out of range", v.Bit)
+	}
+	return nil
+}
+
+func (v *Value) scaled(f float64) float64 {
+	if v.Scale != 0 {
+		f *= v.Scale
+	}
+	return f + v.Add
+}
+
+// Decode extracts the value from a reply. Strings decode to string, the
+// bit type to bool and everything else to a scaled float64.
+func (v *Value) Decode(reply []byte) (any, error) {
+	if v.re != nil {
+		m := v.re.FindSubmatch(reply)
+		if m == nil {
+			return nil, fmt.Errorf("pattern %q does not match", v.Pattern)
+		}
+		s := m[0]
+		if len(m) > 1 {
+			s = m[1]
+		}
+		if v.Type == "string" {
+			return string(s), nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(s)), 64)
+		if err != nil {
+			return nil, err
+		}
+		return v.scaled(f), nil
+	}
+	if v.Offset+v.Size > len(reply) {
+		return nil, ErrShortReply
+	}
+	b := reorder(reply[v.Offset:v.Offset+v.Size], v.Order)
+	var f float64
+	switch v.Type {
+	case "ascii":
+		return strings.TrimRight(string(b), " \x00"), nil
+	case "bit":
+		return b[0]>>v.Bit&1 == 1, nil
+	case "bcd":
+		n, err := codec.BigEndian.DecodeUint(b)
+		if err != nil {
+			return nil, err
+		}
+		f = float64(n)
+	case "u8":
+		f = float64(b[0])
+	case "i8":
+		f = float64(int8(b[0]))
+	case "u16":
+		f = float64(binary.BigEndian.Uint16(b))
+	case "i16":
+		f = float64(int16(binary.BigEndian.Uint16(b)))
+	case "u32":
+		f = float64(binary.BigEndian.Uint32(b))
+	case "i32":
+		f = float64(int32(binary.BigEndian.Uint32(b)))
+	case "f32":
+		f = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case "u64":
+		f = float64(binary.BigEndian.Uint64(b))
+	case "i64":
+		f = float64(int64(binary.BigEndian.Uint64(b)))
+	case "f64":
+		f = math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return v.scaled(f), nil
+}
+
+// reorder returns b in big endian order.
+func reorder(b []byte, order string) []byte {
+	switch order {
+	case "le":
+		r := make([]byte, len(b))
+		for i := range b {
+			r[len(b)-1-i] = b[i]
+		}
+		return r
+	case "swap":
+		if len(b)%2 != 0 {
+			return b
+		}
+		r := make([]byte, 0, len(b))
+		for i := len(b) - 2; i >= 0; i -= 2 {
+			r = append(r, b[i], b[i+1])
+		}
+		return r
+	}
+	return b
+}
+
+// unescape expands \r, \n, \t, \\ and \xNN in text requests.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'x':
+			if i+2 < len(s) {
+				if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					sb.WriteByte(byte(n))
+					i += 2
+					continue
+				}
+			}
+			sb.WriteString(`\x`)
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,371 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package profile
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"system-conf/common"
+	"system-conf/common/log"
+	"system-conf/common/modbus"
+	"time"
+)
+
+// Publisher is the part of mqtt.Session a Runner publishes through.
+type Publisher interface {
+	Publish(topic string, qos int, retained bool, payload interface{}) error
+}
+
+// Reading is the latest result of one value.
+type Reading struct {
+	Value any       `json:"value,omitempty"`
+	Unit  string    `json:"unit,omitempty"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Message is the JSON payload published on a profile topic.
+type Message struct {
+	Profile string            `json:"profile"`
+	Sn      string            `json:"sn,omitempty"`
+	Time    time.Time         `json:"time"`
+	Values  map[string]any    `json:"values"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+type Status struct {
+	Running   bool                `json:"running"`
+	Polls     uint64              `json:"polls"`
+	Errors    uint64              `json:"errors"`
+	Published uint64              `json:"published"`
+	LastPoll  time.Time           `json:"lastPoll,omitempty"`
+	LastError string              `json:"lastError,omitempty"`
+	Values    map[string]*Reading `json:"values"`
+}
+
+type Info struct {
+	*Profile
+	Status Status `json:"status"`
+}
+
+// Runner polls the profiles found in Dir, each on its own goroutine, and
+// publishes the readings through Publisher when one is set.
+type Runner struct {
+	Dir       string
+	Serial    *common.SerialManager
+	Publisher Publisher
+	// Sn fills {sn} in topics, log.Sn by default
+	Sn string
+
+	mu   sync.Mutex
+	runs map[string]*run
+}
+
+type run struct {
+	*Runner
+	profile *Profile
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu     sync.Mutex
+	status Status
+}
+
+func NewRunner(dir string, serial *common.SerialManager, pub Publisher) *Runner {
+	return &Runner{Dir: dir, Serial: serial, Publisher: pub, runs: make(map[string]*run)}
+}
+
+func (r *Runner) sn() string {
+	if r.Sn != "" {
+		return r.Sn
+	}
+	return log.Sn
+}
+
+// Load (re)reads Dir and restarts every profile. On error the running
+// profiles are left alone.
+func (r *Runner) Load() error {
+	profiles, err := LoadDir(r.Dir)
+	if err != nil {
+		return err
+	}
+	r.Stop()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs = make(map[string]*run, len(profiles))
+	for _, p := range profiles {
+		ru := &run{Runner: r, profile: p, status: Status{Values: map[string]*Reading{}}}
+		r.runs[p.Name] = ru
+		if p.Disabled {
+			continue
+		}
+		if e := ru.start(); e != nil {
+			log.Warnf("failed to start profile %s: %v", p.Name, e)
+			ru.status.LastError = e.Error()
+		}
+	}
+	log.Printf("loaded %d serial profile(s) from %s", len(profiles), r.Dir)
+	return nil
+}
+
+// Stop stops polling and waits for in-flight requests to finish.
+func (r *Runner) Stop() {
+	r.mu.Lock()
+	runs := r.runs
+	r.mu.Unlock()
+	for _, ru := range runs {
+		ru.stop()
+	}
+}
+
+func (r *Runner) List() []*Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*Info, 0, len(r.runs))
+	for _, ru := range r.runs {
+		list = append(list, ru.info())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (r *Runner) Get(name string) *Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ru, ok := r.runs[name]; ok {
+		return ru.info()
+	}
+	return nil
+}
+
+func (ru *run) info() *Info {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	st := ru.status
+	st.Values = make(map[string]*Reading, len(ru.status.Values))
+	for k, v := range ru.status.Values {
+		rd := *v
+		st.Values[k] = &rd
+	}
+	return &Info{Profile: ru.profile, Status: st}
+}
+
+// start applies the port settings, saving them only when they change, and
+// starts the poll loop.
+func (ru *run) start() error {
+	p := ru.profile
+	conf := ru.Serial.GetConf(p.Port.Name)
+	if merged := p.PortConf(ru.Serial.GetConf(p.Port.Name)); !reflect.DeepEqual(conf, merged) {
+		if err := ru.Serial.SetConf(merged); err != nil {
+			return err
+		}
+	}
+	cx, cancel := context.WithCancel(context.Background())
+	ru.cancel = cancel
+	ru.done = make(chan struct{})
+	ru.status.Running = true
+	go ru.loop(cx)
+	return nil
+}
+
+func (ru *run) stop() {
+	if ru.cancel == nil {
+		return
+	}
+	ru.cancel()
+	<-ru.done
+	ru.mu.Lock()
+	ru.status.Running = false
+	ru.mu.Unlock()
+}
+
+func (ru *run) loop(cx context.Context) {
+	defer close(ru.done)
+	t := time.NewTicker(ru.profile.Interval)
+	defer t.Stop()
+	for {
+		ru.poll(cx)
+		select {
+		case <-cx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// poll runs every request of the profile once and publishes the values,
+// one message per expanded topic.
+func (ru *run) poll(cx context.Context) {
+	p := ru.profile
+	sn := ru.sn()
+	messages := map[string]*Message{}
+	var topics []string
+	var lastErr error
+	for _, poll := range p.Polls {
+		reply, err := ru.request(cx, poll)
+		if cx.Err() != nil {
+			return
+		}
+		now := time.Now()
+		topic := p.TopicFor(sn, poll.Name)
+		msg, ok := messages[topic]
+		if !ok {
+			msg = &Message{Profile: p.Name, Sn: sn, Time: now, Values: map[string]any{}}
+			messages[topic] = msg
+			topics = append(topics, topic)
+		}
+		ru.mu.Lock()
+		ru.status.Polls++
+		ru.status.LastPoll = now
+		for _, v := range poll.Values {
+			rd := &Reading{Unit: v.Unit, Time: now}
+			var val any
+			e := err
+			if e == nil {
+				val, e = v.Decode(reply)
+			}
+			if e != nil {
+				rd.Error = e.Error()
+				if msg.Errors == nil {
+					msg.Errors = map[string]string{}
+				}
+				msg.Errors[v.Name] = rd.Error
+				lastErr = fmt.Errorf("%s: %w", poll.Name, e)
+			} else {
+				rd.Value = val
+				msg.Values[v.Name] = val
+			}
+			ru.status.Values[v.Name] = rd
+		}
+		if err != nil {
+			ru.status.Errors++
+		}
+		ru.mu.Unlock()
+	}
+	ru.mu.Lock()
+	if lastErr != nil {
+		// log changes only, a disconnected device fails every poll
+		if lastErr.Error() != ru.status.LastError {
+			log.Warnf("profile %s: %v", p.Name, lastErr)
+		}
+		ru.status.LastError = lastErr.Error()
+	} else {
+		ru.status.LastError = ""
+	}
+	ru.mu.Unlock()
+	for _, topic := range topics {
+		ru.publish(topic, messages[topic])
+	}
+}
+
+func (ru *run) request(cx context.Context, poll *Poll) ([]byte, error) {
+	ctx, err := ru.Serial.Ctx(ru.profile.Port.Name)
+	if err != nil {
+		return nil, err
+	}
+	if mb := poll.Modbus; mb != nil {
+		if poll.Retries > 0 {
+			cx = modbus.WithRetries(cx, poll.Retries)
+		}
+		master := modbus.GetRTUMaster(ctx)
+		switch mb.Function {
+		case 1, 2:
+			read := master.ReadCoils
+			if mb.Function == 2 {
+				read = master.ReadDiscreteInputs
+			}
+			bits, err := read(cx, mb.Unit, mb.Address, mb.Quantity)
+			if err != nil {
+				return nil, err
+			}
+			reply := make([]byte, len(bits))
+			for i, b := range bits {
+				if b {
+					reply[i] = 1
+				}
+			}
+			return reply, nil
+		default:
+			read := master.ReadHoldingRegisters
+			if mb.Function == 4 {
+				read = master.ReadInputRegisters
+			}
+			regs, err := read(cx, mb.Unit, mb.Address, mb.Quantity)
+			if err != nil {
+				return nil, err
+			}
+			reply := make([]byte, 2*len(regs))
+			for i, r := range regs {
+				binary.BigEndian.PutUint16(reply[2*i:], r)
+			}
+			return reply, nil
+		}
+	}
+	if poll.Timeout > 0 {
+		cx = common.WithTransactTimeout(cx, poll.Timeout)
+	}
+	if poll.Retries > 0 {
+		cx = common.WithTransactRetries(cx, poll.Retries)
+	}
+	return ctx.Transact(cx, poll.request, poll.matcher())
+}
+
+// publish sends msg as JSON and, with ValueTopics, each value as plain text
+// on <topic>/<value>. Nothing is sent when every value failed.
+func (ru *run) publish(topic string, msg *Message) {
+	if ru.Publisher == nil || len(msg.Values) == 0 {
+		return
+	}
+	p := ru.profile
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Warnf("profile %s: %v", p.Name, err)
+		return
+	}
+	if err = ru.Publisher.Publish(topic, p.Qos, p.Retain, data); err != nil {
+		log.Warnf("profile %s: failed to publish %s: %v", p.Name, topic, err)
+		return
+	}
+	if p.ValueTopics {
+		for name, v := range msg.Values {
+			_ = ru.Publisher.Publish(strings.TrimSuffix(topic, "/")+"/"+name, p.Qos, p.Retain, formatValue(v))
+		}
+	}
+	ru.mu.Lock()
+	ru.status.Published++
+	ru.mu.Unlock()
+}
+
+func formatValue(v any) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
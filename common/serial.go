@@ -22,11 +22,28 @@ package common
 
 import (
 	"context"
+	"errors"
 	"go.bug.st/serial"
+	"sync"
+	"sync/atomic"
 	"system-conf/common/log"
 	"time"
 )
 
+// serialCtxMap holds the running serial contexts so they can be closed on
+// shutdown.
+var serialCtxMap = sync.Map{}
+
+func init() {
+	OnShutdown(ShutdownStageDevice, "serial ports", func(cx context.Context) error {
+		serialCtxMap.Range(func(key, value any) bool {
+			key.(*SerialCtx).Stop()
+			return cx.Err() == nil
+		})
+		return cx.Err()
+	})
+}
+
 type SerialParams struct {
 	Name        string `json:"name"`
 	serial.Mode `json:",inline"`
@@ -38,35 +55,256 @@ type SerialCtx struct {
 	runFlag bool
 	cc      context.Context
 	cl      context.CancelFunc
+	mu      sync.Mutex
+
+	// IdleTimeout, if set before RunAsSlave, bounds each read; when it
+	// expires without data the callback is invoked with an empty slice so
+	// framers can detect line silence.
+	IdleTimeout time.Duration
+
+	taps atomic.Pointer[[]*SerialTap]
+	// txq holds a token while a request/response exchange owns the port
+	txq     chan struct{}
+	pending atomic.Int32
+
+	// resolver maps the port to its current device, see SetResolver
+	resolver func() (string, error)
+	device   string
+	wake     chan struct{}
+}
+
+// SerialTap observes the bytes read from (rx) and written to (tx) a port.
+type SerialTap struct {
+	Fn func(tx bool, data []byte)
+}
+
+// AddTap registers a tap that sees all traffic of the port, including that
+// of users of OpenPort.
+func (ctx *SerialCtx) AddTap(tap *SerialTap) {
+	for {
+		old := ctx.taps.Load()
+		var taps []*SerialTap
+		if old != nil {
+			taps = append(taps, *old...)
+		}
+		taps = append(taps, tap)
+		if ctx.taps.CompareAndSwap(old, &taps) {
+			return
+		}
+	}
+}
+
+func (ctx *SerialCtx) RemoveTap(tap *SerialTap) {
+	for {
+		old := ctx.taps.Load()
+		if old == nil {
+			return
+		}
+		var taps []*SerialTap
+		for _, t := range *old {
+			if t != tap {
+				taps = append(taps, t)
+			}
+		}
+		if ctx.taps.CompareAndSwap(old, &taps) {
+			return
+		}
+	}
+}
+
+func (ctx *SerialCtx) tap(tx bool, data []byte) {
+	if taps := ctx.taps.Load(); taps != nil {
+		for _, t := range *taps {
+			t.Fn(tx, data)
+		}
+	}
+}
+
+// tapPort hands the traffic of a port to the taps of its SerialCtx.
+type tapPort struct {
+	serial.Port
+	ctx *SerialCtx
+}
+
+func (p *tapPort) Read(buf []byte) (n int, err error) {
+	n, err = p.Port.Read(buf)
+	if n > 0 {
+		p.ctx.tap(false, buf[:n])
+	}
+	return
+}
+
+func (p *tapPort) Write(buf []byte) (n int, err error) {
+	n, err = p.Port.Write(buf)
+	if n > 0 {
+		p.ctx.tap(true, buf[:n])
+	}
+	return
 }
 
 func NewSerialCtx(params *SerialParams) (ctx *SerialCtx) {
-	return &SerialCtx{Params: params}
+	return &SerialCtx{Params: params, txq: make(chan struct{}, 1), wake: make(chan struct{}, 1)}
+}
+
+// SetResolver makes the port open whatever device fn returns instead of
+// Params.Name, so it can follow a USB adapter that was renumbered.
+func (ctx *SerialCtx) SetResolver(fn func() (string, error)) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.resolver = fn
+}
+
+// Device returns the device the port was last opened on.
+func (ctx *SerialCtx) Device() string {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.device == "" {
+		return ctx.Params.Name
+	}
+	return ctx.device
+}
+
+// Reopen makes a RunAsSlave loop waiting for its device retry at once,
+// e.g. when the device was plugged in.
+func (ctx *SerialCtx) Reopen() {
+	select {
+	case ctx.wake <- struct{}{}:
+	default:
+	}
+}
+
+// openDevice must be called with ctx.mu held.
+func (ctx *SerialCtx) openDevice() (serial.Port, error) {
+	name := ctx.Params.Name
+	if ctx.resolver != nil {
+		var err error
+		if name, err = ctx.resolver(); err != nil {
+			return nil, err
+		}
+	}
+	port, err := serial.Open(name, &ctx.Params.Mode)
+	if err != nil {
+		return nil, err
+	}
+	ctx.device = name
+	return &tapPort{Port: port, ctx: ctx}, nil
 }
 
 func (ctx *SerialCtx) open() (err error) {
-	ctx.Port, err = serial.Open(ctx.Params.Name, &ctx.Params.Mode)
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.Port, err = ctx.openDevice(); err != nil {
+		return err
+	}
+	if ctx.IdleTimeout > 0 {
+		err = ctx.Port.SetReadTimeout(ctx.IdleTimeout)
+	}
 	return
 }
 func (ctx *SerialCtx) close() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	if ctx.Port != nil {
 		ctx.Port.Close()
+		ctx.Port = nil
+	}
+}
+func (ctx *SerialCtx) port() serial.Port {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.Port
+}
+func (ctx *SerialCtx) running() bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.runFlag
+}
+func (ctx *SerialCtx) IsRunning() bool {
+	return ctx.running()
+}
+
+func (ctx *SerialCtx) Mode() serial.Mode {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.Params.Mode
+}
+
+// SetMode changes the line settings, applying them at once if the port is open.
+func (ctx *SerialCtx) SetMode(mode serial.Mode) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.Params.Mode = mode
+	if ctx.Port != nil {
+		return ctx.Port.SetMode(&mode)
 	}
+	return nil
 }
+
+var (
+	ErrSerialBusy   = errors.New("serial port is busy")
+	ErrSerialClosed = errors.New("serial port is not open")
+)
+
+// OpenPort opens the port for direct request/response use. It fails with
+// ErrSerialBusy while the port is run by RunAsSlave.
+func (ctx *SerialCtx) OpenPort() (serial.Port, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.runFlag {
+		return nil, ErrSerialBusy
+	}
+	if ctx.Port == nil {
+		port, err := ctx.openDevice()
+		if err != nil {
+			return nil, err
+		}
+		ctx.Port = port
+		serialCtxMap.Store(ctx, true)
+	}
+	return ctx.Port, nil
+}
+
+// ClosePort closes a port opened by OpenPort so it is reopened on next use,
+// e.g. after an I/O error.
+func (ctx *SerialCtx) ClosePort() {
+	ctx.close()
+}
+
+// Write writes to the open port, e.g. from outside the RunAsSlave callback.
+func (ctx *SerialCtx) Write(data []byte) (int, error) {
+	port := ctx.port()
+	if port == nil {
+		return 0, ErrSerialClosed
+	}
+	return port.Write(data)
+}
+
 func (ctx *SerialCtx) RunAsSlave(cb func(data []byte) []byte) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	if !ctx.runFlag {
 		ctx.cc, ctx.cl = context.WithCancel(context.Background())
 		ctx.runFlag = true
+		serialCtxMap.Store(ctx, true)
 		go ctx.run(cb)
 	}
 }
 func (ctx *SerialCtx) Stop() {
-	if ctx.runFlag {
-		ctx.runFlag = false
+	ctx.mu.Lock()
+	if !ctx.runFlag {
+		ctx.mu.Unlock()
+		serialCtxMap.Delete(ctx)
 		ctx.close()
-		if ctx.cc != nil {
-			<-ctx.cc.Done()
-		}
+		return
+	}
+	ctx.runFlag = false
+	cc := ctx.cc
+	ctx.mu.Unlock()
+	ctx.Reopen()
+	serialCtxMap.Delete(ctx)
+	ctx.close()
+	if cc != nil {
+		<-cc.Done()
 	}
 }
 
@@ -74,28 +312,33 @@ func (ctx *SerialCtx) run(cb func(data []byte) []byte) {
 	log.Printf("serial ctx goroutine started")
 	buf := make([]byte, 128)
 	var err error
-	for ctx.runFlag {
-		if ctx.Port == nil {
+	for ctx.running() {
+		port := ctx.port()
+		if port == nil {
 			if err = ctx.open(); err != nil {
 				log.Warnf("failed to open serial:%v", err)
-				time.Sleep(time.Second * 5)
+				select {
+				case <-ctx.wake:
+				case <-time.After(time.Second * 5):
+				}
 			}
 			continue
 		} else {
 			var sz int
-			sz, err = ctx.Port.Read(buf)
+			sz, err = port.Read(buf)
 			if err != nil {
 				ctx.close()
 			}
-			if sz > 0 && cb != nil {
+			if cb != nil && (sz > 0 || err == nil && ctx.IdleTimeout > 0) {
 				recv := cb(buf[:sz])
 				if len(recv) > 0 {
-					ctx.Port.Write(recv)
+					port.Write(recv)
 				}
 			}
 		}
 
 	}
+	ctx.close()
 	ctx.cl()
 	log.Printf("serial ctx goroutine exited")
 
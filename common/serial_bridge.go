@@ -0,0 +1,492 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"go.bug.st/serial"
+	"net"
+	"sync"
+	"sync/atomic"
+	"system-conf/common/log"
+	"time"
+)
+
+// SerialBridgeConf exposes a serial port as a TCP server.
+type SerialBridgeConf struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen" example:":4001"`
+	// RFC2217 speaks telnet with the COM-PORT-OPTION so clients can change
+	// the line settings remotely (not persisted); otherwise the connection is
+	// raw bytes.
+	RFC2217 bool `json:"rfc2217,omitempty"`
+}
+
+// BridgeClientInfo describes a client connected to a SerialBridge.
+type BridgeClientInfo struct {
+	Remote  string    `json:"remote"`
+	Since   time.Time `json:"since"`
+	Writer  bool      `json:"writer"`
+	RxBytes uint64    `json:"rxBytes"`
+	TxBytes uint64    `json:"txBytes"`
+	Dropped uint64    `json:"dropped"`
+}
+
+type BridgeInfo struct {
+	SerialBridgeConf
+	Running bool                `json:"running"`
+	Clients []*BridgeClientInfo `json:"clients"`
+}
+
+const bridgeClientQueue = 64
+
+// SerialBridge forwards everything read from a port to every connected TCP
+// client and lets one client at a time write to it: the first client that
+// sends data holds the write lock until it disconnects, writes of the other
+// clients are dropped.
+type SerialBridge struct {
+	Serial *SerialCtx
+	Conf   SerialBridgeConf
+
+	mu      sync.Mutex
+	ln      net.Listener
+	clients map[*bridgeClient]struct{}
+	writer  *bridgeClient
+}
+
+type bridgeClient struct {
+	conn    net.Conn
+	since   time.Time
+	out     chan []byte
+	rx, tx  atomic.Uint64
+	dropped atomic.Uint64
+	telnet  *telnetConn
+}
+
+func NewSerialBridge(ctx *SerialCtx, conf SerialBridgeConf) *SerialBridge {
+	return &SerialBridge{Serial: ctx, Conf: conf}
+}
+
+// Start listens on Conf.Listen and runs the port for the bridge.
+func (b *SerialBridge) Start() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ln != nil {
+		return nil
+	}
+	if b.Serial.IsRunning() {
+		return ErrSerialBusy
+	}
+	ln, err := net.Listen("tcp", b.Conf.Listen)
+	if err != nil {
+		return err
+	}
+	b.ln = ln
+	b.clients = make(map[*bridgeClient]struct{})
+	b.Serial.RunAsSlave(b.broadcast)
+	go b.accept(ln)
+	log.Printf("serial bridge %s listening on %s", b.Serial.Params.Name, ln.Addr())
+	return nil
+}
+
+func (b *SerialBridge) Stop() {
+	b.mu.Lock()
+	ln := b.ln
+	b.ln = nil
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+		b.Serial.Stop()
+		log.Printf("serial bridge %s stopped", b.Serial.Params.Name)
+	}
+}
+
+func (b *SerialBridge) Info() *BridgeInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info := &BridgeInfo{SerialBridgeConf: b.Conf, Running: b.ln != nil, Clients: []*BridgeClientInfo{}}
+	for c := range b.clients {
+		info.Clients = append(info.Clients, &BridgeClientInfo{
+			Remote:  c.conn.RemoteAddr().String(),
+			Since:   c.since,
+			Writer:  c == b.writer,
+			RxBytes: c.rx.Load(),
+			TxBytes: c.tx.Load(),
+			Dropped: c.dropped.Load(),
+		})
+	}
+	return info
+}
+
+func (b *SerialBridge) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &bridgeClient{conn: conn, since: time.Now(), out: make(chan []byte, bridgeClientQueue)}
+		if b.Conf.RFC2217 {
+			c.telnet = &telnetConn{bridge: b, client: c}
+		}
+		b.mu.Lock()
+		if b.ln != ln {
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+		b.clients[c] = struct{}{}
+		b.mu.Unlock()
+		log.Printf("serial bridge %s: client %s connected", b.Serial.Params.Name, conn.RemoteAddr())
+		go b.serveWrite(c)
+		go b.serveRead(c)
+	}
+}
+
+// broadcast is the RunAsSlave callback: it queues the received bytes for
+// every client, dropping them for clients whose queue is full.
+func (b *SerialBridge) broadcast(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	if b.Conf.RFC2217 {
+		data = telnetEscape(data)
+	} else {
+		data = append([]byte(nil), data...)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		select {
+		case c.out <- data:
+		default:
+			c.dropped.Add(uint64(len(data)))
+		}
+	}
+	return nil
+}
+
+func (b *SerialBridge) serveWrite(c *bridgeClient) {
+	for data := range c.out {
+		if _, err := c.conn.Write(data); err != nil {
+			c.conn.Close()
+			return
+		}
+		c.tx.Add(uint64(len(data)))
+	}
+}
+
+func (b *SerialBridge) serveRead(c *bridgeClient) {
+	defer b.disconnect(c)
+	if c.telnet != nil {
+		c.telnet.negotiate()
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			c.rx.Add(uint64(n))
+			data := buf[:n]
+			if c.telnet != nil {
+				data = c.telnet.parse(data)
+			}
+			if len(data) > 0 && b.lockWriter(c) {
+				if _, e := b.Serial.Write(data); e != nil {
+					log.Warnf("serial bridge %s: write failed:%v", b.Serial.Params.Name, e)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// lockWriter makes c the writer if nobody holds the lock and reports
+// whether c may write.
+func (b *SerialBridge) lockWriter(c *bridgeClient) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.writer == nil {
+		b.writer = c
+		log.Printf("serial bridge %s: client %s holds the write lock", b.Serial.Params.Name, c.conn.RemoteAddr())
+	}
+	return b.writer == c
+}
+
+func (b *SerialBridge) disconnect(c *bridgeClient) {
+	b.mu.Lock()
+	delete(b.clients, c)
+	if b.writer == c {
+		b.writer = nil
+	}
+	close(c.out)
+	b.mu.Unlock()
+	c.conn.Close()
+	log.Printf("serial bridge %s: client %s disconnected, rx %d tx %d dropped %d bytes", b.Serial.Params.Name,
+		c.conn.RemoteAddr(), c.rx.Load(), c.tx.Load(), c.dropped.Load())
+}
+
+// send queues bytes that are already telnet encoded.
+func (c *bridgeClient) send(data []byte) {
+	select {
+	case c.out <- data:
+	default:
+		c.dropped.Add(uint64(len(data)))
+	}
+}
+
+// RFC 854 telnet and RFC 2217 com port control.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetBinary  = 0
+	telnetSGA     = 3
+	telnetComPort = 44
+
+	comSetBaudRate  = 1
+	comSetDataSize  = 2
+	comSetParity    = 3
+	comSetStopSize  = 4
+	comSetControl   = 5
+	comPurgeData    = 12
+	comServerOffset = 100
+)
+
+func telnetEscape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			out = append(out, telnetIAC)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+type telnetConn struct {
+	bridge *SerialBridge
+	client *bridgeClient
+	state  int
+	verb   byte
+	sb     []byte
+	agreed map[[2]byte]bool
+}
+
+const (
+	tnData = iota
+	tnIAC
+	tnOption
+	tnSB
+	tnSBIAC
+)
+
+func (t *telnetConn) negotiate() {
+	t.agreed = make(map[[2]byte]bool)
+	var out []byte
+	for _, opt := range []byte{telnetBinary, telnetSGA} {
+		out = append(out, telnetIAC, telnetWILL, opt, telnetIAC, telnetDO, opt)
+		t.agreed[[2]byte{telnetWILL, opt}] = true
+		t.agreed[[2]byte{telnetDO, opt}] = true
+	}
+	out = append(out, telnetIAC, telnetDO, telnetComPort)
+	t.agreed[[2]byte{telnetDO, telnetComPort}] = true
+	t.client.send(out)
+}
+
+// parse strips telnet commands from data, handling them on the way, and
+// returns the remaining payload.
+func (t *telnetConn) parse(data []byte) []byte {
+	out := data[:0:0]
+	for _, b := range data {
+		switch t.state {
+		case tnData:
+			if b == telnetIAC {
+				t.state = tnIAC
+			} else {
+				out = append(out, b)
+			}
+		case tnIAC:
+			switch b {
+			case telnetIAC:
+				out = append(out, b)
+				t.state = tnData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.verb, t.state = b, tnOption
+			case telnetSB:
+				t.sb, t.state = t.sb[:0], tnSB
+			default:
+				t.state = tnData
+			}
+		case tnOption:
+			t.option(t.verb, b)
+			t.state = tnData
+		case tnSB:
+			if b == telnetIAC {
+				t.state = tnSBIAC
+			} else if len(t.sb) < 64 {
+				t.sb = append(t.sb, b)
+			}
+		case tnSBIAC:
+			if b == telnetSE {
+				t.subnegotiation(t.sb)
+				t.state = tnData
+			} else {
+				t.sb = append(t.sb, b)
+				t.state = tnSB
+			}
+		}
+	}
+	return out
+}
+
+// option answers WILL/DO requests: binary, suppress-go-ahead and com port
+// control are accepted, everything else refused. Requests that match the
+// current state are acknowledgments and get no reply, which avoids loops.
+func (t *telnetConn) option(verb, opt byte) {
+	supported := opt == telnetBinary || opt == telnetSGA || opt == telnetComPort
+	var key [2]byte
+	var enable bool
+	switch verb {
+	case telnetWILL, telnetWONT:
+		key, enable = [2]byte{telnetDO, opt}, verb == telnetWILL && supported
+	default:
+		// the server never acts as the com port client
+		key, enable = [2]byte{telnetWILL, opt}, verb == telnetDO && supported && opt != telnetComPort
+	}
+	requested := verb == telnetWILL || verb == telnetDO
+	if requested == t.agreed[key] {
+		return
+	}
+	t.agreed[key] = enable
+	reply := key[0]
+	if !enable {
+		reply++ // DO->DONT, WILL->WONT
+	}
+	t.client.send([]byte{telnetIAC, reply, opt})
+}
+
+func (t *telnetConn) subnegotiation(sb []byte) {
+	if len(sb) < 2 || sb[0] != telnetComPort {
+		return
+	}
+	cmd, value := sb[1], sb[2:]
+	ctx := t.bridge.Serial
+	mode := ctx.Mode()
+	set := false
+	var reply []byte
+	switch cmd {
+	case comSetBaudRate:
+		if len(value) == 4 {
+			if v := binary.BigEndian.Uint32(value); v != 0 {
+				mode.BaudRate, set = int(v), true
+			}
+		}
+		reply = binary.BigEndian.AppendUint32(nil, uint32(mode.BaudRate))
+	case comSetDataSize:
+		if len(value) == 1 && value[0] >= 5 && value[0] <= 8 {
+			mode.DataBits, set = int(value[0]), true
+		}
+		reply = []byte{byte(mode.DataBits)}
+	case comSetParity:
+		if len(value) == 1 && value[0] >= 1 && value[0] <= 5 {
+			mode.Parity, set = serial.Parity(value[0]-1), true
+		}
+		reply = []byte{byte(mode.Parity) + 1}
+	case comSetStopSize:
+		stops := map[byte]serial.StopBits{1: serial.OneStopBit, 2: serial.TwoStopBits, 3: serial.OnePointFiveStopBits}
+		if len(value) == 1 {
+			if s, ok := stops[value[0]]; ok {
+				mode.StopBits, set = s, true
+			}
+		}
+		for k, v := range stops {
+			if v == mode.StopBits {
+				reply = []byte{k}
+			}
+		}
+	case comSetControl:
+		reply = []byte{1}
+		if len(value) == 1 {
+			reply[0] = t.control(value[0])
+		}
+	case comPurgeData:
+		if len(value) == 1 {
+			if port := ctx.port(); port != nil {
+				if value[0]&1 != 0 {
+					_ = port.ResetInputBuffer()
+				}
+				if value[0]&2 != 0 {
+					_ = port.ResetOutputBuffer()
+				}
+			}
+			reply = value
+		}
+	default:
+		// line/modem state notifications are not supported: echo the request
+		reply = value
+	}
+	if set && t.bridge.lockWriter(t.client) {
+		if err := ctx.SetMode(mode); err != nil {
+			log.Warnf("serial bridge %s: failed to set mode:%v", ctx.Params.Name, err)
+		} else {
+			log.Printf("serial bridge %s: client %s changed mode to %+v", ctx.Params.Name, t.client.conn.RemoteAddr(), mode)
+		}
+		mode = ctx.Mode()
+	}
+	out := []byte{telnetIAC, telnetSB, telnetComPort, cmd + comServerOffset}
+	out = append(out, telnetEscape(reply)...)
+	t.client.send(append(out, telnetIAC, telnetSE))
+}
+
+// control handles SET-CONTROL: DTR (8-10) and RTS (11-13) are applied, flow
+// control requests are answered with "no flow control".
+func (t *telnetConn) control(v byte) byte {
+	port := t.bridge.Serial.port()
+	switch v {
+	case 8, 11:
+		return v + 1
+	case 9, 10, 12, 13:
+		if port == nil || !t.bridge.lockWriter(t.client) {
+			return v
+		}
+		var err error
+		switch v {
+		case 9, 10:
+			err = port.SetDTR(v == 9)
+		default:
+			err = port.SetRTS(v == 12)
+		}
+		if err != nil {
+			log.Warnf("serial bridge %s: set control %d failed:%v", t.bridge.Serial.Params.Name, v, err)
+		}
+		return v
+	}
+	return 1
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"system-conf/common/log"
+	"time"
+)
+
+const (
+	CaptureFormatHex  = "hex"
+	CaptureFormatPcap = "pcap"
+
+	DefaultCaptureSize = 1000
+
+	// pcap link type for private use; each packet starts with a direction
+	// byte (0 rx, 1 tx) followed by the serial bytes.
+	pcapLinkTypeUser0 = 147
+)
+
+// CaptureDir is where capture files are written.
+var CaptureDir = filepath.Join(os.TempDir(), "serial-capture")
+
+// CaptureRecord is one chunk of serial traffic.
+type CaptureRecord struct {
+	Seq  uint64
+	Time time.Time
+	Tx   bool
+	Data []byte
+}
+
+func (r *CaptureRecord) Dir() string {
+	if r.Tx {
+		return "tx"
+	}
+	return "rx"
+}
+
+func (r *CaptureRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Seq  uint64    `json:"seq"`
+		Time time.Time `json:"time"`
+		Dir  string    `json:"dir"`
+		Len  int       `json:"len"`
+		Hex  string    `json:"hex"`
+		Text string    `json:"text"`
+	}{r.Seq, r.Time, r.Dir(), len(r.Data), hex.EncodeToString(r.Data), printable(r.Data)})
+}
+
+// String formats the record as one hex-dump line.
+func (r *CaptureRecord) String() string {
+	return fmt.Sprintf("%s %s %4d | % X | %s", r.Time.In(log.BJ).Format("2006-01-02 15:04:05.000000"),
+		strings.ToUpper(r.Dir()), len(r.Data), r.Data, printable(r.Data))
+}
+
+func printable(data []byte) string {
+	buf := make([]byte, len(data))
+	for i, b := range data {
+		if b >= 0x20 && b < 0x7F {
+			buf[i] = b
+		} else {
+			buf[i] = '.'
+		}
+	}
+	return string(buf)
+}
+
+// SerialCaptureConf configures a SerialCapture.
+type SerialCaptureConf struct {
+	// Size is the number of records kept in memory
+	Size int `json:"size" example:"1000"`
+	// File is a file name inside CaptureDir; empty keeps the capture in memory only
+	File string `json:"file,omitempty" example:"ttyS0.pcap"`
+	// Format of the file: hex or pcap
+	Format string `json:"format,omitempty" example:"hex"`
+}
+
+type SerialCaptureInfo struct {
+	SerialCaptureConf
+	Path    string    `json:"path,omitempty"`
+	Since   time.Time `json:"since"`
+	Records uint64    `json:"records"`
+	RxBytes uint64    `json:"rxBytes"`
+	TxBytes uint64    `json:"txBytes"`
+}
+
+// SerialCapture tees the traffic of a SerialCtx into a ring buffer, an
+// optional file and its subscribers.
+type SerialCapture struct {
+	Serial *SerialCtx
+	Conf   SerialCaptureConf
+
+	mu          sync.Mutex
+	tap         *SerialTap
+	ring        []*CaptureRecord
+	next        int
+	seq         uint64
+	rx, tx      uint64
+	since       time.Time
+	path        string
+	file        *os.File
+	w           *bufio.Writer
+	subscribers map[int]func(*CaptureRecord)
+	subId       int
+}
+
+var captures = sync.Map{}
+
+// GetSerialCapture returns the running capture of a SerialCtx, if any.
+func GetSerialCapture(ctx *SerialCtx) *SerialCapture {
+	if v, ok := captures.Load(ctx); ok {
+		return v.(*SerialCapture)
+	}
+	return nil
+}
+
+var ErrCaptureRunning = errors.New("serial capture is already running")
+
+// StartSerialCapture starts capturing the traffic of ctx.
+func StartSerialCapture(ctx *SerialCtx, conf SerialCaptureConf) (c *SerialCapture, err error) {
+	if conf.Size <= 0 {
+		conf.Size = DefaultCaptureSize
+	}
+	if conf.Format == "" {
+		conf.Format = CaptureFormatHex
+	}
+	if conf.Format != CaptureFormatHex && conf.Format != CaptureFormatPcap {
+		return nil, fmt.Errorf("bad capture format:%s", conf.Format)
+	}
+	c = &SerialCapture{
+		Serial:      ctx,
+		Conf:        conf,
+		ring:        make([]*CaptureRecord, 0, conf.Size),
+		since:       time.Now(),
+		subscribers: make(map[int]func(*CaptureRecord)),
+	}
+	if conf.File != "" {
+		if conf.File != filepath.Base(conf.File) || conf.File == "." || conf.File == ".." {
+			return nil, fmt.Errorf("bad capture file name:%s", conf.File)
+		}
+		if err = c.openFile(); err != nil {
+			return nil, err
+		}
+	}
+	if _, loaded := captures.LoadOrStore(ctx, c); loaded {
+		c.closeFile()
+		return nil, ErrCaptureRunning
+	}
+	c.tap = &SerialTap{Fn: c.record}
+	ctx.AddTap(c.tap)
+	log.Printf("serial capture of %s started, file:%s", ctx.Params.Name, c.path)
+	return c, nil
+}
+
+func (c *SerialCapture) openFile() (err error) {
+	if !Exists(CaptureDir) {
+		_ = os.MkdirAll(CaptureDir, os.ModePerm)
+	}
+	c.path = filepath.Join(CaptureDir, c.Conf.File)
+	if c.file, err = os.Create(c.path); err != nil {
+		return
+	}
+	c.w = bufio.NewWriter(c.file)
+	if c.Conf.Format == CaptureFormatPcap {
+		// global header: magic, version 2.4, tz, sigfigs, snaplen, link type
+		hdr := make([]byte, 24)
+		binary.LittleEndian.PutUint32(hdr[0:], 0xa1b23c4d) // nanosecond timestamps
+		binary.LittleEndian.PutUint16(hdr[4:], 2)
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], 65535)
+		binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeUser0)
+		_, err = c.w.Write(hdr)
+	} else {
+		_, err = fmt.Fprintf(c.w, "# serial capture of %s %+v\n", c.Serial.Params.Name, c.Serial.Mode())
+	}
+	return
+}
+
+func (c *SerialCapture) closeFile() {
+	if c.file != nil {
+		_ = c.w.Flush()
+		_ = c.file.Close()
+		c.file, c.w = nil, nil
+	}
+}
+
+// record is the SerialTap callback.
+func (c *SerialCapture) record(tx bool, data []byte) {
+	c.mu.Lock()
+	c.seq++
+	rec := &CaptureRecord{Seq: c.seq, Time: time.Now(), Tx: tx, Data: append([]byte(nil), data...)}
+	if len(c.ring) < c.Conf.Size {
+		c.ring = append(c.ring, rec)
+	} else {
+		c.ring[c.next] = rec
+		c.next = (c.next + 1) % c.Conf.Size
+	}
+	if tx {
+		c.tx += uint64(len(data))
+	} else {
+		c.rx += uint64(len(data))
+	}
+	if c.w != nil {
+		if err := c.write(rec); err != nil {
+			log.Warnf("failed to write serial capture %s: %v", c.path, err)
+			c.closeFile()
+		}
+	}
+	subscribers := make([]func(*CaptureRecord), 0, len(c.subscribers))
+	for _, fn := range c.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	c.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(rec)
+	}
+}
+
+func (c *SerialCapture) write(rec *CaptureRecord) (err error) {
+	if c.Conf.Format == CaptureFormatPcap {
+		hdr := make([]byte, 16, 17)
+		ns := rec.Time.UnixNano()
+		binary.LittleEndian.PutUint32(hdr[0:], uint32(ns/1e9))
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(ns%1e9))
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len(rec.Data)+1))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(len(rec.Data)+1))
+		dir := byte(0)
+		if rec.Tx {
+			dir = 1
+		}
+		if _, err = c.w.Write(append(hdr, dir)); err == nil {
+			_, err = c.w.Write(rec.Data)
+		}
+	} else {
+		_, err = fmt.Fprintln(c.w, rec.String())
+	}
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return
+}
+
+// Records returns up to limit of the most recent records, oldest first; a
+// limit <= 0 returns the whole ring.
+func (c *SerialCapture) Records(limit int) []*CaptureRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := make([]*CaptureRecord, 0, len(c.ring))
+	records = append(records, c.ring[c.next:]...)
+	records = append(records, c.ring[:c.next]...)
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records
+}
+
+// Subscribe calls fn for every new record until the returned function is
+// called. fn runs on the reading goroutine of the port and must not block.
+func (c *SerialCapture) Subscribe(fn func(*CaptureRecord)) (cancel func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subId++
+	id := c.subId
+	c.subscribers[id] = fn
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subscribers, id)
+	}
+}
+
+func (c *SerialCapture) Info() *SerialCaptureInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &SerialCaptureInfo{
+		SerialCaptureConf: c.Conf,
+		Path:              c.path,
+		Since:             c.since,
+		Records:           c.seq,
+		RxBytes:           c.rx,
+		TxBytes:           c.tx,
+	}
+}
+
+// Path is the capture file, empty if the capture is kept in memory only.
+func (c *SerialCapture) Path() string {
+	return c.path
+}
+
+func (c *SerialCapture) Stop() {
+	c.Serial.RemoveTap(c.tap)
+	captures.CompareAndDelete(c.Serial, c)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeFile()
+	log.Printf("serial capture of %s stopped, %d records", c.Serial.Params.Name, c.seq)
+}
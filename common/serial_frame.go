@@ -0,0 +1,428 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"system-conf/common/log"
+	"time"
+)
+
+// FrameDecoder turns the arbitrary chunks read from a serial port into
+// complete frames. Decoders strip their framing, so that the matching
+// FrameEncoder applied to a decoded frame yields the bytes on the wire.
+type FrameDecoder interface {
+	// Decode consumes received bytes and returns the frames they complete.
+	Decode(data []byte) [][]byte
+	// Flush is called when the line has been idle for SerialCtx.IdleTimeout.
+	Flush() [][]byte
+	Reset()
+}
+
+// FrameEncoder adds the framing for a frame to be written.
+type FrameEncoder interface {
+	Encode(frame []byte) ([]byte, error)
+}
+
+// FrameCodec is a decoder and the encoder for the same framing.
+type FrameCodec interface {
+	FrameDecoder
+	FrameEncoder
+}
+
+// idleGapper is implemented by decoders that need the read loop to wake up
+// on line silence.
+type idleGapper interface {
+	IdleGap() time.Duration
+}
+
+// DefaultMaxFrame bounds the buffered bytes of a decoder whose MaxLen is 0.
+const DefaultMaxFrame = 4096
+
+var ErrFrameTooLong = errors.New("frame exceeds the maximum length")
+
+func maxFrame(n int) int {
+	if n <= 0 {
+		return DefaultMaxFrame
+	}
+	return n
+}
+
+// consume drops the first n bytes of buf, moving the rest to the front so
+// the backing array of a long-running port does not keep growing.
+func consume(buf []byte, n int) []byte {
+	return buf[:copy(buf, buf[n:])]
+}
+
+// DelimiterCodec splits frames at Delim, e.g. "\r\n" for text protocols.
+// Bytes beyond MaxLen without a delimiter are discarded.
+type DelimiterCodec struct {
+	Delim  []byte
+	MaxLen int
+	buf    []byte
+}
+
+func NewDelimiterCodec(delim []byte, maxLen int) *DelimiterCodec {
+	return &DelimiterCodec{Delim: delim, MaxLen: maxLen}
+}
+
+func (d *DelimiterCodec) Decode(data []byte) (frames [][]byte) {
+	d.buf = append(d.buf, data...)
+	start := 0
+	for len(d.Delim) > 0 {
+		i := bytes.Index(d.buf[start:], d.Delim)
+		if i < 0 {
+			break
+		}
+		frames = append(frames, append([]byte(nil), d.buf[start:start+i]...))
+		start += i + len(d.Delim)
+	}
+	d.buf = consume(d.buf, start)
+	if len(d.buf) > maxFrame(d.MaxLen) {
+		d.buf = d.buf[:0]
+	}
+	return
+}
+
+func (d *DelimiterCodec) Flush() [][]byte { return nil }
+func (d *DelimiterCodec) Reset()          { d.buf = nil }
+
+func (d *DelimiterCodec) Encode(frame []byte) ([]byte, error) {
+	if len(frame) > maxFrame(d.MaxLen) {
+		return nil, ErrFrameTooLong
+	}
+	return append(append([]byte(nil), frame...), d.Delim...), nil
+}
+
+// FixedLengthCodec splits the stream into frames of Size bytes. A partial
+// frame is dropped when the line goes idle for Gap, which resynchronizes
+// after a lost byte; a zero Gap never drops.
+type FixedLengthCodec struct {
+	Size int
+	Gap  time.Duration
+	buf  []byte
+}
+
+func NewFixedLengthCodec(size int) *FixedLengthCodec {
+	return &FixedLengthCodec{Size: size}
+}
+
+func (d *FixedLengthCodec) IdleGap() time.Duration { return d.Gap }
+
+func (d *FixedLengthCodec) Decode(data []byte) (frames [][]byte) {
+	if d.Size <= 0 {
+		return nil
+	}
+	d.buf = append(d.buf, data...)
+	start := 0
+	for len(d.buf)-start >= d.Size {
+		frames = append(frames, append([]byte(nil), d.buf[start:start+d.Size]...))
+		start += d.Size
+	}
+	d.buf = consume(d.buf, start)
+	return
+}
+
+func (d *FixedLengthCodec) Flush() [][]byte {
+	if d.Gap > 0 {
+		d.buf = nil
+	}
+	return nil
+}
+func (d *FixedLengthCodec) Reset() { d.buf = nil }
+
+func (d *FixedLengthCodec) Encode(frame []byte) ([]byte, error) {
+	if len(frame) != d.Size {
+		return nil, errors.New("frame length does not match the fixed size")
+	}
+	return frame, nil
+}
+
+// LengthPrefixCodec reads frames whose length is carried in a header field:
+// Offset bytes of header, then a Size byte (1, 2 or 4) length field. The
+// field counts the bytes following it, plus Adjust. Decoded frames are the
+// header followed by the body, without the length field.
+type LengthPrefixCodec struct {
+	Offset    int
+	Size      int
+	BigEndian bool
+	Adjust    int
+	MaxLen    int
+	buf       []byte
+}
+
+func NewLengthPrefixCodec(size int, bigEndian bool) *LengthPrefixCodec {
+	return &LengthPrefixCodec{Size: size, BigEndian: bigEndian}
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+func (d *LengthPrefixCodec) order() byteOrder {
+	if d.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (d *LengthPrefixCodec) Decode(data []byte) (frames [][]byte) {
+	d.buf = append(d.buf, data...)
+	head := d.Offset + d.Size
+	start := 0
+	defer func() { d.buf = consume(d.buf, start) }()
+	for len(d.buf)-start >= head {
+		var n int
+		buf := d.buf[start:]
+		field := buf[d.Offset:head]
+		switch d.Size {
+		case 1:
+			n = int(field[0])
+		case 2:
+			n = int(d.order().Uint16(field))
+		case 4:
+			n = int(d.order().Uint32(field))
+		default:
+			start = len(d.buf)
+			return
+		}
+		n -= d.Adjust
+		if n < 0 || head+n > maxFrame(d.MaxLen) {
+			// not a valid header: resynchronize one byte later
+			start++
+			continue
+		}
+		if len(buf) < head+n {
+			break
+		}
+		frame := make([]byte, 0, d.Offset+n)
+		frame = append(frame, buf[:d.Offset]...)
+		frames = append(frames, append(frame, buf[head:head+n]...))
+		start += head + n
+	}
+	return
+}
+
+func (d *LengthPrefixCodec) Flush() [][]byte { return nil }
+func (d *LengthPrefixCodec) Reset()          { d.buf = nil }
+
+func (d *LengthPrefixCodec) Encode(frame []byte) ([]byte, error) {
+	if len(frame) < d.Offset {
+		return nil, ErrBadFrame
+	}
+	n := len(frame) - d.Offset
+	if d.Offset+d.Size+n > maxFrame(d.MaxLen) {
+		return nil, ErrFrameTooLong
+	}
+	v := uint64(n + d.Adjust)
+	out := append([]byte(nil), frame[:d.Offset]...)
+	switch d.Size {
+	case 1:
+		if v > 0xFF {
+			return nil, ErrFrameTooLong
+		}
+		out = append(out, byte(v))
+	case 2:
+		if v > 0xFFFF {
+			return nil, ErrFrameTooLong
+		}
+		out = d.order().AppendUint16(out, uint16(v))
+	case 4:
+		out = d.order().AppendUint32(out, uint32(v))
+	default:
+		return nil, errors.New("length field size must be 1, 2 or 4")
+	}
+	return append(out, frame[d.Offset:]...), nil
+}
+
+var ErrBadFrame = errors.New("malformed frame")
+
+// StartEndCodec reads frames between a Start and End byte. Inside a frame,
+// Escape followed by b stands for b^EscapeXor, so Start, End and Escape can
+// appear in the data (HDLC style with Escape 0x7D and EscapeXor 0x20). A
+// zero Escape disables escaping. Bytes outside frames are ignored.
+type StartEndCodec struct {
+	Start, End byte
+	Escape     byte
+	EscapeXor  byte
+	MaxLen     int
+
+	buf     []byte
+	inFrame bool
+	escaped bool
+}
+
+func NewStartEndCodec(start, end, escape, xor byte) *StartEndCodec {
+	return &StartEndCodec{Start: start, End: end, Escape: escape, EscapeXor: xor}
+}
+
+func (d *StartEndCodec) Decode(data []byte) (frames [][]byte) {
+	for _, b := range data {
+		switch {
+		case !d.inFrame:
+			if b == d.Start {
+				d.inFrame = true
+				d.buf = d.buf[:0]
+			}
+		case d.escaped:
+			d.escaped = false
+			d.buf = append(d.buf, b^d.EscapeXor)
+		case d.Escape != 0 && b == d.Escape:
+			d.escaped = true
+		case b == d.End:
+			if d.Start != d.End {
+				d.inFrame = false
+			} else if len(d.buf) == 0 {
+				// back to back flags
+				continue
+			}
+			// with Start == End, as in HDLC, the flag also opens the next
+			// frame
+			frames = append(frames, append([]byte(nil), d.buf...))
+			d.buf = d.buf[:0]
+		case b == d.Start:
+			// unterminated frame: restart
+			d.buf = d.buf[:0]
+		default:
+			d.buf = append(d.buf, b)
+		}
+		if len(d.buf) > maxFrame(d.MaxLen) {
+			d.Reset()
+		}
+	}
+	return
+}
+
+func (d *StartEndCodec) Flush() [][]byte { return nil }
+func (d *StartEndCodec) Reset() {
+	d.buf = d.buf[:0]
+	d.inFrame = false
+	d.escaped = false
+}
+
+func (d *StartEndCodec) Encode(frame []byte) ([]byte, error) {
+	if len(frame) > maxFrame(d.MaxLen) {
+		return nil, ErrFrameTooLong
+	}
+	out := make([]byte, 0, len(frame)+2)
+	out = append(out, d.Start)
+	for _, b := range frame {
+		if d.Escape != 0 && (b == d.Start || b == d.End || b == d.Escape) {
+			out = append(out, d.Escape, b^d.EscapeXor)
+		} else if d.Escape == 0 && (b == d.Start || b == d.End) {
+			return nil, ErrBadFrame
+		} else {
+			out = append(out, b)
+		}
+	}
+	return append(out, d.End), nil
+}
+
+// IdleGapCodec treats every burst of bytes followed by Gap of silence as a
+// frame, like Modbus RTU does with its 3.5 character gap.
+type IdleGapCodec struct {
+	Gap    time.Duration
+	MaxLen int
+	buf    []byte
+	last   time.Time
+}
+
+func NewIdleGapCodec(gap time.Duration) *IdleGapCodec {
+	return &IdleGapCodec{Gap: gap}
+}
+
+func (d *IdleGapCodec) IdleGap() time.Duration { return d.Gap }
+
+func (d *IdleGapCodec) Decode(data []byte) (frames [][]byte) {
+	now := time.Now()
+	if len(d.buf) > 0 && now.Sub(d.last) >= d.Gap {
+		frames = d.Flush()
+	}
+	d.last = now
+	d.buf = append(d.buf, data...)
+	if len(d.buf) >= maxFrame(d.MaxLen) {
+		frames = append(frames, d.Flush()...)
+	}
+	return
+}
+
+func (d *IdleGapCodec) Flush() [][]byte {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	frame := d.buf
+	d.buf = nil
+	return [][]byte{frame}
+}
+func (d *IdleGapCodec) Reset() { d.buf = nil }
+
+func (d *IdleGapCodec) Encode(frame []byte) ([]byte, error) {
+	return frame, nil
+}
+
+// RunFramed runs the port like RunAsSlave, but hands cb complete frames
+// from dec. Replies are framed with enc when it is not nil. Decoders with
+// an idle gap set IdleTimeout unless it was set already.
+func (ctx *SerialCtx) RunFramed(dec FrameDecoder, enc FrameEncoder, cb func(frame []byte) []byte) {
+	if g, ok := dec.(idleGapper); ok && g.IdleGap() > 0 && ctx.IdleTimeout == 0 {
+		ctx.IdleTimeout = g.IdleGap()
+	}
+	dec.Reset()
+	ctx.RunAsSlave(func(data []byte) []byte {
+		var frames [][]byte
+		if len(data) == 0 {
+			frames = dec.Flush()
+		} else {
+			frames = dec.Decode(data)
+		}
+		var out []byte
+		for _, frame := range frames {
+			reply := cb(frame)
+			if len(reply) == 0 {
+				continue
+			}
+			if enc != nil {
+				var err error
+				if reply, err = enc.Encode(reply); err != nil {
+					log.Warnf("failed to encode serial frame:%v", err)
+					continue
+				}
+			}
+			out = append(out, reply...)
+		}
+		return out
+	})
+}
+
+// WriteFrame frames data with enc and writes it to the open port.
+func (ctx *SerialCtx) WriteFrame(enc FrameEncoder, data []byte) error {
+	if enc != nil {
+		var err error
+		if data, err = enc.Encode(data); err != nil {
+			return err
+		}
+	}
+	_, err := ctx.Write(data)
+	return err
+}
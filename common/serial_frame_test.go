@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// fakePort is an in-memory serial.Port: chunks sent on rx are returned by
+// Read as they come, writes go to tx. Read returns no data after timeout,
+// like a port with a read timeout, and io.EOF once closed.
+type fakePort struct {
+	rx      chan []byte
+	tx      chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	timeout time.Duration
+	pending []byte
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{rx: make(chan []byte, 16), tx: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (p *fakePort) Read(buf []byte) (int, error) {
+	if len(p.pending) == 0 {
+		var timeout <-chan time.Time
+		if p.timeout > 0 {
+			timeout = time.After(p.timeout)
+		}
+		select {
+		case p.pending = <-p.rx:
+		case <-timeout:
+			return 0, nil
+		case <-p.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(buf, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *fakePort) Write(data []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	case p.tx <- append([]byte(nil), data...):
+		return len(data), nil
+	}
+}
+
+func (p *fakePort) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *fakePort) SetMode(mode *serial.Mode) error { return nil }
+func (p *fakePort) Drain() error                    { return nil }
+func (p *fakePort) ResetInputBuffer() error         { return nil }
+func (p *fakePort) ResetOutputBuffer() error        { return nil }
+func (p *fakePort) SetDTR(dtr bool) error           { return nil }
+func (p *fakePort) SetRTS(rts bool) error           { return nil }
+func (p *fakePort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+func (p *fakePort) SetReadTimeout(t time.Duration) error { p.timeout = t; return nil }
+func (p *fakePort) Break(time.Duration) error            { return nil }
+
+func (p *fakePort) expectWrite(t *testing.T, want []byte) {
+	t.Helper()
+	select {
+	case got := <-p.tx:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("wrote %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("nothing written, want %q", want)
+	}
+}
+
+// decodeAll feeds chunks one after the other and collects the frames.
+func decodeAll(dec FrameDecoder, chunks ...[]byte) (frames [][]byte) {
+	for _, c := range chunks {
+		frames = append(frames, dec.Decode(c)...)
+	}
+	return
+}
+
+// bytewise splits data into one chunk per byte.
+func bytewise(data []byte) (chunks [][]byte) {
+	for i := range data {
+		chunks = append(chunks, data[i:i+1])
+	}
+	return
+}
+
+func expectFrames(t *testing.T, got [][]byte, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames %q, want %q", len(got), got, want)
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Fatalf("frame %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDelimiterCodec(t *testing.T) {
+	d := NewDelimiterCodec([]byte("\r\n"), 0)
+	expectFrames(t, decodeAll(d, []byte("ab\r"), []byte("\ncd\r\nef\r\n"), []byte("g")), "ab", "cd", "ef")
+	expectFrames(t, d.Decode([]byte("h\r\n")), "gh")
+	expectFrames(t, decodeAll(d, bytewise([]byte("one\r\ntwo\r\n"))...), "one", "two")
+
+	out, err := d.Encode([]byte("x"))
+	if err != nil || string(out) != "x\r\n" {
+		t.Fatalf("Encode = %q, %v", out, err)
+	}
+}
+
+func TestDelimiterCodecTooLong(t *testing.T) {
+	d := NewDelimiterCodec([]byte("\n"), 4)
+	expectFrames(t, decodeAll(d, []byte("abcdefgh")))
+	expectFrames(t, d.Decode([]byte("xy\n")), "xy")
+	if _, err := d.Encode([]byte("abcde")); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("Encode = %v, want ErrFrameTooLong", err)
+	}
+}
+
+// backing returns the start of the array behind buf.
+func backing(buf []byte) *byte {
+	return &buf[:cap(buf)][0]
+}
+
+// A long-running port must keep reusing the decoder's buffer instead of
+// moving along a growing array.
+func TestDelimiterCodecReusesBuffer(t *testing.T) {
+	d := NewDelimiterCodec([]byte("\n"), 0)
+	d.Decode([]byte("frame\nfr"))
+	first := backing(d.buf)
+	for i := 0; i < 1000; i++ {
+		d.Decode([]byte("ame\nfr"))
+		if backing(d.buf) != first {
+			t.Fatalf("buffer moved after %d frames", i)
+		}
+	}
+}
+
+func TestFixedLengthCodec(t *testing.T) {
+	d := NewFixedLengthCodec(3)
+	expectFrames(t, decodeAll(d, []byte("ab"), []byte("cdefg"), []byte("h")), "abc", "def")
+	expectFrames(t, d.Decode([]byte("i")), "ghi")
+	if _, err := d.Encode([]byte("ab")); err == nil {
+		t.Fatal("Encode of a short frame succeeded")
+	}
+
+	// without a gap a partial frame survives silence, with one it is dropped
+	expectFrames(t, decodeAll(d, []byte("ab")))
+	d.Flush()
+	expectFrames(t, d.Decode([]byte("c")), "abc")
+	d.Gap = 10 * time.Millisecond
+	d.Decode([]byte("ab"))
+	d.Flush()
+	expectFrames(t, d.Decode([]byte("xyz")), "xyz")
+	d.Decode([]byte("12345"))
+	first := backing(d.buf)
+	for i := 0; i < 1000; i++ {
+		d.Decode([]byte("6"))
+		d.Decode([]byte("12345"))
+		if backing(d.buf) != first {
+			t.Fatalf("buffer moved after %d frames", i)
+		}
+	}
+}
+
+func TestLengthPrefixCodec(t *testing.T) {
+	// one address byte, then a big endian 16 bit length of the body
+	d := &LengthPrefixCodec{Offset: 1, Size: 2, BigEndian: true, MaxLen: 32}
+	wire, err := d.Encode([]byte("\x05hello"))
+	if err != nil || !bytes.Equal(wire, []byte("\x05\x00\x05hello")) {
+		t.Fatalf("Encode = %q, %v", wire, err)
+	}
+	expectFrames(t, decodeAll(d, bytewise(append(append([]byte(nil), wire...), wire...))...), "\x05hello", "\x05hello")
+	expectFrames(t, decodeAll(d, wire[:4], wire[4:]), "\x05hello")
+
+	// a length beyond MaxLen is no header: skip to the next valid one
+	expectFrames(t, decodeAll(d, append([]byte("\x01\xff\xff"), wire...)), "\x05hello")
+	if _, err := d.Encode(make([]byte, 40)); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("Encode = %v, want ErrFrameTooLong", err)
+	}
+	if _, err := (&LengthPrefixCodec{Size: 1}).Encode(make([]byte, 300)); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("Encode of 300 bytes with a 1 byte length = %v, want ErrFrameTooLong", err)
+	}
+}
+
+func TestLengthPrefixCodecAdjust(t *testing.T) {
+	// little endian length that also counts a 2 byte trailer
+	d := &LengthPrefixCodec{Size: 1, Adjust: 2}
+	wire, err := d.Encode([]byte("ab"))
+	if err != nil || !bytes.Equal(wire, []byte("\x04ab")) {
+		t.Fatalf("Encode = %q, %v", wire, err)
+	}
+	expectFrames(t, d.Decode(wire), "ab")
+}
+
+func TestStartEndCodecEscaping(t *testing.T) {
+	d := NewStartEndCodec(0x7E, 0x7E, 0x7D, 0x20)
+	frame := []byte{0x01, 0x7E, 0x02, 0x7D, 0x03}
+	wire, err := d.Encode(frame)
+	want := []byte{0x7E, 0x01, 0x7D, 0x5E, 0x02, 0x7D, 0x5D, 0x03, 0x7E}
+	if err != nil || !bytes.Equal(wire, want) {
+		t.Fatalf("Encode = % x, %v, want % x", wire, err, want)
+	}
+	expectFrames(t, decodeAll(d, bytewise(wire)...), string(frame))
+	// noise before the first flag and back to back delimiters
+	d.Reset()
+	expectFrames(t, decodeAll(d, []byte{0x11, 0x22}, wire, wire), string(frame), string(frame))
+	// an escape split across reads
+	d.Reset()
+	expectFrames(t, decodeAll(d, wire[:3], wire[3:]), string(frame))
+	// frames sharing one flag, also split before and after it
+	d.Reset()
+	expectFrames(t, decodeAll(d, []byte{0x7E, 'A', 0x7E, 'B', 0x7E}), "A", "B")
+	expectFrames(t, decodeAll(d, []byte{0x7E, 'C'}, []byte{0x7E}, []byte{'D', 0x7E}), "C", "D")
+}
+
+func TestStartEndCodecWithoutEscape(t *testing.T) {
+	d := &StartEndCodec{Start: '<', End: '>', MaxLen: 4}
+	expectFrames(t, decodeAll(d, []byte("x<ab"), []byte("c><d<ef>")), "abc", "ef")
+	if _, err := d.Encode([]byte("a>b")); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("Encode of an End byte = %v, want ErrBadFrame", err)
+	}
+	// an oversize frame is dropped and the next one decodes
+	expectFrames(t, decodeAll(d, []byte("<abcdefgh>"), []byte("<ok>")), "ok")
+	if _, err := d.Encode([]byte("abcde")); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("Encode = %v, want ErrFrameTooLong", err)
+	}
+}
+
+func TestIdleGapCodec(t *testing.T) {
+	d := NewIdleGapCodec(20 * time.Millisecond)
+	expectFrames(t, decodeAll(d, []byte("ab"), []byte("c")))
+	time.Sleep(30 * time.Millisecond)
+	expectFrames(t, d.Decode([]byte("d")), "abc")
+	expectFrames(t, d.Flush(), "d")
+	expectFrames(t, d.Flush())
+
+	d.MaxLen = 4
+	expectFrames(t, decodeAll(d, []byte("12"), []byte("345")), "12345")
+}
+
+func TestRunFramed(t *testing.T) {
+	port := newFakePort()
+	ctx := NewSerialCtx(&SerialParams{})
+	ctx.Port = port
+	ctx.RunFramed(NewDelimiterCodec([]byte("\n"), 0), NewDelimiterCodec([]byte("\r\n"), 0), func(frame []byte) []byte {
+		return bytes.ToUpper(frame)
+	})
+	defer ctx.Stop()
+	port.rx <- []byte("hel")
+	port.rx <- []byte("lo\nwor")
+	port.expectWrite(t, []byte("HELLO\r\n"))
+	port.rx <- []byte("ld\nx\n")
+	port.expectWrite(t, []byte("WORLD\r\nX\r\n"))
+}
+
+func TestRunFramedIdleGap(t *testing.T) {
+	port := newFakePort()
+	port.timeout = 20 * time.Millisecond
+	ctx := NewSerialCtx(&SerialParams{})
+	ctx.Port = port
+	frames := make(chan []byte, 4)
+	ctx.RunFramed(NewIdleGapCodec(port.timeout), nil, func(frame []byte) []byte {
+		frames <- frame
+		return nil
+	})
+	defer ctx.Stop()
+	if ctx.IdleTimeout != port.timeout {
+		t.Fatalf("IdleTimeout = %v, want the codec's gap", ctx.IdleTimeout)
+	}
+	port.rx <- []byte{1, 2}
+	port.rx <- []byte{3}
+	select {
+	case f := <-frames:
+		if !bytes.Equal(f, []byte{1, 2, 3}) {
+			t.Fatalf("frame = % x", f)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame after the line went idle")
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	ctx := NewSerialCtx(&SerialParams{})
+	enc := NewStartEndCodec(0x02, 0x03, 0x10, 0x20)
+	if err := ctx.WriteFrame(enc, []byte("x")); !errors.Is(err, ErrSerialClosed) {
+		t.Fatalf("WriteFrame on a closed port = %v, want ErrSerialClosed", err)
+	}
+	port := newFakePort()
+	ctx.Port = port
+	if err := ctx.WriteFrame(enc, []byte{'a', 0x03}); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	port.expectWrite(t, []byte{0x02, 'a', 0x10, 0x23, 0x03})
+	if err := ctx.WriteFrame(NewFixedLengthCodec(4), []byte("abc")); err == nil {
+		t.Fatal("WriteFrame of an unencodable frame succeeded")
+	}
+	if err := ctx.WriteFrame(nil, []byte("raw")); err != nil {
+		t.Fatalf("WriteFrame without encoder: %v", err)
+	}
+	port.expectWrite(t, []byte("raw"))
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"system-conf/common/log"
+	"time"
+)
+
+// SerialByIdDir holds the stable symlinks udev creates for serial devices.
+const SerialByIdDir = "/dev/serial/by-id"
+
+const (
+	SerialConnect    = "connect"
+	SerialDisconnect = "disconnect"
+
+	hotplugDebounce = 500 * time.Millisecond
+	hotplugRescan   = 10 * time.Second
+)
+
+// SerialPortMatch identifies a port by stable attributes instead of its
+// device name. Every non-empty field must match.
+type SerialPortMatch struct {
+	ById         string `json:"byId,omitempty" example:"/dev/serial/by-id/usb-FTDI_FT232R_USB_UART_A50285BI-if00-port0"`
+	VID          string `json:"vid,omitempty" example:"0403"`
+	PID          string `json:"pid,omitempty" example:"6001"`
+	SerialNumber string `json:"serialNumber,omitempty" example:"A50285BI"`
+}
+
+func (p *SerialPortMatch) IsEmpty() bool {
+	return p.ById == "" && p.VID == "" && p.PID == "" && p.SerialNumber == ""
+}
+
+func (p *SerialPortMatch) Match(info *SerialPortInfo) bool {
+	if p.IsEmpty() || !info.Present {
+		return false
+	}
+	if p.ById != "" && p.ById != info.ById && filepath.Join(SerialByIdDir, p.ById) != info.ById {
+		return false
+	}
+	return (p.VID == "" || strings.EqualFold(p.VID, info.VID)) &&
+		(p.PID == "" || strings.EqualFold(p.PID, info.PID)) &&
+		(p.SerialNumber == "" || p.SerialNumber == info.SerialNumber)
+}
+
+// SerialHotplugEvent reports a serial device that appeared or went away.
+type SerialHotplugEvent struct {
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Port *SerialPortInfo `json:"port"`
+	// Conf is the configured port the device belongs to, if any
+	Conf string `json:"conf,omitempty"`
+}
+
+// serialByIdLinks maps device paths to their /dev/serial/by-id symlink.
+func serialByIdLinks() map[string]string {
+	links := make(map[string]string)
+	entries, err := os.ReadDir(SerialByIdDir)
+	if err != nil {
+		return links
+	}
+	for _, e := range entries {
+		link := filepath.Join(SerialByIdDir, e.Name())
+		if target, err := filepath.EvalSymlinks(link); err == nil {
+			links[target] = link
+		}
+	}
+	return links
+}
+
+// resolveMatch returns the device currently matching p.
+func resolveMatch(p *SerialPortMatch) (string, error) {
+	if p.ById != "" && p.VID == "" && p.PID == "" && p.SerialNumber == "" {
+		link := p.ById
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(SerialByIdDir, link)
+		}
+		return filepath.EvalSymlinks(link)
+	}
+	ports, err := enumeratePorts()
+	if err != nil {
+		return "", err
+	}
+	for _, info := range ports {
+		if p.Match(info) {
+			return info.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no serial device matches %+v", *p)
+}
+
+// OnHotplug registers fn to be called for every hotplug event until the
+// returned function is called.
+func (m *SerialManager) OnHotplug(fn func(*SerialHotplugEvent)) (cancel func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hotplugId++
+	id := m.hotplugId
+	m.hotplugSubs[id] = fn
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.hotplugSubs, id)
+	}
+}
+
+// StartHotplug watches for serial devices being plugged in or removed,
+// using kernel uevents or inotify where available and a periodic rescan
+// otherwise. Ports that match a new device are reopened at once.
+func (m *SerialManager) StartHotplug() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hotplugStop != nil {
+		return
+	}
+	m.hotplugStop = make(chan struct{})
+	go m.hotplugLoop(m.hotplugStop)
+}
+
+func (m *SerialManager) StopHotplug() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hotplugStop != nil {
+		close(m.hotplugStop)
+		m.hotplugStop = nil
+	}
+}
+
+func (m *SerialManager) hotplugLoop(stop chan struct{}) {
+	trigger := make(chan struct{}, 1)
+	go func() {
+		err := watchHotplug(stop, func() {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			log.Warnf("serial hotplug notifications unavailable, polling every %v: %v", hotplugRescan, err)
+		}
+	}()
+	known, _ := enumeratePorts()
+	ticker := time.NewTicker(hotplugRescan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-trigger:
+			// let udev finish creating device nodes and links
+			select {
+			case <-stop:
+				return
+			case <-time.After(hotplugDebounce):
+			}
+		case <-ticker.C:
+		}
+		ports, err := enumeratePorts()
+		if err != nil {
+			log.Warnf("failed to enumerate serial ports: %v", err)
+			continue
+		}
+		for name, info := range known {
+			if _, ok := ports[name]; !ok {
+				m.hotplug(&SerialHotplugEvent{Type: SerialDisconnect, Time: time.Now(), Port: info})
+			}
+		}
+		for name, info := range ports {
+			if _, ok := known[name]; !ok {
+				m.hotplug(&SerialHotplugEvent{Type: SerialConnect, Time: time.Now(), Port: info})
+			}
+		}
+		known = ports
+	}
+}
+
+func (m *SerialManager) hotplug(ev *SerialHotplugEvent) {
+	m.mu.Lock()
+	for name, conf := range m.confs {
+		if name == ev.Port.Name || conf.Match != nil && conf.Match.Match(ev.Port) {
+			ev.Conf = name
+			break
+		}
+	}
+	if ctx, ok := m.ctxs[ev.Conf]; ok {
+		if ev.Type == SerialConnect {
+			ctx.Reopen()
+		} else if !ctx.IsRunning() && ctx.Device() == ev.Port.Name {
+			// drop the stale handle so the next request reopens the device
+			ctx.ClosePort()
+		}
+	}
+	subs := make([]func(*SerialHotplugEvent), 0, len(m.hotplugSubs))
+	for _, fn := range m.hotplugSubs {
+		subs = append(subs, fn)
+	}
+	m.mu.Unlock()
+	log.Printf("serial device %s %s (conf:%s vid:%s pid:%s sn:%s)", ev.Port.Name, ev.Type, ev.Conf,
+		ev.Port.VID, ev.Port.PID, ev.Port.SerialNumber)
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
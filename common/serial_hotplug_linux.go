@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+)
+
+// watchHotplug calls trigger for tty uevents from the kernel, falling back
+// to inotify on /dev, until stop is closed.
+func watchHotplug(stop chan struct{}, trigger func()) error {
+	f, isUevent, err := openUevents()
+	if err != nil {
+		if f, err = openDevInotify(); err != nil {
+			return err
+		}
+	}
+	go func() {
+		<-stop
+		f.Close()
+	}()
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return nil
+		}
+		if !isUevent || isTtyUevent(buf[:n]) {
+			trigger()
+		}
+	}
+}
+
+// openUevents subscribes to the kernel uevent multicast group.
+func openUevents() (*os.File, bool, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, false, err
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, false, err
+	}
+	return os.NewFile(uintptr(fd), "uevent"), true, nil
+}
+
+func openDevInotify() (*os.File, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = syscall.InotifyAddWatch(fd, "/dev", syscall.IN_CREATE|syscall.IN_DELETE); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "inotify"), nil
+}
+
+// isTtyUevent checks a "ACTION@DEVPATH\0KEY=VALUE\0..." message for the tty
+// and usb-serial subsystems.
+func isTtyUevent(msg []byte) bool {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if v, ok := bytes.CutPrefix(field, []byte("SUBSYSTEM=")); ok {
+			return bytes.Equal(v, []byte("tty")) || bytes.Equal(v, []byte("usb-serial"))
+		}
+	}
+	return false
+}
@@ -0,0 +1,477 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"system-conf/common/log"
+)
+
+var parityNames = map[serial.Parity]string{
+	serial.NoParity:    "none",
+	serial.OddParity:   "odd",
+	serial.EvenParity:  "even",
+	serial.MarkParity:  "mark",
+	serial.SpaceParity: "space",
+}
+var stopBitsNames = map[serial.StopBits]string{
+	serial.OneStopBit:           "1",
+	serial.OnePointFiveStopBits: "1.5",
+	serial.TwoStopBits:          "2",
+}
+
+// SerialPortConf is the persisted, human readable form of SerialParams.
+type SerialPortConf struct {
+	Name     string `json:"name" example:"/dev/ttyS0"`
+	Alias    string `json:"alias,omitempty" example:"rs485-1"`
+	BaudRate int    `json:"baudRate" example:"9600"`
+	DataBits int    `json:"dataBits" example:"8"`
+	Parity   string `json:"parity" example:"none"`
+	StopBits string `json:"stopBits" example:"1"`
+	Enabled  bool   `json:"enabled"`
+
+	Bridge *SerialBridgeConf `json:"bridge,omitempty"`
+	// Match opens whichever device matches instead of Name, so the port
+	// survives USB adapters being renumbered
+	Match *SerialPortMatch `json:"match,omitempty"`
+}
+
+func DefaultSerialPortConf(name string) *SerialPortConf {
+	return &SerialPortConf{Name: name, BaudRate: 9600, DataBits: 8, Parity: "none", StopBits: "1"}
+}
+
+func NewSerialPortConf(params *SerialParams) *SerialPortConf {
+	return &SerialPortConf{
+		Name:     params.Name,
+		BaudRate: params.BaudRate,
+		DataBits: params.DataBits,
+		Parity:   parityNames[params.Parity],
+		StopBits: stopBitsNames[params.StopBits],
+		Enabled:  params.Enabled,
+	}
+}
+
+func (c *SerialPortConf) clone() *SerialPortConf {
+	cc := *c
+	if c.Bridge != nil {
+		b := *c.Bridge
+		cc.Bridge = &b
+	}
+	if c.Match != nil {
+		p := *c.Match
+		cc.Match = &p
+	}
+	return &cc
+}
+
+// ToParams validates the configuration and converts it to SerialParams.
+func (c *SerialPortConf) ToParams() (params *SerialParams, err error) {
+	params = &SerialParams{Name: c.Name, Enabled: c.Enabled}
+	if c.Name == "" {
+		return nil, fmt.Errorf("port name is empty")
+	}
+	if c.Bridge != nil && c.Bridge.Enabled && c.Bridge.Listen == "" {
+		return nil, fmt.Errorf("bridge listen address is empty")
+	}
+	if c.BaudRate <= 0 || c.BaudRate > 4000000 {
+		return nil, fmt.Errorf("bad baud rate:%d", c.BaudRate)
+	}
+	params.BaudRate = c.BaudRate
+	if c.DataBits < 5 || c.DataBits > 8 {
+		return nil, fmt.Errorf("data bits must be 5-8")
+	}
+	params.DataBits = c.DataBits
+	found := false
+	for k, v := range parityNames {
+		if strings.EqualFold(v, c.Parity) {
+			params.Parity, found = k, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("bad parity:%s", c.Parity)
+	}
+	found = false
+	for k, v := range stopBitsNames {
+		if v == c.StopBits {
+			params.StopBits, found = k, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("bad stop bits:%s", c.StopBits)
+	}
+	return
+}
+
+// SerialPortInfo merges what the OS reports about a port with its
+// configuration.
+type SerialPortInfo struct {
+	Name         string          `json:"name"`
+	Present      bool            `json:"present"`
+	IsUSB        bool            `json:"isUsb,omitempty"`
+	VID          string          `json:"vid,omitempty"`
+	PID          string          `json:"pid,omitempty"`
+	SerialNumber string          `json:"serialNumber,omitempty"`
+	Product      string          `json:"product,omitempty"`
+	ById         string          `json:"byId,omitempty"`
+	Device       string          `json:"device,omitempty"` // what a port configured by match resolves to
+	Conf         *SerialPortConf `json:"conf,omitempty"`
+	Running      bool            `json:"running"`
+	Bridge       *BridgeInfo     `json:"bridge,omitempty"`
+}
+
+// SerialManager owns the configuration of all serial ports and the
+// SerialCtx opened for each of them.
+type SerialManager struct {
+	Path string
+
+	mu      sync.Mutex
+	confs   map[string]*SerialPortConf
+	ctxs    map[string]*SerialCtx
+	bridges map[string]*SerialBridge
+
+	hotplugStop chan struct{}
+	hotplugSubs map[int]func(*SerialHotplugEvent)
+	hotplugId   int
+}
+
+func NewSerialManager(path string) *SerialManager {
+	return &SerialManager{
+		Path:    path,
+		confs:   make(map[string]*SerialPortConf),
+		ctxs:    make(map[string]*SerialCtx),
+		bridges: make(map[string]*SerialBridge),
+
+		hotplugSubs: make(map[int]func(*SerialHotplugEvent)),
+	}
+}
+
+// ResolvePortName maps a short name such as "ttyUSB0" to its device path.
+func ResolvePortName(name string) string {
+	if runtime.GOOS != "windows" && !strings.HasPrefix(name, "/") {
+		return "/dev/" + name
+	}
+	return name
+}
+
+func (m *SerialManager) Load() error {
+	if m.Path == "" || !Exists(m.Path) {
+		return nil
+	}
+	buf, err := os.ReadFile(m.Path)
+	if err != nil {
+		return err
+	}
+	var confs []*SerialPortConf
+	if err = json.Unmarshal(buf, &confs); err != nil {
+		return fmt.Errorf("failed to parse %s:%v", m.Path, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range confs {
+		if _, e := c.ToParams(); e != nil {
+			log.Warnf("ignore serial conf of %s: %v", c.Name, e)
+			continue
+		}
+		m.confs[c.Name] = c
+	}
+	log.Printf("%d serial port confs loaded from %s", len(m.confs), m.Path)
+	for name := range m.confs {
+		m.applyBridge(name)
+	}
+	return nil
+}
+
+// save must be called with m.mu held.
+func (m *SerialManager) save() error {
+	if m.Path == "" {
+		return nil
+	}
+	confs := make([]*SerialPortConf, 0, len(m.confs))
+	for _, c := range m.confs {
+		confs = append(confs, c)
+	}
+	sort.Slice(confs, func(i, j int) bool { return confs[i].Name < confs[j].Name })
+	buf, err := json.MarshalIndent(confs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(m.Path); !Exists(dir) {
+		_ = os.MkdirAll(dir, os.ModePerm)
+	}
+	tmp := m.Path + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.Path)
+}
+
+// enumeratePorts returns the ports present on the system by device name.
+func enumeratePorts() (map[string]*SerialPortInfo, error) {
+	found := make(map[string]*SerialPortInfo)
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		// fall back to plain names if USB details are unavailable
+		var names []string
+		if names, err = serial.GetPortsList(); err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			found[name] = &SerialPortInfo{Name: name, Present: true}
+		}
+	}
+	for _, d := range details {
+		found[d.Name] = &SerialPortInfo{
+			Name:         d.Name,
+			Present:      true,
+			IsUSB:        d.IsUSB,
+			VID:          d.VID,
+			PID:          d.PID,
+			SerialNumber: d.SerialNumber,
+			Product:      d.Product,
+		}
+	}
+	for target, link := range serialByIdLinks() {
+		if info, ok := found[target]; ok {
+			info.ById = link
+		}
+	}
+	return found, nil
+}
+
+// List returns every port that is either present or configured.
+func (m *SerialManager) List() (ports []*SerialPortInfo, err error) {
+	found, err := enumeratePorts()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	for name, c := range m.confs {
+		info, ok := found[name]
+		if !ok {
+			info = &SerialPortInfo{Name: name}
+			found[name] = info
+		}
+		info.Conf = c.clone()
+		if c.Match != nil && !c.Match.IsEmpty() {
+			if dev, e := resolveMatch(c.Match); e == nil {
+				info.Device, info.Present = dev, true
+				if d, ok := found[dev]; ok {
+					info.IsUSB, info.VID, info.PID = d.IsUSB, d.VID, d.PID
+					info.SerialNumber, info.Product, info.ById = d.SerialNumber, d.Product, d.ById
+				}
+			}
+		}
+	}
+	for name, ctx := range m.ctxs {
+		if info, ok := found[name]; ok {
+			info.Running = ctx.IsRunning()
+		}
+	}
+	for name, b := range m.bridges {
+		if info, ok := found[name]; ok {
+			info.Bridge = b.Info()
+		}
+	}
+	m.mu.Unlock()
+	for _, info := range found {
+		ports = append(ports, info)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return
+}
+
+func (m *SerialManager) Get(name string) (*SerialPortInfo, error) {
+	name = ResolvePortName(name)
+	ports, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ports {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("serial port %s not found", name)
+}
+
+// GetConf returns the configuration of a port, or the defaults if the port
+// has not been configured yet.
+func (m *SerialManager) GetConf(name string) *SerialPortConf {
+	name = ResolvePortName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.confs[name]; ok {
+		return c.clone()
+	}
+	return DefaultSerialPortConf(name)
+}
+
+// SetConf validates and persists a port configuration and applies the new
+// mode to the port if it is open.
+func (m *SerialManager) SetConf(conf *SerialPortConf) error {
+	// ResolvePortName turns "" into "/dev/"
+	if strings.TrimSpace(conf.Name) == "" {
+		return fmt.Errorf("port name is empty")
+	}
+	conf.Name = ResolvePortName(conf.Name)
+	params, err := conf.ToParams()
+	if err != nil {
+		return err
+	}
+	var stale *SerialCtx
+	var staleBridge *SerialBridge
+	m.mu.Lock()
+	m.confs[conf.Name] = conf
+	if ctx, ok := m.ctxs[conf.Name]; ok {
+		ctx.SetResolver(matchResolver(conf.Match))
+	}
+	if b, ok := m.bridges[conf.Name]; ok && (conf.Bridge == nil || b.Conf != *conf.Bridge || !conf.Enabled) {
+		staleBridge = b
+		delete(m.bridges, conf.Name)
+	}
+	if ctx, ok := m.ctxs[conf.Name]; ok {
+		if e := ctx.SetMode(params.Mode); e != nil {
+			log.Warnf("failed to apply mode to %s: %v", conf.Name, e)
+		}
+		if !conf.Enabled {
+			stale = ctx
+			delete(m.ctxs, conf.Name)
+		}
+	}
+	err = m.save()
+	m.mu.Unlock()
+	// both Stops wait for the reader goroutine; hotplug takes m.mu as well,
+	// so holding it here can deadlock
+	if staleBridge != nil {
+		staleBridge.Stop()
+	}
+	if stale != nil {
+		stale.Stop()
+	}
+	// the old bridge has released its listen address by now
+	m.mu.Lock()
+	m.applyBridge(conf.Name)
+	m.mu.Unlock()
+	return err
+}
+
+// applyBridge starts the TCP bridge of a port if it is configured and not
+// running yet. It must be called with m.mu held.
+func (m *SerialManager) applyBridge(name string) {
+	conf := m.confs[name]
+	if _, ok := m.bridges[name]; ok || conf == nil || !conf.Enabled || conf.Bridge == nil || !conf.Bridge.Enabled {
+		return
+	}
+	ctx, err := m.ctx(name)
+	if err != nil {
+		log.Warnf("failed to start serial bridge of %s: %v", name, err)
+		return
+	}
+	b := NewSerialBridge(ctx, *conf.Bridge)
+	if err = b.Start(); err != nil {
+		log.Warnf("failed to start serial bridge of %s: %v", name, err)
+		return
+	}
+	m.bridges[name] = b
+}
+
+func matchResolver(p *SerialPortMatch) func() (string, error) {
+	if p == nil || p.IsEmpty() {
+		return nil
+	}
+	match := *p
+	return func() (string, error) {
+		return resolveMatch(&match)
+	}
+}
+
+// Bridge returns the running TCP bridge of a port, if any.
+func (m *SerialManager) Bridge(name string) *SerialBridge {
+	name = ResolvePortName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bridges[name]
+}
+
+func (m *SerialManager) SetEnabled(name string, enabled bool) error {
+	conf := m.GetConf(name)
+	conf.Enabled = enabled
+	return m.SetConf(conf)
+}
+
+// Ctx returns the SerialCtx of an enabled port, creating it on first use.
+func (m *SerialManager) Ctx(name string) (*SerialCtx, error) {
+	name = ResolvePortName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ctx(name)
+}
+
+// ctx must be called with m.mu held.
+func (m *SerialManager) ctx(name string) (*SerialCtx, error) {
+	if ctx, ok := m.ctxs[name]; ok {
+		return ctx, nil
+	}
+	conf, ok := m.confs[name]
+	if !ok || !conf.Enabled {
+		return nil, fmt.Errorf("serial port %s is not enabled", name)
+	}
+	params, err := conf.ToParams()
+	if err != nil {
+		return nil, err
+	}
+	ctx := NewSerialCtx(params)
+	ctx.SetResolver(matchResolver(conf.Match))
+	m.ctxs[name] = ctx
+	return ctx, nil
+}
+
+// Close stops every SerialCtx created by the manager.
+func (m *SerialManager) Close() {
+	m.mu.Lock()
+	bridges := make([]*SerialBridge, 0, len(m.bridges))
+	for name, b := range m.bridges {
+		bridges = append(bridges, b)
+		delete(m.bridges, name)
+	}
+	ctxs := make([]*SerialCtx, 0, len(m.ctxs))
+	for name, ctx := range m.ctxs {
+		ctxs = append(ctxs, ctx)
+		delete(m.ctxs, name)
+	}
+	m.mu.Unlock()
+	// stopped without m.mu for the same reason as in SetConf
+	for _, b := range bridges {
+		b.Stop()
+	}
+	for _, ctx := range ctxs {
+		ctx.Stop()
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"system-conf/common/log"
+	"time"
+)
+
+const (
+	DefaultTransactTimeout = time.Second
+	// DefaultTransactIdle is the silence that ends a reply when there is no
+	// matcher; OS read timeouts are too coarse to go much lower.
+	DefaultTransactIdle = 50 * time.Millisecond
+)
+
+var (
+	ErrTransactTimeout = errors.New("serial: reply timeout")
+	ErrReplyMismatch   = errors.New("serial: reply does not match the request")
+)
+
+// ReplyMatcher decides when the bytes received after request form a reply.
+// It returns the length of a complete reply at the start of buf, 0 if more
+// bytes are needed, or an error if buf cannot be the reply, which fails
+// the attempt.
+type ReplyMatcher func(request, buf []byte) (int, error)
+
+// MatchLength expects a reply of exactly n bytes.
+func MatchLength(n int) ReplyMatcher {
+	return func(_, buf []byte) (int, error) {
+		if len(buf) >= n {
+			return n, nil
+		}
+		return 0, nil
+	}
+}
+
+// MatchDelimiter expects a reply terminated by delim, which is included in
+// the reply.
+func MatchDelimiter(delim []byte) ReplyMatcher {
+	return func(_, buf []byte) (int, error) {
+		if i := bytes.Index(buf, delim); i >= 0 {
+			return i + len(delim), nil
+		}
+		return 0, nil
+	}
+}
+
+// MatchPrefix expects a reply starting with prefix and completed by next,
+// e.g. an address byte echoed by the device.
+func MatchPrefix(prefix []byte, next ReplyMatcher) ReplyMatcher {
+	return func(request, buf []byte) (int, error) {
+		n := len(prefix)
+		if len(buf) < n {
+			n = len(buf)
+		}
+		if !bytes.Equal(buf[:n], prefix[:n]) {
+			return 0, ErrReplyMismatch
+		}
+		if len(buf) < len(prefix) {
+			return 0, nil
+		}
+		return next(request, buf)
+	}
+}
+
+type transactKey int
+
+const (
+	transactTimeoutKey transactKey = iota
+	transactRetriesKey
+	transactIdleKey
+)
+
+// WithTransactTimeout sets how long each attempt of Transact waits for the
+// reply.
+func WithTransactTimeout(cx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(cx, transactTimeoutKey, timeout)
+}
+
+// WithTransactRetries sets how often Transact resends a request that got
+// no or a bad reply.
+func WithTransactRetries(cx context.Context, retries int) context.Context {
+	return context.WithValue(cx, transactRetriesKey, retries)
+}
+
+// WithTransactIdle sets the silence that ends a reply.
+func WithTransactIdle(cx context.Context, idle time.Duration) context.Context {
+	return context.WithValue(cx, transactIdleKey, idle)
+}
+
+func contextDuration(cx context.Context, key transactKey, def time.Duration) time.Duration {
+	if v, ok := cx.Value(key).(time.Duration); ok && v > 0 {
+		return v
+	}
+	return def
+}
+
+// Acquire waits for exclusive use of the port for a request/response
+// exchange. Callers queue up until the holder calls release or cx is done.
+func (ctx *SerialCtx) Acquire(cx context.Context) (release func(), err error) {
+	ctx.pending.Add(1)
+	defer ctx.pending.Add(-1)
+	select {
+	case ctx.txq <- struct{}{}:
+		return func() { <-ctx.txq }, nil
+	case <-cx.Done():
+		return nil, cx.Err()
+	}
+}
+
+// Pending returns the number of callers waiting in Acquire.
+func (ctx *SerialCtx) Pending() int {
+	return int(ctx.pending.Load())
+}
+
+// Transact writes request and waits for the reply recognized by match; a
+// nil match takes everything received until the line goes idle. Failed
+// attempts are retried, see WithTransactTimeout and WithTransactRetries.
+// Concurrent callers are served one at a time. The port must not be run
+// by RunAsSlave.
+func (ctx *SerialCtx) Transact(cx context.Context, request []byte, match ReplyMatcher) (reply []byte, err error) {
+	release, err := ctx.Acquire(cx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	retries := 0
+	if v, ok := cx.Value(transactRetriesKey).(int); ok {
+		retries = v
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = cx.Err(); err != nil {
+			return
+		}
+		if reply, err = ctx.transact(cx, request, match); err == nil {
+			return
+		}
+		log.Warnf("serial %s: transaction failed (attempt %d): %v", ctx.Params.Name, attempt+1, err)
+	}
+	return
+}
+
+func (ctx *SerialCtx) transact(cx context.Context, request []byte, match ReplyMatcher) ([]byte, error) {
+	port, err := ctx.OpenPort()
+	if err != nil {
+		return nil, err
+	}
+	_ = port.ResetInputBuffer()
+	if _, err = port.Write(request); err != nil {
+		ctx.ClosePort()
+		return nil, err
+	}
+	deadline := time.Now().Add(contextDuration(cx, transactTimeoutKey, DefaultTransactTimeout))
+	if d, ok := cx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	idle := contextDuration(cx, transactIdleKey, DefaultTransactIdle)
+	reply := make([]byte, 0, 256)
+	buf := make([]byte, 256)
+	for {
+		wait := time.Until(deadline)
+		if match == nil && len(reply) > 0 && wait > idle {
+			wait = idle
+		}
+		if wait <= 0 {
+			if len(reply) == 0 || match != nil {
+				return nil, ErrTransactTimeout
+			}
+			return reply, nil
+		}
+		if err = port.SetReadTimeout(wait); err != nil {
+			return nil, err
+		}
+		n, err := port.Read(buf)
+		if err != nil {
+			ctx.ClosePort()
+			return nil, err
+		}
+		if n == 0 {
+			if len(reply) > 0 && match == nil {
+				return reply, nil
+			}
+			continue
+		}
+		reply = append(reply, buf[:n]...)
+		if match != nil {
+			if want, e := match(request, reply); e != nil {
+				return nil, e
+			} else if want > 0 && len(reply) >= want {
+				return reply[:want], nil
+			}
+		}
+		if len(reply) > DefaultMaxFrame {
+			return nil, ErrFrameTooLong
+		}
+	}
+}
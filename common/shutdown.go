@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2023 fjw
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"system-conf/common/log"
+	"time"
+)
+
+// Shutdown stages run in ascending order; hooks of the same stage run
+// concurrently.
+const (
+	ShutdownStageServer  = 10
+	ShutdownStageJobs    = 20
+	ShutdownStageProcess = 30
+	ShutdownStageSession = 40
+	ShutdownStageDevice  = 50
+)
+
+var (
+	// ShutdownTimeout bounds the whole shutdown sequence.
+	ShutdownTimeout = 15 * time.Second
+	// ProcessStopTimeout is how long child process groups get between
+	// SIGTERM and SIGKILL.
+	ProcessStopTimeout = 5 * time.Second
+
+	ErrShuttingDown = errors.New("service is shutting down")
+)
+
+type shutdownHook struct {
+	stage int
+	name  string
+	fn    func(cx context.Context) error
+}
+
+var shutdownMgr = struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+	once  sync.Once
+	cx    context.Context
+	cl    context.CancelFunc
+	code  int
+	done  chan struct{}
+}{done: make(chan struct{})}
+
+func init() {
+	shutdownMgr.cx, shutdownMgr.cl = context.WithCancel(context.Background())
+	OnShutdown(ShutdownStageProcess, "process groups", StopProcessGroups)
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Warnf("got signal %v; shutting down", sig)
+		go func() {
+			<-c
+			log.Warnf("got second signal; exit immediately")
+			os.Exit(1)
+		}()
+		os.Exit(Shutdown(ShutdownTimeout))
+	}()
+}
+
+// OnShutdown registers fn to be called during Shutdown. fn should return
+// once cx is done even if its work is incomplete.
+func OnShutdown(stage int, name string, fn func(cx context.Context) error) {
+	shutdownMgr.mu.Lock()
+	defer shutdownMgr.mu.Unlock()
+	shutdownMgr.hooks = append(shutdownMgr.hooks, shutdownHook{stage, name, fn})
+}
+
+// ShutdownContext is cancelled as soon as Shutdown begins.
+func ShutdownContext() context.Context {
+	return shutdownMgr.cx
+}
+
+func IsShuttingDown() bool {
+	return shutdownMgr.cx.Err() != nil
+}
+
+// Shutdown runs all registered hooks stage by stage within timeout and
+// returns the exit code: 0 when every hook succeeded, 1 otherwise. Only the
+// first call does the work; later calls wait for it and return its result.
+func Shutdown(timeout time.Duration) int {
+	shutdownMgr.once.Do(func() {
+		shutdownMgr.cl()
+		cx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		shutdownMgr.mu.Lock()
+		hooks := append([]shutdownHook(nil), shutdownMgr.hooks...)
+		shutdownMgr.mu.Unlock()
+		sort.SliceStable(hooks, func(i, j int) bool {
+			return hooks[i].stage < hooks[j].stage
+		})
+		failed := false
+		for i := 0; i < len(hooks); {
+			j := i
+			for j < len(hooks) && hooks[j].stage == hooks[i].stage {
+				j++
+			}
+			if runShutdownStage(cx, hooks[i:j]) {
+				failed = true
+			}
+			i = j
+		}
+		if failed {
+			shutdownMgr.code = 1
+		}
+		log.Warnf("shutdown finished with code %d", shutdownMgr.code)
+		close(shutdownMgr.done)
+	})
+	<-shutdownMgr.done
+	return shutdownMgr.code
+}
+
+func runShutdownStage(cx context.Context, hooks []shutdownHook) (failed bool) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, h := range hooks {
+		wg.Add(1)
+		go func(h shutdownHook) {
+			defer wg.Done()
+			tm := time.Now()
+			err := RunWithContext(cx, func() error { return h.fn(cx) })
+			if err != nil {
+				log.Warnf("shutdown %s failed after %v: %v", h.name, time.Since(tm), err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			} else {
+				log.Printf("shutdown %s done in %v", h.name, time.Since(tm))
+			}
+		}(h)
+	}
+	wg.Wait()
+	return
+}
+
+// WaitShutdown blocks until Shutdown has completed and returns its exit code.
+func WaitShutdown() int {
+	<-shutdownMgr.done
+	return shutdownMgr.code
+}
+
+// RunWithContext runs fn and returns its error, or cx.Err() if cx is done
+// first. fn keeps running in the background in that case.
+func RunWithContext(cx context.Context, fn func() error) error {
+	ch := make(chan error, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				ch <- fmt.Errorf("panic: %v", e)
+			}
+		}()
+		ch <- fn()
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-cx.Done():
+		return cx.Err()
+	}
+}
@@ -1,20 +1,73 @@
 package common
 
-import "golang.org/x/text/encoding/simplifiedchinese"
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+)
 
 type Charset string
 
 const (
-	UTF8    = Charset("UTF-8")
-	GB18030 = Charset("GB18030")
+	UTF8        = Charset("UTF-8")
+	GB18030     = Charset("GB18030")
+	GBK         = Charset("GBK")
+	Big5        = Charset("Big5")
+	CharsetAuto = Charset("auto")
 )
 
+// ParseCharset maps a user supplied name (case-insensitive, "utf8",
+// "gb2312", ...) to a Charset. Unknown names fall back to UTF8.
+func ParseCharset(name string) Charset {
+	switch strings.ToLower(strings.ReplaceAll(name, "_", "-")) {
+	case "gb18030":
+		return GB18030
+	case "gbk", "gb2312", "cp936":
+		return GBK
+	case "big5", "big-5", "cp950":
+		return Big5
+	case "auto", "detect":
+		return CharsetAuto
+	}
+	return UTF8
+}
+
+func (cs Charset) encoding() encoding.Encoding {
+	switch cs {
+	case GB18030:
+		return simplifiedchinese.GB18030
+	case GBK:
+		return simplifiedchinese.GBK
+	case Big5:
+		return traditionalchinese.Big5
+	}
+	return nil
+}
+
+// NewTransformer returns a decoder from cs to UTF-8 that holds back
+// incomplete multi-byte sequences until more input arrives.
+func (cs Charset) NewTransformer() transform.Transformer {
+	if cs == CharsetAuto {
+		return &autoDecoder{}
+	}
+	if enc := cs.encoding(); enc != nil {
+		return enc.NewDecoder()
+	}
+	return utf8Boundary{}
+}
+
 func ConvertByte2String(byte []byte, charset Charset) string {
 
 	var str string
 	switch charset {
-	case GB18030:
-		var decodeBytes, _ = simplifiedchinese.GB18030.NewDecoder().Bytes(byte)
+	case GB18030, GBK, Big5, CharsetAuto:
+		var decodeBytes, _, _ = transform.Bytes(charset.NewTransformer(), byte)
 		str = string(decodeBytes)
 	case UTF8:
 		fallthrough
@@ -24,3 +77,138 @@ func ConvertByte2String(byte []byte, charset Charset) string {
 
 	return str
 }
+
+// NewCharsetReader decodes r to UTF-8. Reads may still end in the middle of a
+// character when the caller's buffer is small; use CharsetDecoder for chunked
+// input that must stay character aligned.
+func NewCharsetReader(r io.Reader, cs Charset) io.Reader {
+	return transform.NewReader(r, cs.NewTransformer())
+}
+
+// CharsetDecoder converts a stream of arbitrary chunks to UTF-8 strings and
+// never splits a multi-byte character across two Decode results.
+type CharsetDecoder struct {
+	t       transform.Transformer
+	pending []byte
+}
+
+func NewCharsetDecoder(cs Charset) *CharsetDecoder {
+	return &CharsetDecoder{t: cs.NewTransformer()}
+}
+
+func (d *CharsetDecoder) Decode(p []byte) string {
+	return d.decode(p, false)
+}
+
+// Flush returns whatever is still buffered, decoding incomplete trailing
+// bytes as replacement characters.
+func (d *CharsetDecoder) Flush() string {
+	s := d.decode(nil, true)
+	d.t.Reset()
+	return s
+}
+
+func (d *CharsetDecoder) decode(p []byte, atEOF bool) string {
+	src := p
+	if len(d.pending) > 0 {
+		src = append(d.pending, p...)
+		d.pending = nil
+	}
+	out := bytes.Buffer{}
+	dst := make([]byte, len(src)*2+16)
+	for len(src) > 0 {
+		nDst, nSrc, err := d.t.Transform(dst, src, atEOF)
+		out.Write(dst[:nDst])
+		src = src[nSrc:]
+		if err == transform.ErrShortDst {
+			if nSrc == 0 && nDst == 0 {
+				dst = make([]byte, len(dst)*2)
+			}
+			continue
+		}
+		if err == transform.ErrShortSrc {
+			d.pending = append([]byte(nil), src...)
+		} else if err != nil {
+			// undecodable input; pass it through untouched
+			out.Write(src)
+		}
+		break
+	}
+	return out.String()
+}
+
+// utf8Tail returns the index at which an incomplete trailing UTF-8
+// sequence begins, or len(p) if p ends on a character boundary.
+func utf8Tail(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return len(p)
+			}
+			return i
+		}
+	}
+	return len(p)
+}
+
+// utf8Boundary passes UTF-8 through unchanged but never emits half a rune.
+type utf8Boundary struct{ transform.NopResetter }
+
+func (utf8Boundary) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	n := len(src)
+	if !atEOF {
+		n = utf8Tail(src)
+	}
+	if n > len(dst) {
+		n = utf8Tail(src[:len(dst)])
+		err = transform.ErrShortDst
+	} else if n < len(src) {
+		err = transform.ErrShortSrc
+	}
+	nDst = copy(dst, src[:n])
+	return nDst, n, err
+}
+
+// autoDecoder sniffs the first non-ASCII input: valid UTF-8 stays UTF-8,
+// anything else is decoded as GB18030. The choice sticks until Reset.
+type autoDecoder struct {
+	t transform.Transformer
+}
+
+func (d *autoDecoder) Reset() {
+	d.t = nil
+}
+
+func (d *autoDecoder) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if d.t == nil {
+		i := 0
+		for i < len(src) && src[i] < utf8.RuneSelf {
+			i++
+		}
+		if i == len(src) {
+			nDst = copy(dst, src)
+			if nDst < len(src) {
+				err = transform.ErrShortDst
+			}
+			return nDst, nDst, err
+		}
+		end := len(src)
+		if !atEOF {
+			end = utf8Tail(src)
+		}
+		if end <= i {
+			// only part of the first non-ASCII character has arrived
+			nDst = copy(dst, src[:i])
+			if err = transform.ErrShortSrc; nDst < i {
+				err = transform.ErrShortDst
+			}
+			return nDst, nDst, err
+		}
+		if utf8.Valid(src[:end]) {
+			d.t = utf8Boundary{}
+		} else {
+			d.t = simplifiedchinese.GB18030.NewDecoder()
+		}
+	}
+	return d.t.Transform(dst, src, atEOF)
+}
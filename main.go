@@ -1,21 +1,41 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 	"system-conf/api"
+	"system-conf/common"
+	"system-conf/common/cron"
+	"system-conf/common/es"
 	"system-conf/common/log"
+	"system-conf/common/mqtt"
+	"system-conf/common/profile"
+	"system-conf/common/s3"
 	"system-conf/version"
 )
 
 type Args struct {
-	Port int
+	Port         int
+	ExecConf     string
+	JobsConf     string
+	JobsRoots    string
+	LogsBucket   string
+	SerialConf   string
+	Profiles     string
+	EventsMqtt   string
+	EventsSub    string
+	EventsFormat string
+	MgmtMqtt     string
+	MgmtAllow    string
 }
 
 func handleDocs(c *gin.Context) {
@@ -37,7 +57,26 @@ func handleDocs(c *gin.Context) {
 func main() {
 	args := &Args{}
 	flag.IntVar(&args.Port, "port", 8081, "service port")
+	flag.StringVar(&args.ExecConf, "exec.conf", "exec.json", "allow-list of diagnostic commands; the built-in list is used if absent")
+	flag.StringVar(&args.JobsConf, "jobs.conf", "jobs.json", "file the scheduled jobs are persisted to")
+	flag.StringVar(&args.JobsRoots, "jobs.roots", "logs", "comma separated directories the disk.cleanup, file.snapshot and log.upload job actions may use")
+	flag.StringVar(&args.LogsBucket, "logs.bucket", "logs", "minio bucket the log.upload job action uploads to")
+	flag.StringVar(&args.SerialConf, "serial.conf", "serial.json", "file the serial port settings are persisted to")
+	flag.StringVar(&args.Profiles, "profiles", "profiles", "directory of serial device profiles (YAML or JSON) to poll")
+	flag.StringVar(&args.EventsMqtt, "events.mqtt", "", "republish the system event stream over mqtt under this topic prefix ({sn} is the serial number); empty disables")
+	flag.StringVar(&args.EventsSub, "events.mqtt.sub", "", "mqtt topic filter fed into the system event stream")
+	flag.StringVar(&args.EventsFormat, "events.mqtt.format", "json", "format of the events republished over mqtt: raw, json, base64, envelope, msgpack or cbor")
+	flag.StringVar(&args.MgmtMqtt, "mgmt.mqtt", "", "serve the /api/system routes over an mqtt 5 connection of its own: requests on <root>/<sn>/req/<route>, responses on <root>/<sn>/res/<route> or the response topic of the request; empty disables")
+	flag.StringVar(&args.MgmtAllow, "mgmt.mqtt.allow", api.DefaultRemoteAllow, "comma separated routes served over mqtt as \"METHOD route\", route being a pattern relative to /api/system and METHOD * for any")
+	flag.StringVar(&log.Sn, "sn", "", "serial number of the device in mqtt topics; the hostname if empty")
+	mqttOpts := &mqtt.Options{}
+	mqttOpts.Parse(false)
+	minioOpts := &s3.MinioOptions{}
+	minioOpts.Parse(false)
 	flag.Parse()
+	if log.Sn == "" {
+		log.Sn, _ = os.Hostname()
+	}
 	engine := gin.Default()
 	apiRoot := engine.Group("/api")
 	apiRoot.GET("/ver", func(c *gin.Context) {
@@ -45,12 +84,106 @@ func main() {
 	})
 
 	ctrl := api.NewController(apiRoot)
+	if conf, e := api.LoadExecConf(args.ExecConf); e != nil {
+		log.Panic(e)
+	} else {
+		ctrl.ExecConf = conf
+	}
+	cron.SetActionRoots(strings.Split(args.JobsRoots, ",")...)
+	if minioOpts.Addr != "" {
+		if mc, e := s3.NewMinioClient(minioOpts); e != nil {
+			log.Warnf("log upload is disabled: %v", e)
+		} else {
+			cron.SetUploader(func(cx context.Context, key, path string) error {
+				_, err := mc.FPutObject(cx, args.LogsBucket, key, path, minio.PutObjectOptions{})
+				return err
+			})
+		}
+	}
+	ctrl.Jobs = cron.NewScheduler(args.JobsConf)
+	if e := ctrl.Jobs.Load(); e != nil {
+		log.Warnf("failed to load jobs: %v", e)
+	}
+	ctrl.Jobs.Start()
+	common.OnShutdown(common.ShutdownStageJobs, "jobs", func(cx context.Context) error {
+		ctrl.Jobs.Stop()
+		return nil
+	})
 	ctrl.AutoBindSystem()
+	ctrl.AutoBindEvents()
 
 	apiRoot.GET("/docs/*any", handleDocs)
-	err := engine.Run(fmt.Sprintf(":%d", args.Port))
-	if err != nil {
-		log.Panic(err)
+	ctrl.Serial = common.NewSerialManager(args.SerialConf)
+	if e := ctrl.Serial.Load(); e != nil {
+		log.Warnf("failed to load serial conf: %v", e)
 	}
+	ctrl.WatchSerial()
+	common.OnShutdown(common.ShutdownStageDevice, "serial hotplug", func(cx context.Context) error {
+		ctrl.Serial.StopHotplug()
+		return nil
+	})
+	ctrl.Profiles = profile.NewRunner(args.Profiles, ctrl.Serial, nil)
+	if mqttOpts.IsEnabled() {
+		session := mqtt.NewPersistSession(mqttOpts)
+		ctrl.Profiles.Publisher = session
+		bridge := es.NewMqttBridge(ctrl.Events, session)
+		if args.EventsMqtt != "" {
+			bridge.Prefix = args.EventsMqtt
+			if enc, e := es.ParseEncoding(args.EventsFormat, "", 0); e != nil {
+				log.Warnf("invalid events.mqtt.format: %v", e)
+			} else {
+				bridge.Encoding = enc
+			}
+			if e := bridge.Start(); e != nil {
+				log.Warnf("failed to bridge events to mqtt: %v", e)
+			}
+		}
+		if args.EventsSub != "" {
+			if e := bridge.Subscribe(args.EventsSub, 0); e != nil {
+				log.Warnf("failed to feed %s into the events: %v", args.EventsSub, e)
+			}
+		}
+		common.OnShutdown(common.ShutdownStageServer, "events mqtt bridge", func(cx context.Context) error {
+			bridge.Stop()
+			return nil
+		})
+		if args.MgmtMqtt != "" {
+			remote := api.NewMqttRemote(mqttOpts, engine, args.MgmtMqtt)
+			remote.Allow = strings.Split(args.MgmtAllow, ",")
+			if e := remote.Start(); e != nil {
+				log.Warnf("failed to serve the api over mqtt: %v", e)
+			}
+			common.OnShutdown(common.ShutdownStageServer, "mqtt remote", func(cx context.Context) error {
+				remote.Stop(cx)
+				return nil
+			})
+		}
+	}
+	if e := ctrl.Profiles.Load(); e != nil {
+		log.Warnf("failed to load serial profiles: %v", e)
+	}
+	common.OnShutdown(common.ShutdownStageJobs, "serial profiles", func(cx context.Context) error {
+		ctrl.Profiles.Stop()
+		return nil
+	})
 
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", args.Port),
+		Handler: engine,
+	}
+	common.OnShutdown(common.ShutdownStageServer, "http server", func(cx context.Context) error {
+		// give in-flight requests a bounded time to drain, then drop them so
+		// their request contexts stop any processes they started
+		dc, cancel := context.WithTimeout(cx, common.ProcessStopTimeout)
+		defer cancel()
+		if err := srv.Shutdown(dc); err != nil {
+			_ = srv.Close()
+		}
+		return nil
+	})
+	log.Printf("listening and serving HTTP on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Panic(err)
+	}
+	os.Exit(common.WaitShutdown())
 }